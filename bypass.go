@@ -0,0 +1,85 @@
+package puppy
+
+/*
+Tunneling connections to their destination without intercepting them
+*/
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// BypassReason is why a connection was tunneled to its destination without being intercepted
+type BypassReason string
+
+const (
+	// The destination matched the CIDR ranges set with SetInterceptCIDR
+	BypassCIDR BypassReason = "cidr"
+
+	// The listener is in log-only mode
+	BypassLogOnly BypassReason = "log only"
+
+	// A client rejected the handshake for the destination and SetFallbackToPassthroughOnHandshakeFail is enabled
+	BypassHandshakeFailed BypassReason = "handshake failed"
+)
+
+// Decide whether a connection to a destination should be tunneled without being intercepted and why
+func (listener *ProxyListener) bypassReason(host string) (BypassReason, bool) {
+	if listener.getLogOnlyMode() {
+		return BypassLogOnly, true
+	}
+	if listener.bypassDest(host) {
+		return BypassCIDR, true
+	}
+	if listener.handshakeFailedFor(host) {
+		return BypassHandshakeFailed, true
+	}
+	return "", false
+}
+
+// Tunnel a connection directly to the given destination without intercepting it. Blocks until the tunnel is closed
+func (listener *ProxyListener) passthrough(pconn *proxyConn, host string, port int, reason BypassReason) error {
+	listener.logConnf(pconn, "Passing connection %d through to: Host='%s', Port=%d", pconn.Id(), host, port)
+	dialHost, dialPort := listener.rewriteDest(host, port)
+	upstream, err := listener.dialTunnel(dialHost, dialPort, false)
+	if err != nil {
+		return &translateError{
+			statusCode: http.StatusBadGateway,
+			err:        fmt.Errorf("could not dial passthrough destination: %s", err),
+		}
+	}
+	listener.reportBypass(pconn, host, port, reason)
+	pconn.handOff.release()
+	relay(pconn, upstream)
+	return nil
+}
+
+// Record that a connection is being tunneled without being intercepted so that operators can audit what the proxy can't see
+func (listener *ProxyListener) reportBypass(pconn *proxyConn, host string, port int, reason BypassReason) {
+	listener.logConnf(pconn, "Interception bypassed for connection %d: reason=%s host=%s port=%d", pconn.Id(), reason, host, port)
+	listener.emitEventFor(pconn, ProxyEvent{
+		Kind:   EventInterceptionBypassed,
+		Detail: string(reason),
+		Host:   host,
+		Port:   port,
+	})
+}
+
+// Copy data between two connections until one side is done then close both
+func relay(client net.Conn, upstream net.Conn) {
+	defer client.Close()
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, client)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
@@ -0,0 +1,194 @@
+package puppy
+
+/*
+Caching the certificates signed for hosts so they don't have to be signed again, including across restarts
+*/
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The most certificates kept in a listener's certificate cache
+const maxCertCacheEntries = 4096
+
+// The most bytes read by LoadCertCache. Dumps of a full cache are well under this
+const maxCertCacheDumpSize = 32 * 1024 * 1024
+
+// Certificates signed by a CA for a set of hosts
+type certCache struct {
+	mtx     sync.Mutex
+	entries map[string]tls.Certificate
+}
+
+func newCertCache() *certCache {
+	return &certCache{entries: make(map[string]tls.Certificate)}
+}
+
+// The key of the certificate for a set of hosts signed by a CA
+func certCacheKey(ca *tls.Certificate, hosts []string) string {
+	sorted := append([]string(nil), hosts...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256(ca.Certificate[0])
+	return fmt.Sprintf("%x|%s", sum, strings.Join(sorted, ","))
+}
+
+// Signs certificates with a CA through a listener's certificate cache. Used when no CertSigner is set
+type cachingCertSigner struct {
+	cache *certCache
+	ca    *tls.Certificate
+}
+
+func (s cachingCertSigner) SignHost(hostnames []string) (tls.Certificate, error) {
+	return s.cache.sign(s.ca, hostnames)
+}
+
+// Get the certificate for a set of hosts from the cache, signing and caching it if needed
+func (c *certCache) sign(ca *tls.Certificate, hosts []string) (tls.Certificate, error) {
+	key := certCacheKey(ca, hosts)
+	c.mtx.Lock()
+	cert, ok := c.entries[key]
+	c.mtx.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	cert, err := signHost(*ca, hosts)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	c.add(key, cert)
+	return cert, nil
+}
+
+func (c *certCache) add(key string, cert tls.Certificate) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxCertCacheEntries {
+		// Make room by dropping an arbitrary entry
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = cert
+}
+
+// DumpCertCache writes the certificates the listener has signed for hosts and their private keys to w as PEM so that they can be restored with LoadCertCache
+func (listener *ProxyListener) DumpCertCache(w io.Writer) error {
+	cache := listener.certCache
+	cache.mtx.Lock()
+	certs := make([]tls.Certificate, 0, len(cache.entries))
+	for _, cert := range cache.entries {
+		certs = append(certs, cert)
+	}
+	cache.mtx.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, cert := range certs {
+		keyBytes, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+		if err != nil {
+			return err
+		}
+		if err := pem.Encode(bw, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}); err != nil {
+			return err
+		}
+		if err := pem.Encode(bw, &pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// LoadCertCache adds certificates written by DumpCertCache to the listener's cache. Entries that were not signed by the listener's current CA certificate, have expired, or don't match their private key are skipped
+func (listener *ProxyListener) LoadCertCache(r io.Reader) error {
+	ca := listener.GetCACertificate()
+	if ca == nil {
+		return fmt.Errorf("ProxyListener does not have a CA certificate to check cached certificates against")
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxCertCacheDumpSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxCertCacheDumpSize {
+		return fmt.Errorf("certificate cache dump is larger than %d bytes", maxCertCacheDumpSize)
+	}
+
+	for {
+		var certBlock, keyBlock *pem.Block
+		certBlock, data = pem.Decode(data)
+		if certBlock == nil {
+			break
+		}
+		keyBlock, data = pem.Decode(data)
+		if keyBlock == nil {
+			return fmt.Errorf("certificate cache dump ends without a private key")
+		}
+		if certBlock.Type != "CERTIFICATE" || keyBlock.Type != "PRIVATE KEY" {
+			return fmt.Errorf("unexpected %s and %s in certificate cache dump", certBlock.Type, keyBlock.Type)
+		}
+
+		leaf, hosts, ok := validCachedCert(certBlock.Bytes, keyBlock.Bytes, caCert)
+		if !ok {
+			continue
+		}
+		cert := tls.Certificate{
+			Certificate: [][]byte{certBlock.Bytes, ca.Certificate[0]},
+			Leaf:        leaf,
+		}
+		cert.PrivateKey, _ = x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+		listener.certCache.add(certCacheKey(ca, hosts), cert)
+	}
+	return nil
+}
+
+// Check that a cached certificate was signed by the CA, is still valid, and matches its key. Returns the parsed certificate and the hosts it was signed for
+func validCachedCert(certDER, keyDER []byte, ca *x509.Certificate) (*x509.Certificate, []string, bool) {
+	leaf, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, nil, false
+	}
+	if err := leaf.CheckSignatureFrom(ca); err != nil {
+		return nil, nil, false
+	}
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return nil, nil, false
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyDER)
+	if err != nil {
+		return nil, nil, false
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, false
+	}
+	if pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(leaf.PublicKey) {
+		return nil, nil, false
+	}
+
+	hosts := append([]string(nil), leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		hosts = append(hosts, ip.String())
+	}
+	if len(hosts) == 0 {
+		return nil, nil, false
+	}
+	return leaf, hosts, true
+}
@@ -4,12 +4,15 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
 	"math/big"
     "os"
+	"strings"
 	"time"
 )
 
@@ -117,3 +120,103 @@ func (pair *CAKeyPair) CACertPEM() []byte {
 		},
 	)
 }
+
+// FingerprintAlgo is a hash algorithm used to fingerprint a certificate
+type FingerprintAlgo int
+
+const (
+	FingerprintSHA256 FingerprintAlgo = iota
+	FingerprintSHA1
+)
+
+// CACertFingerprint returns the fingerprint of the first certificate in cert as colon separated uppercase hex, the same format used by browsers and openssl. Returns an empty string if there is no certificate
+func CACertFingerprint(cert *tls.Certificate, algo FingerprintAlgo) string {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return ""
+	}
+
+	var sum []byte
+	switch algo {
+	case FingerprintSHA1:
+		h := sha1.Sum(cert.Certificate[0])
+		sum = h[:]
+	default:
+		h := sha256.Sum256(cert.Certificate[0])
+		sum = h[:]
+	}
+
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// CertSigner creates the certificates served to clients when stripping TLS. Implementations can keep the CA private key somewhere else such as an HSM or a remote signing service
+type CertSigner interface {
+	// SignHost returns a certificate valid for all of the given hostnames and IP addresses along with its private key
+	SignHost(hostnames []string) (tls.Certificate, error)
+}
+
+// CertForHost returns the certificate that would be served to clients connecting to host when TLS is stripped, signed the same way and taken from the same cache. Leaf is set on the returned certificate. Uses the ProxyListener's CA certificate rather than any set for individual listeners
+func (listener *ProxyListener) CertForHost(host string) (*tls.Certificate, error) {
+	cert, leaf, err := signHostCert(listener.getCertSigner(), listener.GetCACertificate(), listener.certCache, listener.getExtraSANs(), host)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf = leaf
+	return &cert, nil
+}
+
+// Matches a *SignHostError with errors.Is
+const ErrSignHost = ConstErr("could not sign certificate")
+
+// SignHostError is returned when TLS could not be stripped from a connection because a certificate could not be signed for it, such as when the CA certificate or its key is invalid
+type SignHostError struct {
+	// The hostname the certificate was for
+	Host string
+
+	// Why signing failed
+	Err error
+}
+
+func (e *SignHostError) Error() string {
+	return fmt.Sprintf("could not sign certificate for %s: %s", e.Host, e.Err)
+}
+
+func (e *SignHostError) Unwrap() error {
+	return e.Err
+}
+
+func (e *SignHostError) Is(target error) bool {
+	return target == ErrSignHost
+}
+
+// Signs certificates in-process using a CA certificate and its private key
+type caCertSigner struct {
+	ca *tls.Certificate
+}
+
+// NewCACertSigner returns a CertSigner that signs certificates with the given CA certificate. This is what is used when no CertSigner is set
+func NewCACertSigner(ca *tls.Certificate) CertSigner {
+	return caCertSigner{ca: ca}
+}
+
+func (s caCertSigner) SignHost(hostnames []string) (tls.Certificate, error) {
+	return signHost(*s.ca, hostnames)
+}
+
+// SetCertSigner sets what signs the certificates used to strip TLS. When set, it is used instead of the CA certificate of the listener, including any CA given in ListenerOptions. Passing nil goes back to signing with the CA certificate
+func (listener *ProxyListener) SetCertSigner(signer CertSigner) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.certSigner = signer
+}
+
+func (listener *ProxyListener) getCertSigner() CertSigner {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.certSigner
+}
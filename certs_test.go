@@ -0,0 +1,143 @@
+package puppy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testFingerprintCert = `-----BEGIN CERTIFICATE-----
+MIIBhzCCAS2gAwIBAgIUUfcuKmHzk4UwVP8Od09/983y9CUwCgYIKoZIzj0EAwIw
+GDEWMBQGA1UEAwwNcHVwcHkgdGVzdCBDQTAgFw0yNjEwMTQxMDIxMTlaGA8yMTI2
+MDkyMDEwMjExOVowGDEWMBQGA1UEAwwNcHVwcHkgdGVzdCBDQTBZMBMGByqGSM49
+AgEGCCqGSM49AwEHA0IABHV/5Qenw52EtsF9rTwgofhrmvd3QY0m6XAcVtQEjvAm
+FUOl0bLMaeEVYCe13zJaKBJ+ol4gxeYfQONZxJTBJ0ujUzBRMB0GA1UdDgQWBBTP
+M+nItpBLWw9MS1mz07/lw0EBuDAfBgNVHSMEGDAWgBTPM+nItpBLWw9MS1mz07/l
+w0EBuDAPBgNVHRMBAf8EBTADAQH/MAoGCCqGSM49BAMCA0gAMEUCIBLta4qvkVoZ
+0JNPTnwSXTqvHjgwB3hITZdW9p86f8+nAiEA2AfNwJdmJh0LmAZ6my4nLKfh+xRJ
+14lA+Za4dvOyb44=
+-----END CERTIFICATE-----
+`
+
+func TestCACertFingerprint(t *testing.T) {
+	block, _ := pem.Decode([]byte(testFingerprintCert))
+	if block == nil {
+		t.Fatal("could not decode test certificate")
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{block.Bytes}}
+
+	// Expected values from `openssl x509 -noout -fingerprint`
+	checkStr(t, CACertFingerprint(cert, FingerprintSHA256),
+		"42:FC:8F:4A:9D:A4:7A:14:70:03:86:92:77:3A:4A:CC:73:A6:3F:AD:01:2B:1D:D0:21:BC:47:9E:76:A4:CE:5F")
+	checkStr(t, CACertFingerprint(cert, FingerprintSHA1),
+		"BD:75:1C:94:65:55:C3:E3:10:07:5D:05:AF:FA:69:1A:1C:70:AF:46")
+	checkStr(t, CACertFingerprint(nil, FingerprintSHA256), "")
+}
+
+// Signs with the test CA and records what it was asked to sign
+type testSigner struct {
+	mtx    sync.Mutex
+	ca     CertSigner
+	signed [][]string
+}
+
+func (s *testSigner) SignHost(hostnames []string) (tls.Certificate, error) {
+	s.mtx.Lock()
+	s.signed = append(s.signed, hostnames)
+	s.mtx.Unlock()
+	return s.ca.SignHost(hostnames)
+}
+
+func TestCertSigner(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	signer := &testSigner{ca: NewCACertSigner(testCA(t))}
+	// The listener has no CA certificate of its own so all signing has to go through the signer
+	plistener.SetCertSigner(signer)
+
+	testAcceptAsync(plistener)
+	tlsc, err := testConnectTLS(t, addr, "example.com:443", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsc.Close()
+
+	checkStr(t, strings.Join(tlsc.ConnectionState().PeerCertificates[0].DNSNames, ","), "example.com")
+	signer.mtx.Lock()
+	defer signer.mtx.Unlock()
+	if len(signer.signed) != 1 {
+		t.Fatalf("expected signer to be used once, used %d times", len(signer.signed))
+	}
+	checkStr(t, strings.Join(signer.signed[0], ","), "example.com")
+}
+
+func TestSignHostError(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+	// A CA whose certificate can't be parsed so nothing can be signed with it
+	plistener.SetCACertificate(&tls.Certificate{
+		Certificate: [][]byte{[]byte("not a certificate")},
+		PrivateKey:  testCA(t).PrivateKey,
+	})
+	events := make(chan ProxyEvent, 1)
+	plistener.SetEventHandler(func(event ProxyEvent) {
+		if event.Kind == EventSignHostFailed {
+			events <- event
+		}
+	})
+
+	_, err := testConnectTLS(t, addr, "example.com:443", nil)
+	if err == nil || !strings.Contains(err.Error(), "internal error") {
+		t.Errorf("expected the client to get an internal error alert, got %v", err)
+	}
+	select {
+	case event := <-events:
+		checkStr(t, event.Host, "example.com")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for sign host event")
+	}
+
+	var signErr error = &SignHostError{Host: "example.com", Err: fmt.Errorf("broken")}
+	if !errors.Is(signErr, ErrSignHost) {
+		t.Error("expected SignHostError to match ErrSignHost")
+	}
+}
+
+func TestCertForHost(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+	plistener.SetCACertificate(testCA(t))
+	plistener.SetExtraSANs(func(hostname string) ([]string, []net.IP) {
+		return []string{"www." + hostname}, nil
+	})
+
+	cert, err := plistener.CertForHost("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStr(t, strings.Join(cert.Leaf.DNSNames, ","), "example.com,www.example.com")
+	if n := testCertCacheLen(plistener); n != 1 {
+		t.Errorf("expected the certificate to be cached, cache has %d entries", n)
+	}
+
+	testAcceptAsync(plistener)
+	tlsc, err := testConnectTLS(t, addr, "example.com:443", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsc.Close()
+	served := tlsc.ConnectionState().PeerCertificates[0]
+	if !bytes.Equal(served.Raw, cert.Leaf.Raw) {
+		t.Error("served certificate does not match the one from CertForHost")
+	}
+
+	if _, err := NewProxyListener(nil).CertForHost("example.com"); !errors.Is(err, ErrSignHost) {
+		t.Errorf("expected ErrSignHost without a CA certificate, got %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package puppy
+
+/*
+Choosing which destination IP ranges are intercepted
+*/
+
+import (
+	"net"
+	"strings"
+)
+
+// SetInterceptCIDR sets which destination IP ranges should have their connections intercepted. Connections to an address in a bypass range, or outside of every intercept range when any are given, are tunneled directly to their destination without producing a ProxyConn. Bypass ranges take priority over intercept ranges. Pass nil for both to intercept everything.
+func (listener *ProxyListener) SetInterceptCIDR(intercept []*net.IPNet, bypass []*net.IPNet) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.interceptCIDRs = intercept
+	listener.bypassCIDRs = bypass
+}
+
+// Check whether a destination falls outside of the ranges set with SetInterceptCIDR. Only IP addresses can be matched, hostnames are always intercepted
+func (listener *ProxyListener) bypassDest(host string) bool {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	if len(listener.interceptCIDRs) == 0 && len(listener.bypassCIDRs) == 0 {
+		return false
+	}
+
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		return false
+	}
+
+	for _, ipnet := range listener.bypassCIDRs {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	if len(listener.interceptCIDRs) == 0 {
+		return false
+	}
+	for _, ipnet := range listener.interceptCIDRs {
+		if ipnet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
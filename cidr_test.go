@@ -0,0 +1,79 @@
+package puppy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestInterceptCIDR(t *testing.T) {
+	plistener := NewProxyListener(nil)
+
+	checkBypass := func(host string, expected bool) {
+		if plistener.bypassDest(host) != expected {
+			_, f, ln, _ := runtime.Caller(1)
+			t.Errorf("Failed CIDR test at %s:%d. Expected bypass=%t for %s", f, ln, expected, host)
+		}
+	}
+
+	checkBypass("10.1.2.3", false)
+	checkBypass("fd00::1", false)
+
+	plistener.SetInterceptCIDR(nil, testCIDRs(t, "10.0.0.0/8", "fd00::/8"))
+	checkBypass("10.1.2.3", true)
+	checkBypass("11.1.2.3", false)
+	checkBypass("fd00::1", true)
+	checkBypass("[fd00::1]", true)
+	checkBypass("2001:db8::1", false)
+	checkBypass("internal.example", false)
+
+	plistener.SetInterceptCIDR(testCIDRs(t, "192.168.0.0/16", "2001:db8::/32"), testCIDRs(t, "192.168.1.0/24"))
+	checkBypass("192.168.2.1", false)
+	checkBypass("192.168.1.1", true)
+	checkBypass("10.1.2.3", true)
+	checkBypass("2001:db8::1", false)
+	checkBypass("2001:db9::1", true)
+}
+
+func TestInterceptCIDRPassthrough(t *testing.T) {
+	echoAddr := testEchoServer(t)
+	plistener, addr := testProxyListener(t)
+	plistener.SetInterceptCIDR(nil, testCIDRs(t, "127.0.0.0/8"))
+	events := make(chan ProxyEvent, 1)
+	plistener.SetEventHandler(func(e ProxyEvent) {
+		events <- e
+	})
+
+	c := testDial(t, addr)
+	defer c.Close()
+	r := bufio.NewReader(c)
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echoAddr, echoAddr)
+	rsp, err := http.ReadResponse(r, nil)
+	testErr(t, err)
+	if rsp.StatusCode != 200 {
+		t.Fatalf("unexpected CONNECT status %d", rsp.StatusCode)
+	}
+
+	// Would look like a TLS handshake if it were intercepted
+	msg := "\x16not intercepted"
+	c.Write([]byte(msg))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	echoed := make([]byte, len(msg))
+	if _, err := io.ReadFull(r, echoed); err != nil || string(echoed) != msg {
+		t.Errorf("passthrough did not reach destination: %q %v", echoed, err)
+	}
+
+	select {
+	case e := <-events:
+		checkStr(t, e.Kind, EventInterceptionBypassed)
+		checkStr(t, e.Detail, string(BypassCIDR))
+		checkStr(t, net.JoinHostPort(e.Host, fmt.Sprint(e.Port)), echoAddr)
+	default:
+		t.Error("no bypass event was emitted")
+	}
+}
@@ -0,0 +1,111 @@
+package puppy
+
+/*
+Deciding how to handle a connection based on the first bytes the client sends
+*/
+
+import (
+	"time"
+)
+
+// ProtocolClassifier decides what protocol a client is speaking based on the first bytes it sent. The slice has up to the read-ahead length of bytes but may be shorter if the client sent less. Returning ProtocolTLS strips TLS from the connection and then handles it as it would any other TLS connection. Returning ProtocolH2C or ProtocolUnknown passes the connection on without reading any requests from it
+type ProtocolClassifier func(peek []byte) Protocol
+
+// How long to wait for the client to send the full read-ahead length before classifying what has arrived so far
+const classifierReadAheadWait = 100 * time.Millisecond
+
+// DefaultProtocolClassifier treats connections that start with a TLS handshake record as TLS and everything else as HTTP
+func DefaultProtocolClassifier(peek []byte) Protocol {
+	if len(peek) > 0 && peek[0] == '\x16' {
+		return ProtocolTLS
+	}
+	return ProtocolHTTP
+}
+
+// SetProtocolClassifier sets the function used to decide how to handle a connection after a CONNECT request or on a transparent listener. If nil, connections are classified by DefaultProtocolClassifier
+func (listener *ProxyListener) SetProtocolClassifier(classifier ProtocolClassifier) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.classifier = classifier
+}
+
+// SetProtocolReadAhead sets how many bytes are passed to the protocol classifier. Defaults to 1
+func (listener *ProxyListener) SetProtocolReadAhead(n int) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.readAhead = n
+}
+
+func (listener *ProxyListener) getProtocolClassifier() (ProtocolClassifier, int) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	readAhead := listener.readAhead
+	if readAhead < 1 {
+		readAhead = 1
+	}
+	return listener.classifier, readAhead
+}
+
+// Peek at up to n bytes from the start of the connection. Waits for at least one byte but only briefly for the rest
+func (pconn *proxyConn) peekReadAhead(n int) ([]byte, error) {
+	bufConn := pconn.buffered()
+	pconn.mtx.Lock()
+	timeout := pconn.peekTimeout
+	prevDeadline := pconn.readDeadline
+	pconn.mtx.Unlock()
+	if _, err := peekFirstByte(bufConn, timeout, prevDeadline); err != nil {
+		return nil, err
+	}
+	if size := bufConn.reader.Size(); n > size {
+		n = size
+	}
+	if bufConn.reader.Buffered() < n {
+		pconn.mtx.Lock()
+		prevDeadline := pconn.readDeadline
+		pconn.mtx.Unlock()
+
+		wait := time.Now().Add(classifierReadAheadWait)
+		if !prevDeadline.IsZero() && prevDeadline.Before(wait) {
+			wait = prevDeadline
+		}
+		bufConn.SetReadDeadline(wait)
+		bufConn.Peek(n)
+		bufConn.SetReadDeadline(prevDeadline)
+	}
+
+	available := bufConn.reader.Buffered()
+	if available > n {
+		available = n
+	}
+	return bufConn.Peek(available)
+}
+
+// Classify the connection and strip TLS if needed. Returns the protocol the classifier decided on. Connections without a classifier keep the behavior of StartMaybeTLS
+func (listener *ProxyListener) classifyConn(pconn *proxyConn, hostname string) (Protocol, error) {
+	classifier, readAhead := listener.getProtocolClassifier()
+	if classifier == nil {
+		usedTLS, err := pconn.StartMaybeTLS(hostname)
+		if err != nil {
+			return ProtocolUnknown, err
+		}
+		if usedTLS {
+			return ProtocolTLS, nil
+		}
+		return ProtocolHTTP, nil
+	}
+
+	peek, err := pconn.peekReadAhead(readAhead)
+	if err != nil {
+		return ProtocolUnknown, err
+	}
+	protocol := classifier(peek)
+	if protocol == ProtocolTLS {
+		if err := pconn.forceTLS(hostname); err != nil {
+			return ProtocolUnknown, err
+		}
+	}
+	return protocol, nil
+}
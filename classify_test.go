@@ -0,0 +1,104 @@
+package puppy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func testPrefixClassifier(peek []byte) Protocol {
+	switch {
+	case strings.HasPrefix(string(peek), "SSH-"):
+		return ProtocolUnknown
+	case strings.HasPrefix(string(peek), "PRI "):
+		return ProtocolH2C
+	}
+	return DefaultProtocolClassifier(peek)
+}
+
+func TestProtocolClassifierTransparent(t *testing.T) {
+	plistener := NewProxyListener(nil)
+	plistener.SetCACertificate(testCA(t))
+	plistener.SetProtocolClassifier(testPrefixClassifier)
+	plistener.SetProtocolReadAhead(4)
+	addr := testTransparentListener(t, plistener, "10.0.0.1", 22, false)
+
+	tests := []struct {
+		name     string
+		sent     string
+		protocol Protocol
+	}{
+		{"raw", "SSH-2.0-OpenSSH_8.9\r\n", ProtocolUnknown},
+		{"h2c", h2cPreface, ProtocolH2C},
+		{"http", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", ProtocolHTTP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testDial(t, addr)
+			defer c.Close()
+			c.Write([]byte(tt.sent))
+
+			pconn := testAccept(t, plistener)
+			defer pconn.Close()
+			if pconn.Protocol() != tt.protocol {
+				t.Errorf("expected protocol %s, got %s", tt.protocol, pconn.Protocol())
+			}
+			if tt.protocol != ProtocolHTTP {
+				read := make([]byte, len(tt.sent))
+				if _, err := io.ReadFull(pconn, read); err != nil {
+					t.Fatal(err)
+				}
+				checkStr(t, string(read), tt.sent)
+			}
+		})
+	}
+}
+
+func TestProtocolClassifierConnect(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	plistener.SetCACertificate(testCA(t))
+	plistener.SetProtocolClassifier(testPrefixClassifier)
+	plistener.SetProtocolReadAhead(4)
+
+	// Short prefixes are classified once the client stops sending
+	for _, sent := range []string{"SSH-2.0-OpenSSH_8.9\r\n", "SSH"} {
+		c := testDial(t, addr)
+		r := bufio.NewReader(c)
+		fmt.Fprintf(c, "CONNECT example.com:22 HTTP/1.1\r\nHost: example.com:22\r\n\r\n")
+		rsp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsp.StatusCode != 200 {
+			t.Fatalf("unexpected CONNECT status %d", rsp.StatusCode)
+		}
+		c.Write([]byte(sent))
+
+		pconn := testAccept(t, plistener)
+		expected := ProtocolUnknown
+		if len(sent) < 4 {
+			expected = ProtocolHTTP
+		}
+		if pconn.Protocol() != expected {
+			t.Errorf("%q: expected protocol %s, got %s", sent, expected, pconn.Protocol())
+		}
+		checkStr(t, pconn.RemoteAddr().String(), EncodeRemoteAddr("example.com", 22, false))
+		pconn.Close()
+		c.Close()
+	}
+
+	// TLS is still stripped
+	conns := testAcceptAsync(plistener)
+	tlsc, err := testConnectTLS(t, addr, "example.com:443", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsc.Close()
+	pconn := <-conns
+	defer pconn.Close()
+	checkStr(t, pconn.RemoteAddr().String(), EncodeRemoteAddr("example.com", 443, true))
+}
@@ -0,0 +1,117 @@
+package puppy
+
+/*
+Capturing the ClientHello that starts a TLS handshake for analysis outside of puppy
+*/
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+)
+
+// The most bytes of TLS records that will be kept while capturing a ClientHello. Handshakes with bigger ClientHellos still complete but nothing is captured
+const maxClientHelloLength = 64 * 1024
+
+// The sizes of the headers of a TLS record and of a handshake message
+const (
+	tlsRecordHeaderLength    = 5
+	tlsHandshakeHeaderLength = 4
+)
+
+// Records the TLS records containing the ClientHello as the TLS server reads them from the client without changing what it reads
+type helloRecorder struct {
+	net.Conn
+
+	mtx      sync.Mutex
+	buf      []byte
+	done     bool
+	complete bool
+	mem      *connMemory
+}
+
+func (r *helloRecorder) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	if n > 0 {
+		r.record(b[:n])
+	}
+	return n, err
+}
+
+func (r *helloRecorder) record(data []byte) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.done {
+		return
+	}
+	if !r.mem.resize(len(r.buf), len(r.buf)+len(data)) {
+		// Give up on capturing rather than going over the connection's memory limit
+		r.mem.resize(len(r.buf), 0)
+		r.buf = nil
+		r.done = true
+		return
+	}
+	charged := len(r.buf) + len(data)
+	r.buf = append(r.buf, data...)
+	if end, ok := clientHelloEnd(r.buf); ok {
+		r.buf = r.buf[:end]
+		r.done = true
+		r.complete = true
+	} else if end < 0 || len(r.buf) > maxClientHelloLength {
+		r.buf = nil
+		r.done = true
+	}
+	r.mem.resize(charged, len(r.buf))
+}
+
+// The captured records and whether the whole ClientHello was captured
+func (r *helloRecorder) hello() ([]byte, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if !r.complete {
+		return nil, false
+	}
+	return append([]byte(nil), r.buf...), true
+}
+
+// Find where the records holding the ClientHello end. Returns false if more data is needed. A negative end means the data doesn't start with a ClientHello
+func clientHelloEnd(buf []byte) (int, bool) {
+	var handshake []byte
+	pos := 0
+	for pos+tlsRecordHeaderLength <= len(buf) {
+		if buf[pos] != '\x16' {
+			return -1, false
+		}
+		recordLen := int(binary.BigEndian.Uint16(buf[pos+3 : pos+5]))
+		recordEnd := pos + tlsRecordHeaderLength + recordLen
+		if recordEnd > len(buf) {
+			return 0, false
+		}
+		handshake = append(handshake, buf[pos+tlsRecordHeaderLength:recordEnd]...)
+		pos = recordEnd
+
+		if len(handshake) >= tlsHandshakeHeaderLength {
+			if handshake[0] != '\x01' {
+				return -1, false
+			}
+			msgLen := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+			if len(handshake) >= tlsHandshakeHeaderLength+msgLen {
+				return pos, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (pconn *proxyConn) RawClientHello() ([]byte, bool) {
+	pconn.mtx.Lock()
+	recorder := pconn.helloRecorder
+	pconn.mtx.Unlock()
+
+	if recorder == nil {
+		return nil, false
+	}
+	return recorder.hello()
+}
@@ -0,0 +1,89 @@
+package puppy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records everything written to a connection
+type testWriteRecorder struct {
+	net.Conn
+	mtx     sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *testWriteRecorder) Write(b []byte) (int, error) {
+	c.mtx.Lock()
+	c.written.Write(b)
+	c.mtx.Unlock()
+	return c.Conn.Write(b)
+}
+
+func TestRawClientHello(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+	plistener.SetCACertificate(testCA(t))
+	conns := testAcceptAsync(plistener)
+
+	c := testDial(t, addr)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(c, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	rsp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.StatusCode != 200 {
+		t.Fatalf("unexpected CONNECT status %d", rsp.StatusCode)
+	}
+
+	recorder := &testWriteRecorder{Conn: c}
+	tlsc := tls.Client(recorder, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	testErr(t, tlsc.Handshake())
+
+	var pconn ProxyConn
+	select {
+	case pconn = <-conns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for connection")
+	}
+	hello, ok := pconn.RawClientHello()
+	if !ok {
+		t.Fatal("expected ClientHello to be captured")
+	}
+	recorder.mtx.Lock()
+	sent := recorder.written.Bytes()
+	recorder.mtx.Unlock()
+	if len(hello) == 0 || !bytes.HasPrefix(sent, hello) {
+		t.Fatalf("captured ClientHello does not match what the client sent")
+	}
+	if end, ok := clientHelloEnd(sent); !ok || end != len(hello) {
+		t.Errorf("expected %d bytes of ClientHello, captured %d", end, len(hello))
+	}
+}
+
+func TestClientHelloEnd(t *testing.T) {
+	// A ClientHello with a 6 byte body split across two records
+	hello := []byte{
+		0x16, 0x03, 0x01, 0x00, 0x05, 0x01, 0x00, 0x00, 0x06, 0xaa,
+		0x16, 0x03, 0x01, 0x00, 0x05, 0xbb, 0xcc, 0xdd, 0xee, 0xff,
+	}
+	for n := 0; n < len(hello); n++ {
+		if _, ok := clientHelloEnd(hello[:n]); ok {
+			t.Errorf("ClientHello reported complete after %d bytes", n)
+		}
+	}
+	if end, ok := clientHelloEnd(append(hello, 0x17, 0x03)); !ok || end != len(hello) {
+		t.Errorf("expected ClientHello to end at %d, got %d %v", len(hello), end, ok)
+	}
+	if end, _ := clientHelloEnd([]byte("GET / HTTP/1.1\r\n")); end >= 0 {
+		t.Error("expected plaintext to not be a ClientHello")
+	}
+}
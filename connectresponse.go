@@ -0,0 +1,36 @@
+package puppy
+
+/*
+Customizing the response sent to clients once a CONNECT tunnel is set up
+*/
+
+import (
+	"io"
+)
+
+// ConnectResponseWriter writes the response to a CONNECT request for the given destination. Everything written to w is sent to the client as-is before anything is read from the tunnel. Returning an error closes the connection
+type ConnectResponseWriter func(w io.Writer, host string, port int) error
+
+// DefaultConnectResponse writes an HTTP/1.1 200 response with no header fields. A successful response to a CONNECT request is not allowed to have a body so it does not include a Content-Length
+func DefaultConnectResponse(w io.Writer, host string, port int) error {
+	_, err := io.WriteString(w, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return err
+}
+
+// SetConnectResponseWriter sets the function that writes the response to CONNECT requests. Useful for clients that expect a particular status line or HTTP version. If nil, DefaultConnectResponse is used
+func (listener *ProxyListener) SetConnectResponseWriter(writer ConnectResponseWriter) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.connectResponse = writer
+}
+
+func (listener *ProxyListener) getConnectResponseWriter() ConnectResponseWriter {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	if listener.connectResponse == nil {
+		return DefaultConnectResponse
+	}
+	return listener.connectResponse
+}
@@ -0,0 +1,57 @@
+package puppy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestConnectResponseWriter(t *testing.T) {
+	const connect = "CONNECT example.com:8443 HTTP/1.1\r\nHost: example.com:8443\r\n\r\n"
+	readResponse := func(t *testing.T, addr string) string {
+		c := testDial(t, addr)
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write([]byte(connect))
+		var rsp []byte
+		buf := make([]byte, 256)
+		for !bytes.HasSuffix(rsp, []byte("\r\n\r\n")) {
+			n, err := c.Read(buf)
+			rsp = append(rsp, buf[:n]...)
+			if err != nil {
+				break
+			}
+		}
+		return string(rsp)
+	}
+
+	t.Run("default", func(t *testing.T) {
+		_, addr := testProxyListener(t)
+		checkStr(t, readResponse(t, addr), "HTTP/1.1 200 Connection established\r\n\r\n")
+	})
+
+	t.Run("custom", func(t *testing.T) {
+		plistener, addr := testProxyListener(t)
+		plistener.SetConnectResponseWriter(func(w io.Writer, host string, port int) error {
+			_, err := fmt.Fprintf(w, "HTTP/1.0 200 OK\r\nX-Tunnel: %s:%d\r\n\r\n", host, port)
+			return err
+		})
+		checkStr(t, readResponse(t, addr), "HTTP/1.0 200 OK\r\nX-Tunnel: example.com:8443\r\n\r\n")
+	})
+
+	t.Run("error", func(t *testing.T) {
+		plistener, addr := testProxyListener(t)
+		plistener.SetConnectResponseWriter(func(w io.Writer, host string, port int) error {
+			return fmt.Errorf("refusing tunnel")
+		})
+		c := testDial(t, addr)
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write([]byte(connect))
+		if n, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected connection to be closed, read %d bytes: %v", n, err)
+		}
+	})
+}
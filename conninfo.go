@@ -0,0 +1,53 @@
+package puppy
+
+/*
+Snapshots of what is known about a connection
+*/
+
+import (
+	"net"
+)
+
+// ConnInfo is a snapshot of what is known about a ProxyConn
+type ConnInfo struct {
+	Id          int
+	ClientAddr  net.Addr
+	DestHost    string
+	DestPort    int
+	UseTLS      bool
+	Transparent bool
+	Protocol    Protocol
+	Origin      OriginKind
+
+	// Whether the listener terminated TLS on the connection
+	TLSStripped bool
+
+	// The common name and subject alternative names of the certificate served to the client when TLS was stripped
+	CertCommonName string
+	CertSANs       []string
+}
+
+func (pconn *proxyConn) Info() ConnInfo {
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+
+	info := ConnInfo{
+		Id:          pconn.id,
+		ClientAddr:  pconn.clientAddr,
+		DestHost:    pconn.Addr.Host,
+		DestPort:    pconn.Addr.Port,
+		UseTLS:      pconn.Addr.UseTLS,
+		Transparent: pconn.transparentMode,
+		Protocol:    pconn.protocol,
+		Origin:      pconn.origin,
+		TLSStripped: pconn.servedCert != nil,
+	}
+	if pconn.servedCert != nil {
+		info.CertCommonName = pconn.servedCert.Subject.CommonName
+		info.CertSANs = append(info.CertSANs, pconn.servedCert.DNSNames...)
+		for _, ip := range pconn.servedCert.IPAddresses {
+			info.CertSANs = append(info.CertSANs, ip.String())
+		}
+	}
+	return info
+}
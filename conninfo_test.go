@@ -0,0 +1,41 @@
+package puppy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnInfo(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	plistener.SetCACertificate(testCA(t))
+
+	conns := testAcceptAsync(plistener)
+	tlsc, err := testConnectTLS(t, addr, "example.com:443", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsc.Close()
+
+	var pconn ProxyConn
+	select {
+	case pconn = <-conns:
+		defer pconn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for connection")
+	}
+
+	info := pconn.Info()
+	if info.Id != pconn.Id() {
+		t.Errorf("expected id %d, got %d", pconn.Id(), info.Id)
+	}
+	checkStr(t, info.ClientAddr.String(), tlsc.LocalAddr().String())
+	checkStr(t, info.DestHost, "example.com")
+	if info.DestPort != 443 || !info.UseTLS || !info.TLSStripped || info.Transparent {
+		t.Errorf("unexpected connection info: %+v", info)
+	}
+	if info.Origin != OriginConnect || info.Protocol != ProtocolHTTP {
+		t.Errorf("unexpected origin or protocol: %s, %s", info.Origin, info.Protocol)
+	}
+	checkStr(t, strings.Join(info.CertSANs, ","), "example.com")
+}
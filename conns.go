@@ -0,0 +1,71 @@
+package puppy
+
+/*
+Keeping track of the connections a ProxyListener has produced that are still open
+*/
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// ActiveConns returns the connections produced by the listener that have not been closed yet, ordered by id. The slice is a snapshot taken at the time of the call. Connections may be closed or new ones accepted as soon as it returns
+func (listener *ProxyListener) ActiveConns() []ProxyConn {
+	listener.mtx.Lock()
+	conns := make([]ProxyConn, 0, len(listener.activeConns))
+	for _, pconn := range listener.activeConns {
+		conns = append(conns, pconn)
+	}
+	listener.mtx.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].Id() < conns[j].Id()
+	})
+	return conns
+}
+
+// ActiveConnsByAge returns the same snapshot as ActiveConns ordered from the oldest to the newest connection by the time they were accepted
+func (listener *ProxyListener) ActiveConnsByAge() []ProxyConn {
+	conns := listener.ActiveConns()
+	sort.SliceStable(conns, func(i, j int) bool {
+		return conns[i].AcceptedAt().Before(conns[j].AcceptedAt())
+	})
+	return conns
+}
+
+// PendingConns returns how many connections are ready but waiting for Accept to be called. A count that keeps growing means connections are being produced faster than they are accepted
+func (listener *ProxyListener) PendingConns() int {
+	return int(atomic.LoadInt32(&listener.pending))
+}
+
+// Add a connection to the active connections until it is closed
+func (listener *ProxyListener) trackConn(pconn *proxyConn) {
+	id := pconn.Id()
+	listener.mtx.Lock()
+	if listener.activeConns == nil {
+		listener.activeConns = make(map[int]*proxyConn)
+	}
+	listener.activeConns[id] = pconn
+	listener.mtx.Unlock()
+
+	untrack := func() {
+		listener.mtx.Lock()
+		delete(listener.activeConns, id)
+		listener.mtx.Unlock()
+	}
+	if !pconn.addCloseHook(untrack) {
+		untrack()
+	}
+}
+
+// Call a function once the connection is closed. Returns false without keeping the function if the connection is already closed
+func (pconn *proxyConn) addCloseHook(f func()) bool {
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+
+	if pconn.closeReason != "" {
+		return false
+	}
+	pconn.onClose = append(pconn.onClose, f)
+	return true
+}
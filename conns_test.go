@@ -0,0 +1,114 @@
+package puppy
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func testActiveIds(plistener *ProxyListener) []int {
+	var ids []int
+	for _, pconn := range plistener.ActiveConns() {
+		ids = append(ids, pconn.Id())
+	}
+	return ids
+}
+
+func TestActiveConns(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+
+	var pconns []ProxyConn
+	for i := 0; i < 3; i++ {
+		c := testDial(t, addr)
+		defer c.Close()
+		c.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		pconns = append(pconns, testAccept(t, plistener))
+	}
+
+	ids := testActiveIds(plistener)
+	if len(ids) != 3 {
+		t.Fatalf("expected 3 active connections, got %v", ids)
+	}
+	for i, pconn := range pconns {
+		if ids[i] != pconn.Id() {
+			t.Errorf("expected connection %d at position %d, got %v", pconn.Id(), i, ids)
+		}
+	}
+
+	pconns[1].Close()
+	ids = testActiveIds(plistener)
+	if len(ids) != 2 || ids[0] != pconns[0].Id() || ids[1] != pconns[2].Id() {
+		t.Errorf("expected closed connection to be removed, got %v", ids)
+	}
+
+	// Snapshots can be taken while connections are being closed
+	var wg sync.WaitGroup
+	for _, pconn := range pconns {
+		wg.Add(1)
+		go func(pconn ProxyConn) {
+			defer wg.Done()
+			pconn.Close()
+		}(pconn)
+	}
+	for i := 0; i < 10; i++ {
+		plistener.ActiveConns()
+	}
+	wg.Wait()
+	if ids := testActiveIds(plistener); len(ids) != 0 {
+		t.Errorf("expected no active connections, got %v", ids)
+	}
+}
+
+func TestAcceptedAt(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+
+	var pconns []ProxyConn
+	for i := 0; i < 2; i++ {
+		before := time.Now()
+		c := testDial(t, addr)
+		defer c.Close()
+		c.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		pconn := testAccept(t, plistener)
+		defer pconn.Close()
+		if accepted := pconn.AcceptedAt(); accepted.Before(before) || accepted.After(time.Now()) {
+			t.Errorf("accept time %s is not between %s and now", accepted, before)
+		}
+		pconns = append(pconns, pconn)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	byAge := plistener.ActiveConnsByAge()
+	if len(byAge) != 2 || byAge[0].Id() != pconns[0].Id() || byAge[1].Id() != pconns[1].Id() {
+		t.Errorf("expected the oldest connection first")
+	}
+}
+
+func TestPendingConns(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+
+	waitPending := func(expected int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for plistener.PendingConns() != expected && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := plistener.PendingConns(); n != expected {
+			t.Fatalf("expected %d pending connections, got %d", expected, n)
+		}
+	}
+
+	// Nothing is accepting so every connection waits
+	for i := 0; i < 3; i++ {
+		c := testDial(t, addr)
+		defer c.Close()
+		c.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	}
+	waitPending(3)
+
+	pconn := testAccept(t, plistener)
+	defer pconn.Close()
+	waitPending(2)
+}
@@ -0,0 +1,50 @@
+package puppy
+
+/*
+Dialing destinations through the listener for code that uses the dialer interfaces from golang.org/x/net/proxy
+*/
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	"golang.org/x/net/proxy"
+)
+
+// Dials destinations with a listener's DialUpstream settings
+type upstreamDialer struct {
+	listener *ProxyListener
+}
+
+// Dialer returns a dialer that connects to destinations the same way DialUpstream does, except that it always opens a new connection instead of taking one from the upstream pool. The address can be the destination encoding returned by the RemoteAddr of a ProxyConn, which is "host/port/tls" where tls is 1 to connect with TLS and 0 to connect in plaintext, or a regular "host:port" address which is always connected to in plaintext. The network must be tcp, tcp4, or tcp6. The returned value also implements proxy.Dialer
+func (listener *ProxyListener) Dialer() proxy.ContextDialer {
+	return upstreamDialer{listener: listener}
+}
+
+func (d upstreamDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d upstreamDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("cannot dial network %q, only tcp is supported", network)
+	}
+
+	host, port, useTLS, err := DecodeRemoteAddr(addr)
+	if err != nil {
+		var portStr string
+		host, portStr, err = net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse destination %q: %s", addr, err)
+		}
+		if port, err = strconv.Atoi(portStr); err != nil {
+			return nil, fmt.Errorf("could not parse destination %q: %s", addr, err)
+		}
+		useTLS = false
+	}
+	return d.listener.dialUpstreamContext(ctx, network, host, port, useTLS, nil)
+}
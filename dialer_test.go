@@ -0,0 +1,74 @@
+package puppy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testDialerGet(t *testing.T, plistener *ProxyListener, addr string) string {
+	conn, err := plistener.Dialer().DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /dialed HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	rsp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(rsp.Body)
+	return string(body)
+}
+
+func TestDialer(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+
+	t.Run("host and port", func(t *testing.T) {
+		checkStr(t, testDialerGet(t, plistener, server.Listener.Addr().String()), "/dialed")
+	})
+
+	t.Run("encoded tls", func(t *testing.T) {
+		host, port := testServerDest(t, tlsServer)
+		checkStr(t, testDialerGet(t, plistener, EncodeRemoteAddr(host, port, true)), "/dialed")
+	})
+
+	t.Run("proxy conn destination", func(t *testing.T) {
+		host, port := testServerDest(t, server)
+		c := testDial(t, addr)
+		defer c.Close()
+		fmt.Fprintf(c, "GET http://%s:%d/ HTTP/1.1\r\nHost: %s:%d\r\n\r\n", host, port, host, port)
+		pconn := testAccept(t, plistener)
+		defer pconn.Close()
+		checkStr(t, testDialerGet(t, plistener, pconn.RemoteAddr().String()), "/dialed")
+	})
+
+	t.Run("unsupported network", func(t *testing.T) {
+		if _, err := plistener.Dialer().DialContext(context.Background(), "udp", server.Listener.Addr().String()); err == nil {
+			t.Error("expected an error dialing udp")
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := plistener.Dialer().DialContext(ctx, "tcp", server.Listener.Addr().String()); err == nil {
+			t.Error("expected an error dialing with a canceled context")
+		}
+	})
+}
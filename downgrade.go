@@ -0,0 +1,23 @@
+package puppy
+
+/*
+Refusing CONNECT tunnels that fall back to cleartext
+*/
+
+// Returned when a client sends something other than a TLS handshake through a CONNECT tunnel and SetRequireTLSAfterConnect is on
+const ErrCleartextAfterConnect = ConstErr("client did not start TLS after CONNECT")
+
+// SetRequireTLSAfterConnect sets whether connections are closed if the client does not start a TLS handshake after a CONNECT request instead of being handled as plaintext. Ports set up with SetStartTLSProtocol are not affected
+func (listener *ProxyListener) SetRequireTLSAfterConnect(require bool) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.requireTLS = require
+}
+
+func (listener *ProxyListener) getRequireTLSAfterConnect() bool {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.requireTLS
+}
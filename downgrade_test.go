@@ -0,0 +1,44 @@
+package puppy
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRequireTLSAfterConnect(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	plistener.SetCACertificate(testCA(t))
+	plistener.SetRequireTLSAfterConnect(true)
+
+	t.Run("cleartext", func(t *testing.T) {
+		c := testDial(t, addr)
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+		r := bufio.NewReader(c)
+		rsp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsp.StatusCode != 200 {
+			t.Fatalf("unexpected CONNECT status %d", rsp.StatusCode)
+		}
+
+		c.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		if n, err := r.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected connection to be closed, read %d bytes: %v", n, err)
+		}
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		testAcceptAsync(plistener)
+		tlsc, err := testConnectTLS(t, addr, "example.com:443", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsc.Close()
+	})
+}
@@ -0,0 +1,119 @@
+package puppy
+
+/*
+Telling clients why their connection could not be translated
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// An error translating a connection that should be reported to the client with an HTTP response before closing the connection. If TLS has been stripped from the connection by the time it is returned from translateConn, the response is left out since the client is expecting TLS records
+type translateError struct {
+	statusCode int
+	connId     int
+	err        error
+}
+
+func (e *translateError) Error() string {
+	return e.err.Error()
+}
+
+// Convert an error from reading a plaintext request into an error that can be reported to the client. Returns the error unchanged if the client went away
+func requestReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return err
+	}
+	if err == ErrRequestLineTooLong {
+		return &translateError{statusCode: http.StatusRequestURITooLong, err: err}
+	}
+	if errors.Is(err, ErrConnMemoryLimit) {
+		return &translateError{statusCode: http.StatusRequestHeaderFieldsTooLarge, err: err}
+	}
+	if _, ok := err.(*url.Error); ok {
+		// A request target that could not be parsed. These implement net.Error too so they have to be checked first
+		return &translateError{statusCode: http.StatusBadRequest, err: err}
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return &translateError{statusCode: http.StatusRequestTimeout, err: err}
+	}
+	if _, ok := err.(net.Error); ok {
+		return err
+	}
+	return &translateError{statusCode: http.StatusBadRequest, err: err}
+}
+
+// ErrorBodyFunc returns the body of the response sent to a client when its connection could not be translated
+type ErrorBodyFunc func(statusCode int, connId int, err error) string
+
+func defaultErrorBody(statusCode int, connId int, err error) string {
+	return fmt.Sprintf("%d %s: %s\nConnection ID: %d\n", statusCode, http.StatusText(statusCode), err, connId)
+}
+
+// Tell the client why its connection could not be translated if we can
+func (listener *ProxyListener) reportTranslateError(inconn *inputConn, err error) {
+	terr, ok := err.(*translateError)
+	if !ok {
+		return
+	}
+
+	if listener.getSilentErrors() {
+		return
+	}
+
+	bodyFunc := listener.getErrorBody()
+	if bodyFunc == nil {
+		bodyFunc = defaultErrorBody
+	}
+	body := bodyFunc(terr.statusCode, terr.connId, terr.err)
+	resp := http.Response{
+		StatusCode:    terr.statusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		Close:         true,
+	}
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if err := resp.Write(inconn.conn); err != nil {
+		listener.logger.Println("Could not write error response:", err)
+	}
+}
+
+// SetSilentErrors sets whether connections that cannot be translated are closed without sending an error response to the client
+func (listener *ProxyListener) SetSilentErrors(silent bool) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.silentErrors = silent
+}
+
+func (listener *ProxyListener) getSilentErrors() bool {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.silentErrors
+}
+
+// SetErrorBody sets the function used to generate the body of error responses sent to clients. Passing nil restores the default body
+func (listener *ProxyListener) SetErrorBody(f ErrorBodyFunc) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.errorBody = f
+}
+
+func (listener *ProxyListener) getErrorBody() ErrorBodyFunc {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.errorBody
+}
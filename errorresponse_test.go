@@ -0,0 +1,107 @@
+package puppy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTranslateErrorResponses(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+
+	closedAddr := testClosedAddr(t)
+	plistener.SetInterceptCIDR(nil, testCIDRs(t, "127.0.0.0/8"))
+
+	tests := []struct {
+		name       string
+		request    string
+		statusCode int
+	}{
+		{"parse failure", "not a request\r\n\r\n", 400},
+		{"unreachable bypass", "CONNECT " + closedAddr + " HTTP/1.1\r\nHost: " + closedAddr + "\r\n\r\n", 502},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testDial(t, addr)
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			c.Write([]byte(tt.request))
+
+			rsp, err := http.ReadResponse(bufio.NewReader(c), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rsp.StatusCode != tt.statusCode {
+				t.Errorf("expected status %d, got %d", tt.statusCode, rsp.StatusCode)
+			}
+			body, _ := ioutil.ReadAll(rsp.Body)
+			if !strings.Contains(string(body), "Connection ID:") {
+				t.Errorf("error body does not include connection id: %q", body)
+			}
+		})
+	}
+
+	t.Run("custom body", func(t *testing.T) {
+		plistener.SetErrorBody(func(statusCode int, connId int, err error) string {
+			return fmt.Sprintf("custom %d", statusCode)
+		})
+		defer plistener.SetErrorBody(nil)
+
+		c := testDial(t, addr)
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write([]byte("not a request\r\n\r\n"))
+
+		rsp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(rsp.Body)
+		checkStr(t, string(body), "custom 400")
+	})
+
+	t.Run("silent", func(t *testing.T) {
+		plistener.SetSilentErrors(true)
+		defer plistener.SetSilentErrors(false)
+
+		c := testDial(t, addr)
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write([]byte("not a request\r\n\r\n"))
+
+		data, err := ioutil.ReadAll(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != 0 {
+			t.Errorf("expected connection to be dropped, got %q", data)
+		}
+	})
+}
+
+func TestNoErrorResponseAfterTLSStripped(t *testing.T) {
+	plistener := NewProxyListener(nil)
+	defer plistener.Close()
+	plistener.SetCACertificate(testCA(t))
+	plistener.SetMaxRequestLineLength(100)
+	addr := testTransparentListener(t, plistener, "example.com", 443, false)
+
+	tlsc := tls.Client(testDial(t, addr), &tls.Config{InsecureSkipVerify: true})
+	defer tlsc.Close()
+	tlsc.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := tlsc.Write([]byte("GET /" + strings.Repeat("a", 200) + " HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	testErr(t, err)
+
+	// A plaintext error response would show up as a bad TLS record instead of the connection closing
+	_, err = tlsc.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+}
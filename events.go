@@ -0,0 +1,148 @@
+package puppy
+
+/*
+Notifications about things that happen to connections in a ProxyListener
+*/
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Kinds of ProxyEvent
+const (
+	// A fault was deliberately injected into a connection. The detail is the fault point
+	EventFaultInjected = "fault injected"
+
+	// A connection was tunneled to its destination without being intercepted. The detail is the BypassReason
+	EventInterceptionBypassed = "interception bypassed"
+
+	// The server accepted a STARTTLS command on a connection and TLS will be stripped if the client starts a handshake. The detail is the StartTLSProto
+	EventStartTLS = "starttls"
+
+	// The server name a client sent while starting TLS in a CONNECT tunnel did not match the CONNECT host. The detail is the server name and the host and port are from the CONNECT request
+	EventSNIMismatch = "sni mismatch"
+
+	// TLS could not be stripped from a connection because a certificate could not be signed for it. The detail is the signing error and the host is the one the certificate was for
+	EventSignHostFailed = "sign host failed"
+)
+
+// ProxyEvent describes something that happened to a connection
+type ProxyEvent struct {
+	// What happened. One of the Event constants
+	Kind string
+
+	// The id of the connection the event is about
+	ConnId int
+
+	// Extra information about the event. Depends on the kind of event
+	Detail string
+
+	// The destination of the connection if it is relevant to the event
+	Host string
+	Port int
+
+	// When the event happened
+	Time time.Time
+}
+
+// SetEventHandler sets a function that is called with every event that happens on the listener. The handler is called synchronously so it should return quickly
+func (listener *ProxyListener) SetEventHandler(handler func(ProxyEvent)) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.eventHandler = handler
+}
+
+func (listener *ProxyListener) emitEvent(kind string, pconn *proxyConn, detail string) {
+	listener.emitEventFor(pconn, ProxyEvent{Kind: kind, Detail: detail})
+}
+
+// Send a fully filled out event about a connection to the handler and the connection's transcript. The connection id and time are set automatically
+func (listener *ProxyListener) emitEventFor(pconn *proxyConn, event ProxyEvent) {
+	event.ConnId = pconn.Id()
+	event.Time = time.Now()
+	pconn.transcript.record(event)
+
+	listener.mtx.Lock()
+	handler := listener.eventHandler
+	listener.mtx.Unlock()
+
+	if handler == nil {
+		return
+	}
+	handler(event)
+}
+
+// Kinds of ListenerEvent
+const (
+	// The listener was added to the ProxyListener
+	ListenerAdded = "added"
+
+	// The listener was taken out by RemoveListener or by closing the ProxyListener
+	ListenerRemoved = "removed"
+
+	// The listener stopped accepting connections on its own, such as when it was closed directly
+	ListenerClosed = "closed"
+)
+
+// ListenerEvent describes a listener being added to or taken out of a ProxyListener
+type ListenerEvent struct {
+	// What happened. One of the Listener constants
+	Kind string
+
+	// The id of the listener
+	ListenerId int
+
+	// The name set in the ListenerOptions the listener was added with
+	Name string
+
+	// The address the listener accepts connections on
+	Addr net.Addr
+
+	// When the event happened
+	Time time.Time
+}
+
+// SetListenerLifecycleHandler sets a function that is called whenever a listener is added to or taken out of the ProxyListener. Each listener is reported as added once and then as removed or closed once. The handler is called without any locks held so it can call back into the ProxyListener
+func (listener *ProxyListener) SetListenerLifecycleHandler(handler func(ListenerEvent)) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.lifecycle = handler
+}
+
+func (listener *ProxyListener) emitListenerEvent(kind string, il *listenerData) {
+	listener.mtx.Lock()
+	handler := listener.lifecycle
+	listener.mtx.Unlock()
+
+	if handler == nil {
+		return
+	}
+	handler(ListenerEvent{
+		Kind:       kind,
+		ListenerId: il.Id,
+		Name:       il.Options.Name,
+		Addr:       il.Listener.Addr(),
+		Time:       time.Now(),
+	})
+}
+
+// Report that a listener was added. Must be called without the lock held
+func (listener *ProxyListener) reportListenerAdded(il *listenerData) {
+	listener.emitListenerEvent(ListenerAdded, il)
+	close(il.announced)
+}
+
+// Report that a listener was taken out after its added event. Must be called without the lock held
+func (listener *ProxyListener) reportListenerEnded(il *listenerData, kind string) {
+	<-il.announced
+	listener.emitListenerEvent(kind, il)
+}
+
+// Take responsibility for removing a listener and reporting it. Returns false if something else already has
+func (il *listenerData) claimEnd() bool {
+	return atomic.CompareAndSwapInt32(&il.ended, 0, 1)
+}
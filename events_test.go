@@ -0,0 +1,67 @@
+package puppy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListenerLifecycleHandler(t *testing.T) {
+	plistener := NewProxyListener(nil)
+	events := make(chan ListenerEvent, 16)
+	plistener.SetListenerLifecycleHandler(func(event ListenerEvent) {
+		// Calling back into the ProxyListener must not deadlock
+		plistener.SetMaxListeners(0)
+		events <- event
+	})
+	next := func() ListenerEvent {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for listener event")
+			return ListenerEvent{}
+		}
+	}
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+
+	removed, closed, remaining := listen(), listen(), listen()
+	testErr(t, plistener.AddListenerWithOptions(removed, ListenerOptions{Name: "removed"}))
+	added := next()
+	checkStr(t, added.Kind, ListenerAdded)
+	checkStr(t, added.Name, "removed")
+	checkStr(t, added.Addr.String(), removed.Addr().String())
+
+	testErr(t, plistener.RemoveListener(removed))
+	event := next()
+	checkStr(t, event.Kind, ListenerRemoved)
+	checkStr(t, event.Name, "removed")
+	if event.ListenerId != added.ListenerId {
+		t.Errorf("expected removed listener id %d, got %d", added.ListenerId, event.ListenerId)
+	}
+
+	testErr(t, plistener.AddListenerWithOptions(closed, ListenerOptions{Name: "closed"}))
+	checkStr(t, next().Kind, ListenerAdded)
+	closed.Close()
+	event = next()
+	checkStr(t, event.Kind, ListenerClosed)
+	checkStr(t, event.Name, "closed")
+
+	testErr(t, plistener.AddTransparentListener(remaining, "example.com", 80, false))
+	checkStr(t, next().Kind, ListenerAdded)
+	testErr(t, plistener.Close())
+	checkStr(t, next().Kind, ListenerRemoved)
+
+	// Each listener is only reported once
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
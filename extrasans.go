@@ -0,0 +1,27 @@
+package puppy
+
+/*
+Adding names to the certificates generated for intercepted hosts
+*/
+
+import (
+	"net"
+)
+
+// ExtraSANsFunc returns additional names that should be included in the certificate generated for a host when stripping TLS
+type ExtraSANsFunc func(host string) (dnsNames []string, ipAddrs []net.IP)
+
+// SetExtraSANs sets a function which gives additional DNS names and IP addresses to include in the certificates generated when stripping TLS. Set to nil to only include the hostname of the destination.
+func (listener *ProxyListener) SetExtraSANs(extraSANs ExtraSANsFunc) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.extraSANs = extraSANs
+}
+
+func (listener *ProxyListener) getExtraSANs() ExtraSANsFunc {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.extraSANs
+}
@@ -0,0 +1,30 @@
+package puppy
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestExtraSANs(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	plistener.SetCACertificate(testCA(t))
+	plistener.SetExtraSANs(func(host string) ([]string, []net.IP) {
+		return []string{"alias." + host}, []net.IP{net.ParseIP("192.0.2.10"), net.ParseIP("2001:db8::10")}
+	})
+
+	testAcceptAsync(plistener)
+	tlsc, err := testConnectTLS(t, addr, "example.com:443", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsc.Close()
+
+	cert := tlsc.ConnectionState().PeerCertificates[0]
+	checkStr(t, strings.Join(cert.DNSNames, ","), "example.com,alias.example.com")
+	if len(cert.IPAddresses) != 2 ||
+		!cert.IPAddresses[0].Equal(net.ParseIP("192.0.2.10")) ||
+		!cert.IPAddresses[1].Equal(net.ParseIP("2001:db8::10")) {
+		t.Errorf("unexpected IP SANs %v", cert.IPAddresses)
+	}
+}
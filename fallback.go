@@ -0,0 +1,129 @@
+package puppy
+
+/*
+Falling back to tunneling hosts whose clients reject the certificates used to intercept them
+*/
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// How long a host is tunneled for after a client rejects the handshake for it
+const handshakeFallbackExpiry = 10 * time.Minute
+
+// The most hosts that are tunneled because of rejected handshakes at once. The host that would expire soonest makes room for a new one
+const maxHandshakeFallbackHosts = 1024
+
+// How long a client gets to finish the handshake when it is done before the connection is returned by Accept. A variable so tests don't have to wait as long
+var handshakeFallbackTimeout = 10 * time.Second
+
+// SetFallbackToPassthroughOnHandshakeFail sets whether a host is tunneled without being intercepted for a while after a client rejects the TLS handshake for it, such as when the client doesn't trust the CA. The connection that was rejected is not recovered and is closed. Its ClientHello is not replayed to the destination since the client has already seen the certificate it rejected. Only later connections to the host are tunneled, before anything is read from them, and they are reported with BypassHandshakeFailed. Hosts are tunneled for 10 minutes after the last rejection and at most 1024 hosts are tunneled at once. When enabled, the handshake is finished before the connection is returned by Accept and the client gets 10 seconds to finish it. Disabling it forgets every host that was being tunneled
+func (listener *ProxyListener) SetFallbackToPassthroughOnHandshakeFail(fallback bool) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.fallback = fallback
+	if !fallback {
+		listener.failedHosts = nil
+	}
+}
+
+func (listener *ProxyListener) getFallbackToPassthroughOnHandshakeFail() bool {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.fallback
+}
+
+// Check whether a client has rejected a handshake for a host recently
+func (listener *ProxyListener) handshakeFailedFor(host string) bool {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	key := strings.ToLower(host)
+	expires, ok := listener.failedHosts[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(listener.failedHosts, key)
+		return false
+	}
+	return true
+}
+
+// Start tunneling a host after a client rejected the handshake for it. Must be called while holding the lock
+func (listener *ProxyListener) rememberFailedHost(host string) {
+	if listener.failedHosts == nil {
+		listener.failedHosts = make(map[string]time.Time)
+	}
+	key := strings.ToLower(host)
+	now := time.Now()
+	if _, ok := listener.failedHosts[key]; !ok && len(listener.failedHosts) >= maxHandshakeFallbackHosts {
+		var soonest string
+		for h, expires := range listener.failedHosts {
+			if now.After(expires) {
+				delete(listener.failedHosts, h)
+				continue
+			}
+			if soonest == "" || expires.Before(listener.failedHosts[soonest]) {
+				soonest = h
+			}
+		}
+		if len(listener.failedHosts) >= maxHandshakeFallbackHosts {
+			delete(listener.failedHosts, soonest)
+		}
+	}
+	listener.failedHosts[key] = now.Add(handshakeFallbackExpiry)
+}
+
+// Finish the handshake on a connection TLS is being stripped from so that a client rejecting it is noticed while the listener still has the connection. Does nothing if fallback is disabled or the connection isn't using TLS
+func (listener *ProxyListener) checkHandshake(pconn *proxyConn, host string) error {
+	if !listener.getFallbackToPassthroughOnHandshakeFail() {
+		return nil
+	}
+	pconn.mtx.Lock()
+	tlsConn, ok := pconn.conn.(*tls.Conn)
+	prevRead := pconn.readDeadline
+	prevWrite := pconn.writeDeadline
+	pconn.mtx.Unlock()
+	if !ok {
+		return nil
+	}
+
+	// Don't let a client that stalls in the middle of the handshake hold on to the translator
+	wait := time.Now().Add(handshakeFallbackTimeout)
+	readWait, writeWait := wait, wait
+	if !prevRead.IsZero() && prevRead.Before(wait) {
+		readWait = prevRead
+	}
+	if !prevWrite.IsZero() && prevWrite.Before(wait) {
+		writeWait = prevWrite
+	}
+	tlsConn.SetReadDeadline(readWait)
+	tlsConn.SetWriteDeadline(writeWait)
+	err := tlsConn.Handshake()
+	tlsConn.SetReadDeadline(prevRead)
+	tlsConn.SetWriteDeadline(prevWrite)
+	if err == nil || !isRemoteTLSAlert(err) {
+		return err
+	}
+
+	listener.logConnf(pconn, "Client rejected the handshake on connection %d, tunneling later connections to %s instead: %s", pconn.Id(), host, err)
+	listener.mtx.Lock()
+	if listener.fallback {
+		listener.rememberFailedHost(host)
+	}
+	listener.mtx.Unlock()
+	return err
+}
+
+// Whether a handshake failed because the client sent an alert rather than because of a network error or a problem on our end
+func isRemoteTLSAlert(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "remote error"
+}
@@ -0,0 +1,156 @@
+package puppy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Connect through the proxy with a client that doesn't trust its CA, then connect again with one that trusts anything and return the certificate it was given
+func testRejectThenReconnect(t *testing.T, plistener *ProxyListener, addr string, server *httptest.Server) *x509.Certificate {
+	host, _ := testServerDest(t, server)
+	dest := server.Listener.Addr().String()
+
+	strict := &tls.Config{ServerName: host, RootCAs: x509.NewCertPool()}
+	if tlsc, err := testConnectTLS(t, addr, dest, strict); err == nil {
+		tlsc.Close()
+		t.Fatal("client trusted the proxy's certificate")
+	}
+
+	// The proxy finds out about the rejection after the client gives up
+	deadline := time.Now().Add(5 * time.Second)
+	for plistener.getFallbackToPassthroughOnHandshakeFail() && !plistener.handshakeFailedFor(host) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tlsc, err := testConnectTLS(t, addr, dest, nil)
+	testErr(t, err)
+	defer tlsc.Close()
+	return tlsc.ConnectionState().PeerCertificates[0]
+}
+
+func TestFallbackToPassthroughOnHandshakeFail(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	host, port := testServerDest(t, server)
+
+	plistener, addr := testProxyListener(t)
+	plistener.SetCACertificate(testCA(t))
+	plistener.SetFallbackToPassthroughOnHandshakeFail(true)
+	events := make(chan ProxyEvent, 4)
+	plistener.SetEventHandler(func(e ProxyEvent) {
+		if e.Kind == EventInterceptionBypassed {
+			events <- e
+		}
+	})
+
+	cert := testRejectThenReconnect(t, plistener, addr, server)
+	if !cert.Equal(server.Certificate()) {
+		t.Error("second connection was intercepted after the client rejected the first")
+	}
+	select {
+	case e := <-events:
+		checkStr(t, e.Detail, string(BypassHandshakeFailed))
+		checkStr(t, e.Host, host)
+		if e.Port != port {
+			t.Errorf("expected port %d, got %d", port, e.Port)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("no bypass event was emitted")
+	}
+
+	// Turning it off starts intercepting the host again
+	plistener.SetFallbackToPassthroughOnHandshakeFail(false)
+	if plistener.handshakeFailedFor(host) {
+		t.Error("failed host was not forgotten")
+	}
+}
+
+func TestNoFallbackOnHandshakeFail(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+	plistener.SetCACertificate(testCA(t))
+	go func() {
+		for {
+			c, err := plistener.Accept()
+			if err != nil {
+				return
+			}
+			// Reading is what finishes the handshake when it isn't done before Accept
+			go func() {
+				io.Copy(io.Discard, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	cert := testRejectThenReconnect(t, plistener, addr, server)
+	if cert.Equal(server.Certificate()) {
+		t.Error("connection was tunneled without fallback enabled")
+	}
+}
+
+func TestFallbackHandshakeTimeout(t *testing.T) {
+	prevTimeout := handshakeFallbackTimeout
+	handshakeFallbackTimeout = 200 * time.Millisecond
+	defer func() {
+		handshakeFallbackTimeout = prevTimeout
+	}()
+
+	plistener, addr := testProxyListener(t)
+	plistener.SetCACertificate(testCA(t))
+	plistener.SetFallbackToPassthroughOnHandshakeFail(true)
+	plistener.SetOrderedTranslation(true)
+
+	// Looks like the start of a handshake and then never sends the rest
+	stalled := testDial(t, addr)
+	defer stalled.Close()
+	fmt.Fprint(stalled, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n\x16\x03\x01")
+	time.Sleep(50 * time.Millisecond)
+
+	c := testDial(t, addr)
+	defer c.Close()
+	fmt.Fprint(c, "GET http://after.example/ HTTP/1.1\r\nHost: after.example\r\n\r\n")
+	pconn := testAccept(t, plistener)
+	defer pconn.Close()
+	checkStr(t, pconn.RemoteAddr().String(), EncodeRemoteAddr("after.example", 80, false))
+
+	stalled.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(stalled); err != nil {
+		t.Errorf("stalled connection was not closed: %s", err)
+	}
+}
+
+func TestFallbackHostsBounded(t *testing.T) {
+	plistener := NewProxyListener(nil)
+	defer plistener.Close()
+	plistener.SetFallbackToPassthroughOnHandshakeFail(true)
+
+	plistener.mtx.Lock()
+	for i := 0; i < maxHandshakeFallbackHosts+10; i++ {
+		plistener.rememberFailedHost(fmt.Sprintf("host%d.example", i))
+	}
+	count := len(plistener.failedHosts)
+	plistener.mtx.Unlock()
+	if count != maxHandshakeFallbackHosts {
+		t.Errorf("expected %d failed hosts, got %d", maxHandshakeFallbackHosts, count)
+	}
+	if !plistener.handshakeFailedFor("HOST1033.example") {
+		t.Error("newest host was evicted")
+	}
+
+	plistener.mtx.Lock()
+	plistener.failedHosts["host1033.example"] = time.Now().Add(-time.Second)
+	plistener.mtx.Unlock()
+	if plistener.handshakeFailedFor("host1033.example") {
+		t.Error("expired host is still tunneled")
+	}
+}
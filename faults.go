@@ -0,0 +1,92 @@
+package puppy
+
+/*
+Deliberately dropping connections to test how clients handle failures
+*/
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// Points during translation where a fault can be injected. Used as the detail of EventFaultInjected events
+const (
+	FaultOnAccept              = "accept"
+	FaultBeforeConnectResponse = "before connect response"
+	FaultMidRequest            = "mid request"
+)
+
+// FaultInjection is the probability, from 0 to 1, of a connection being dropped at each fault point
+type FaultInjection struct {
+	// Close the connection before anything is read from it
+	DropOnAccept float64
+
+	// Close the connection after reading a CONNECT request without responding to it
+	DropBeforeConnectResponse float64
+
+	// Close the connection after reading the header of a request
+	DropMidRequest float64
+
+	// The source of randomness used to decide whether to inject a fault. Allows for repeatable tests when seeded. If nil, the global source is used
+	Rand *rand.Rand
+}
+
+// Decides when faults are injected. Rand is not safe for concurrent use so it is guarded by a lock
+type faultInjector struct {
+	mtx    sync.Mutex
+	config FaultInjection
+}
+
+// Decide whether a fault should happen given its probability
+func (f *faultInjector) roll(probability float64) bool {
+	if probability <= 0 {
+		return false
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.config.Rand != nil {
+		return f.config.Rand.Float64() < probability
+	}
+	return rand.Float64() < probability
+}
+
+// SetFaultInjection sets how often connections are dropped at each fault point. Passing nil disables fault injection
+func (listener *ProxyListener) SetFaultInjection(config *FaultInjection) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	if config == nil {
+		listener.faults = nil
+		return
+	}
+	listener.faults = &faultInjector{config: *config}
+}
+
+// Decide whether to inject a fault at a fault point. If a fault is injected, the connection is closed and true is returned
+func (listener *ProxyListener) injectFault(pconn *proxyConn, point string) bool {
+	listener.mtx.Lock()
+	faults := listener.faults
+	listener.mtx.Unlock()
+	if faults == nil {
+		return false
+	}
+
+	var probability float64
+	switch point {
+	case FaultOnAccept:
+		probability = faults.config.DropOnAccept
+	case FaultBeforeConnectResponse:
+		probability = faults.config.DropBeforeConnectResponse
+	case FaultMidRequest:
+		probability = faults.config.DropMidRequest
+	}
+	if !faults.roll(probability) {
+		return false
+	}
+
+	listener.logConnf(pconn, "Injecting fault on connection %d: %s", pconn.Id(), point)
+	listener.emitEvent(EventFaultInjected, pconn, point)
+	pconn.closeWithReason(CloseReasonFaultInjected)
+	return true
+}
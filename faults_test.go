@@ -0,0 +1,90 @@
+package puppy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestFaultInjection(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	events := make(chan ProxyEvent, 10)
+	plistener.SetEventHandler(func(e ProxyEvent) {
+		events <- e
+	})
+	plistener.SetFaultInjection(&FaultInjection{
+		DropOnAccept: 0.5,
+		Rand:         rand.New(rand.NewSource(42)),
+	})
+
+	// Use the same seed to predict which connections will be dropped
+	expected := rand.New(rand.NewSource(42))
+	dropped := 0
+	for i := 0; i < 10; i++ {
+		c := testDial(t, addr)
+		fmt.Fprintf(c, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+		if expected.Float64() < 0.5 {
+			dropped++
+			select {
+			case e := <-events:
+				checkStr(t, e.Kind, EventFaultInjected)
+				checkStr(t, e.Detail, FaultOnAccept)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("connection %d was not dropped", i)
+			}
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			// The connection may be reset since the request was never read
+			if data, _ := ioutil.ReadAll(c); len(data) != 0 {
+				t.Errorf("expected dropped connection to be closed, got %q", data)
+			}
+		} else {
+			pconn := testAccept(t, plistener)
+			pconn.Close()
+		}
+		c.Close()
+	}
+	if dropped == 0 || dropped == 10 {
+		t.Errorf("seed did not exercise both outcomes")
+	}
+}
+
+func TestFaultInjectionPoints(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	events := make(chan ProxyEvent, 10)
+	plistener.SetEventHandler(func(e ProxyEvent) {
+		events <- e
+	})
+
+	tests := []struct {
+		name    string
+		config  FaultInjection
+		request string
+		point   string
+	}{
+		{"connect", FaultInjection{DropBeforeConnectResponse: 1}, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n", FaultBeforeConnectResponse},
+		{"mid request", FaultInjection{DropMidRequest: 1}, "POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\n", FaultMidRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plistener.SetFaultInjection(&tt.config)
+			c := testDial(t, addr)
+			defer c.Close()
+			c.Write([]byte(tt.request))
+
+			select {
+			case e := <-events:
+				checkStr(t, e.Detail, tt.point)
+			case <-time.After(5 * time.Second):
+				t.Fatal("no fault was injected")
+			}
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if data, _ := ioutil.ReadAll(c); len(data) != 0 {
+				t.Errorf("expected no response, got %q", data)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package puppy
+
+/*
+Helpers for forwarding connections from a ProxyListener directly to their destination
+*/
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// BadGatewayResponder returns the response sent to a client when its destination cannot be reached. Returning nil closes the connection without a response
+type BadGatewayResponder func(err error) *http.Response
+
+// How long to wait for the client's request before sending a bad gateway response anyway
+const badGatewayReadTimeout = 5 * time.Second
+
+// DialOptions changes how DialUpstreamWithOptions connects to a destination
+type DialOptions struct {
+	// The connection the upstream connection is being made for
+	Client ProxyConn
+
+	// Offer the destination the server name, ALPN protocols, cipher suites, curves, and TLS versions that Client offered when TLS was stripped from it. The standard library limits how closely this can be done: it picks the order of cipher suites and curves, TLS 1.3 cipher suites cannot be chosen, values it doesn't implement (including GREASE values) are dropped, and extensions and signature algorithms are always its own. Since ALPN protocols are offered as-is, the destination may pick one such as h2 that the client did not negotiate with the listener, so check the NegotiatedProtocol of the upstream connection before relaying
+	MirrorClientHello bool
+}
+
+// DialUpstream opens a connection to the given destination. If useTLS is true, a TLS connection is made without verifying the server's certificate. If SetUpstreamPool was used, an idle connection to the destination is reused when there is one, so the connection should be used for request and response exchanges and then given back with ReleaseUpstream or closed
+func (listener *ProxyListener) DialUpstream(host string, port int, useTLS bool) (net.Conn, error) {
+	return listener.DialUpstreamWithOptions(host, port, useTLS, nil)
+}
+
+// DialUpstreamWithOptions opens a connection to the given destination like DialUpstream using the given options. Passing nil options is the same as calling DialUpstream
+func (listener *ProxyListener) DialUpstreamWithOptions(host string, port int, useTLS bool, opts *DialOptions) (net.Conn, error) {
+	// Mirrored connections depend on the client so they are never taken from the pool. Neither are TLS connections when the server name is picked per call since a pooled one may have been opened with a different one
+	mirror := opts != nil && opts.MirrorClientHello && opts.Client != nil
+	pickedSNI := useTLS && listener.getUpstreamSNI() != nil
+	if pool := listener.getUpstreamPool(); pool != nil && !mirror && !pickedSNI {
+		if conn := pool.get(upstreamPoolKey(host, port, useTLS)); conn != nil {
+			return conn, nil
+		}
+	}
+	return listener.dialUpstreamContext(context.Background(), "tcp", host, port, useTLS, opts)
+}
+
+// Open a new connection to a destination. Never takes connections from the upstream pool, so it is used for tunnels and anything else that keeps the connection for itself
+func (listener *ProxyListener) dialUpstreamContext(ctx context.Context, network string, host string, port int, useTLS bool, opts *DialOptions) (net.Conn, error) {
+	mirror := opts != nil && opts.MirrorClientHello && opts.Client != nil
+	conn, err := listener.dialResolved(ctx, network, host, port)
+	if err != nil {
+		return nil, err
+	}
+	listener.applyTCPNoDelay(conn)
+	if !useTLS {
+		return conn, nil
+	}
+
+	config := &tls.Config{ServerName: host, InsecureSkipVerify: true}
+	var hello *tls.ClientHelloInfo
+	if opts != nil && opts.Client != nil {
+		if pconn, ok := opts.Client.(*proxyConn); ok {
+			hello = pconn.getHelloInfo()
+		}
+	}
+	if mirror && hello != nil {
+		mirrorTLSConfig(config, hello)
+	}
+	if sni := listener.getUpstreamSNI(); sni != nil {
+		var clientSNI string
+		if hello != nil {
+			clientSNI = hello.ServerName
+		}
+		config.ServerName = sni(clientSNI, host)
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Open a new connection for a tunnel. Tunnels close the connection when they are done and may leave it in the middle of a stream, so they never use pooled connections
+func (listener *ProxyListener) dialTunnel(host string, port int, useTLS bool) (net.Conn, error) {
+	return listener.dialUpstreamContext(context.Background(), "tcp", host, port, useTLS, nil)
+}
+
+// Forward connects a ProxyConn to its destination and copies data between them until one side closes the connection. If the destination cannot be reached and a BadGatewayResponder is set, the client is sent its response. Closes pconn when it is done
+func (listener *ProxyListener) Forward(pconn ProxyConn) error {
+	host, port, useTLS, err := DecodeRemoteAddr(pconn.RemoteAddr().String())
+	if err != nil {
+		pconn.Close()
+		return err
+	}
+
+	upstream, err := listener.dialTunnel(host, port, useTLS)
+	if err != nil {
+		err = fmt.Errorf("could not dial %s:%d: %s", host, port, err)
+		listener.writeBadGateway(pconn, err)
+		pconn.Close()
+		return err
+	}
+
+	relay(pconn, upstream)
+	return nil
+}
+
+// SetBadGatewayResponder sets the function used to generate the response sent to clients by Forward when the destination cannot be reached. Passing nil disables bad gateway responses
+func (listener *ProxyListener) SetBadGatewayResponder(f BadGatewayResponder) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.badGateway = f
+}
+
+func (listener *ProxyListener) getBadGatewayResponder() BadGatewayResponder {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.badGateway
+}
+
+// DefaultBadGatewayResponse returns a plaintext 502 Bad Gateway response describing the error
+func DefaultBadGatewayResponse(err error) *http.Response {
+	body := fmt.Sprintf("%d %s: %s\n", http.StatusBadGateway, http.StatusText(http.StatusBadGateway), err)
+	resp := &http.Response{
+		StatusCode:    http.StatusBadGateway,
+		Header:        make(http.Header),
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+	}
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	return resp
+}
+
+// Send the bad gateway response for an error to the client. Since the response is written to the ProxyConn, clients of TLS-stripped connections receive it over TLS
+func (listener *ProxyListener) writeBadGateway(pconn ProxyConn, dialErr error) {
+	responder := listener.getBadGatewayResponder()
+	if responder == nil {
+		return
+	}
+	resp := responder(dialErr)
+	if resp == nil {
+		return
+	}
+	if resp.Body != nil {
+		defer resp.Body.Close()
+	}
+
+	// Read the request the client is waiting on a response to so it doesn't get reset when we close the connection
+	pconn.SetReadDeadline(time.Now().Add(badGatewayReadTimeout))
+	if req, err := http.ReadRequest(bufio.NewReader(pconn)); err == nil {
+		io.Copy(ioutil.Discard, req.Body)
+		resp.Request = req
+	}
+	pconn.SetReadDeadline(time.Time{})
+
+	if resp.ProtoMajor == 0 {
+		resp.Proto = "HTTP/1.1"
+		resp.ProtoMajor = 1
+		resp.ProtoMinor = 1
+	}
+	resp.Close = true
+	if err := resp.Write(pconn); err != nil {
+		listener.logger.Println("Could not write bad gateway response to connection", pconn.Id(), ":", err)
+	}
+}
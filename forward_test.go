@@ -0,0 +1,94 @@
+package puppy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Get an address that nothing is listening on
+func testClosedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestForwardBadGateway(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	plistener.SetCACertificate(testCA(t))
+	plistener.SetBadGatewayResponder(DefaultBadGatewayResponse)
+	closedAddr := testClosedAddr(t)
+
+	forwarded := make(chan error, 1)
+	go func() {
+		c, err := plistener.Accept()
+		if err != nil {
+			return
+		}
+		forwarded <- plistener.Forward(c.(ProxyConn))
+	}()
+
+	t.Run("plaintext", func(t *testing.T) {
+		c := testDial(t, addr)
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(c, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\n\r\n", closedAddr, closedAddr)
+
+		rsp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsp.StatusCode != http.StatusBadGateway {
+			t.Errorf("expected status 502, got %d", rsp.StatusCode)
+		}
+		if err := <-forwarded; err == nil {
+			t.Error("expected Forward to return an error")
+		}
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		plistener.SetBadGatewayResponder(func(err error) *http.Response {
+			rsp := DefaultBadGatewayResponse(err)
+			rsp.Body = ioutil.NopCloser(strings.NewReader("custom"))
+			rsp.ContentLength = int64(len("custom"))
+			return rsp
+		})
+
+		go func() {
+			c, err := plistener.Accept()
+			if err != nil {
+				return
+			}
+			forwarded <- plistener.Forward(c.(ProxyConn))
+		}()
+		tlsc, err := testConnectTLS(t, addr, closedAddr, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tlsc.Close()
+		tlsc.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(tlsc, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", closedAddr)
+
+		rsp, err := http.ReadResponse(bufio.NewReader(tlsc), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsp.StatusCode != http.StatusBadGateway {
+			t.Errorf("expected status 502, got %d", rsp.StatusCode)
+		}
+		body, _ := ioutil.ReadAll(rsp.Body)
+		checkStr(t, string(body), "custom")
+		if err := <-forwarded; err == nil {
+			t.Error("expected Forward to return an error")
+		}
+	})
+}
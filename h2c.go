@@ -0,0 +1,24 @@
+package puppy
+
+/*
+Recognizing HTTP/2 prior-knowledge connections on transparent listeners
+*/
+
+// The connection preface sent by HTTP/2 clients
+const h2cPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// Check whether the client started the connection with the HTTP/2 connection preface without consuming any data
+func (pconn *proxyConn) peekH2CPreface() (bool, error) {
+	bufConn := pconn.buffered()
+	// Peek one byte at a time so that short HTTP/1 requests don't block waiting for the full preface
+	for n := 1; n <= len(h2cPreface); n++ {
+		b, err := bufConn.Peek(n)
+		if err != nil {
+			return false, err
+		}
+		if b[n-1] != h2cPreface[n-1] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
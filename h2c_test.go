@@ -0,0 +1,42 @@
+package puppy
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestTransparentH2C(t *testing.T) {
+	plistener := NewProxyListener(nil)
+	addr := testTransparentListener(t, plistener, "10.0.0.1", 50051, false)
+
+	c := testDial(t, addr)
+	defer c.Close()
+	sent := h2cPreface + "\x00\x00\x00\x04\x00\x00\x00\x00\x00"
+	c.Write([]byte(sent))
+
+	pconn := testAccept(t, plistener)
+	if pconn.Protocol() != ProtocolH2C {
+		t.Errorf("expected h2c connection, got %s", pconn.Protocol())
+	}
+	checkStr(t, pconn.RemoteAddr().String(), EncodeRemoteAddr("10.0.0.1", 50051, false))
+	checkStr(t, pconn.OriginKind().String(), OriginTransparentStatic.String())
+	read := make([]byte, len(sent))
+	if _, err := io.ReadFull(pconn, read); err != nil {
+		t.Fatal(err)
+	}
+	checkStr(t, string(read), sent)
+
+	// Short HTTP/1 requests still get read normally
+	c2 := testDial(t, addr)
+	defer c2.Close()
+	c2.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	pconn = testAccept(t, plistener)
+	if pconn.Protocol() != ProtocolHTTP {
+		t.Errorf("expected http connection, got %s", pconn.Protocol())
+	}
+	req, err := http.ReadRequest(bufio.NewReader(pconn))
+	testErr(t, err)
+	checkStr(t, req.URL.Path, "/")
+}
@@ -0,0 +1,75 @@
+package puppy
+
+/*
+Listeners that accept both explicit proxy requests and transparently redirected connections on the same port
+*/
+
+import (
+	"net"
+	"time"
+)
+
+// AddHybridListener adds a listener whose connections are detected as explicit proxy connections or transparent ones. Connections that start with a CONNECT request or a request with an absolute-form target are handled like connections from AddListener. Everything else, including TLS and other protocols, is handled like a connection from AddTransparentListener with the given destination
+func (listener *ProxyListener) AddHybridListener(inlisten net.Listener, destHost string, destPort int, useTLS bool) error {
+	addr := &proxyAddr{
+		Host:   destHost,
+		Port:   destPort,
+		UseTLS: useTLS,
+	}
+	listener.mtx.Lock()
+	il, err := listener.addListener(inlisten, false, addr, ListenerOptions{})
+	listener.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	listener.reportListenerAdded(il)
+	return nil
+}
+
+// Decide whether a connection from a hybrid listener is transparent without consuming any data
+func (listener *ProxyListener) detectTransparent(pconn *proxyConn) (bool, error) {
+	mode, waitTimeout := listener.getUnknownProtocolMode()
+	if mode == UnknownProtocolEmit && waitTimeout > 0 {
+		// Clients of protocols where the server talks first never send a request
+		pconn.SetReadDeadline(time.Now().Add(waitTimeout))
+		defer pconn.SetReadDeadline(time.Time{})
+	}
+
+	explicit, err := pconn.peekExplicitProxy()
+	if err != nil {
+		if neterr, ok := err.(net.Error); ok && neterr.Timeout() && mode == UnknownProtocolEmit {
+			return true, nil
+		}
+		return false, err
+	}
+	return !explicit, nil
+}
+
+// Check whether the client started the connection with a request meant for a proxy without consuming any data. Requests meant for a proxy are CONNECT requests and requests that give the full URL rather than a path, so only the start of the request target needs to be checked
+func (pconn *proxyConn) peekExplicitProxy() (bool, error) {
+	isHTTP, err := pconn.peekHTTPMethod()
+	if err != nil || !isHTTP {
+		return false, err
+	}
+
+	bufConn := pconn.buffered()
+	for n := 1; n <= maxMethodSniffLength+1; n++ {
+		b, err := bufConn.Peek(n)
+		if err != nil {
+			return false, err
+		}
+		if b[n-1] != ' ' {
+			continue
+		}
+		if string(b[:n-1]) == "CONNECT" {
+			return true, nil
+		}
+		target, err := bufConn.Peek(n + 1)
+		if err != nil {
+			return false, err
+		}
+		// Origin-form targets start with a slash and asterisk-form targets are just an asterisk
+		return target[n] != '/' && target[n] != '*', nil
+	}
+	return false, nil
+}
@@ -0,0 +1,75 @@
+package puppy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestHybridListener(t *testing.T) {
+	plistener := NewProxyListener(nil)
+	defer plistener.Close()
+	plistener.SetCACertificate(testCA(t))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testErr(t, plistener.AddHybridListener(l, "transparent.example", 8080, false))
+	addr := l.Addr().String()
+
+	t.Run("connect", func(t *testing.T) {
+		go func() {
+			tlsc, err := testConnectTLS(t, addr, "example.com:443", nil)
+			if err == nil {
+				tlsc.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+				defer tlsc.Close()
+			}
+		}()
+		pconn := testAccept(t, plistener)
+		defer pconn.Close()
+		checkStr(t, pconn.RemoteAddr().String(), EncodeRemoteAddr("example.com", 443, true))
+		checkStr(t, pconn.OriginKind().String(), OriginConnect.String())
+	})
+
+	t.Run("absolute", func(t *testing.T) {
+		c := testDial(t, addr)
+		defer c.Close()
+		c.Write([]byte("GET http://explicit.example/ HTTP/1.1\r\nHost: explicit.example\r\n\r\n"))
+		pconn := testAccept(t, plistener)
+		defer pconn.Close()
+		checkStr(t, pconn.RemoteAddr().String(), EncodeRemoteAddr("explicit.example", 80, false))
+		checkStr(t, pconn.OriginKind().String(), OriginAbsoluteURI.String())
+	})
+
+	t.Run("origin-form", func(t *testing.T) {
+		c := testDial(t, addr)
+		defer c.Close()
+		c.Write([]byte("GET /path HTTP/1.1\r\nHost: elsewhere.example\r\n\r\n"))
+		pconn := testAccept(t, plistener)
+		defer pconn.Close()
+		checkStr(t, pconn.RemoteAddr().String(), EncodeRemoteAddr("transparent.example", 8080, false))
+		checkStr(t, pconn.OriginKind().String(), OriginTransparentStatic.String())
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		go func() {
+			c := testDial(t, addr)
+			tlsc := tls.Client(c, &tls.Config{InsecureSkipVerify: true, ServerName: "transparent.example"})
+			if tlsc.Handshake() == nil {
+				tlsc.Write([]byte("GET / HTTP/1.1\r\nHost: transparent.example\r\n\r\n"))
+			}
+			defer tlsc.Close()
+		}()
+		pconn := testAccept(t, plistener)
+		defer pconn.Close()
+		// TLS is stripped so the destination is reached over TLS too
+		checkStr(t, pconn.RemoteAddr().String(), EncodeRemoteAddr("transparent.example", 8080, true))
+		req, err := http.ReadRequest(bufio.NewReader(pconn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStr(t, req.Host, "transparent.example")
+	})
+}
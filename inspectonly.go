@@ -0,0 +1,103 @@
+package puppy
+
+/*
+Reading requests while keeping the exact bytes the client sent
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// SetInspectOnly sets whether requests should be read from connections without being re-serialized. When enabled, the parsed request is available from the InspectedRequest method of the ProxyConn and reading from the ProxyConn produces the exact bytes sent by the client. Requests used to CONNECT are still consumed by the listener.
+func (listener *ProxyListener) SetInspectOnly(inspectOnly bool) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.inspectOnly = inspectOnly
+}
+
+func (listener *ProxyListener) getInspectOnly() bool {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.inspectOnly
+}
+
+func (pconn *proxyConn) InspectedRequest() *http.Request {
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+
+	return pconn.inspectedReq
+}
+
+// Put a request back so that reading from the connection produces it again
+func (pconn *proxyConn) putBackRequest(req *http.Request, peeked *peekedRequest) {
+	if peeked == nil {
+		pconn.returnRequest(req)
+		return
+	}
+
+	peeked.restore()
+	// Only the metadata is available, the body will be read from the connection
+	req.Body = http.NoBody
+	pconn.mtx.Lock()
+	pconn.inspectedReq = req
+	pconn.mtx.Unlock()
+}
+
+// Keeps a copy of everything read from a reader
+type recordingReader struct {
+	r         io.Reader
+	recorded  bytes.Buffer
+	recording bool
+	mem       *connMemory
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.recording {
+		if !r.mem.resize(r.recorded.Len(), r.recorded.Len()+n) {
+			// The connection is dropped so the data is thrown away rather than passed on as a truncated request
+			return 0, ErrConnMemoryLimit
+		}
+		r.recorded.Write(p[:n])
+	}
+	return n, err
+}
+
+// A request that was read from a connection while recording the original data
+type peekedRequest struct {
+	pconn     *proxyConn
+	original  bufferedConn
+	rec       *recordingReader
+	headerLen int
+}
+
+// Put all of the data read while reading the request back into the connection
+func (p *peekedRequest) restore() {
+	if p == nil {
+		return
+	}
+
+	p.rec.recording = false
+	// The recorded data is read back right away so it stops counting towards the memory limit
+	p.rec.mem.resize(p.rec.recorded.Len(), 0)
+	reader := bufio.NewReader(io.MultiReader(bytes.NewReader(p.rec.recorded.Bytes()), p.original.reader))
+	p.pconn.mtx.Lock()
+	p.pconn.conn = bufferedConn{reader, p.original.Conn}
+	p.pconn.mtx.Unlock()
+}
+
+// Stop recording data once the request has been consumed
+func (p *peekedRequest) discard() {
+	if p == nil {
+		return
+	}
+
+	p.rec.recording = false
+	p.rec.mem.resize(p.rec.recorded.Len(), 0)
+	p.rec.recorded = bytes.Buffer{}
+}
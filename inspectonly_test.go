@@ -0,0 +1,33 @@
+package puppy
+
+import (
+	"io"
+	"testing"
+)
+
+func TestInspectOnly(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	plistener.SetInspectOnly(true)
+
+	// Unusual spacing and header casing would be normalized if the request was re-serialized
+	sent := "POST http://example.com:8080/upload HTTP/1.1\r\nhost: example.com:8080\r\nX-Custom:   spaced\r\ncontent-length: 5\r\n\r\nhello" +
+		"GET http://example.com:8080/next HTTP/1.1\r\nHost: example.com:8080\r\n\r\n"
+	c := testDial(t, addr)
+	defer c.Close()
+	c.Write([]byte(sent))
+
+	pconn := testAccept(t, plistener)
+	checkStr(t, pconn.RemoteAddr().String(), EncodeRemoteAddr("example.com", 8080, false))
+	req := pconn.InspectedRequest()
+	if req == nil {
+		t.Fatal("no inspected request")
+	}
+	checkStr(t, req.Method, "POST")
+	checkStr(t, req.Header.Get("X-Custom"), "spaced")
+
+	read := make([]byte, len(sent))
+	if _, err := io.ReadFull(pconn, read); err != nil {
+		t.Fatal(err)
+	}
+	checkStr(t, string(read), sent)
+}
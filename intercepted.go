@@ -0,0 +1,73 @@
+package puppy
+
+/*
+Remembering which hosts TLS has been stripped for
+*/
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+// The most hosts InterceptedHosts keeps. The least recently intercepted host makes room for a new one
+const maxInterceptedHosts = 4096
+
+// A set of hosts that forgets the least recently added host once it is full. Has its own lock so it can be updated without holding the listener's
+type hostLRU struct {
+	mtx   sync.Mutex
+	max   int
+	order *list.List
+	hosts map[string]*list.Element
+}
+
+func newHostLRU(max int) *hostLRU {
+	return &hostLRU{max: max, order: list.New(), hosts: make(map[string]*list.Element)}
+}
+
+// Add a host or mark it as the most recently added one if it is already in the set
+func (l *hostLRU) add(host string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if elem, ok := l.hosts[host]; ok {
+		l.order.MoveToFront(elem)
+		return
+	}
+	l.hosts[host] = l.order.PushFront(host)
+	if l.order.Len() > l.max {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.hosts, oldest.Value.(string))
+	}
+}
+
+// The hosts in the set from the most to the least recently added
+func (l *hostLRU) list() []string {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	hosts := make([]string, 0, l.order.Len())
+	for elem := l.order.Front(); elem != nil; elem = elem.Next() {
+		hosts = append(hosts, elem.Value.(string))
+	}
+	return hosts
+}
+
+// InterceptedHosts returns the hosts TLS has been stripped for since the listener was created, from the most to the least recently intercepted. Each host appears once and is the one the certificate was signed for. Only the 4096 most recently intercepted hosts are kept. Hosts of connections whose TLS is stripped after a STARTTLS command are not included
+func (listener *ProxyListener) InterceptedHosts() []string {
+	return listener.intercepted.list()
+}
+
+// Record the host of a connection if TLS is being stripped from it
+func (listener *ProxyListener) recordIntercepted(pconn *proxyConn) {
+	// The connection may already be wrapped again after TLS was started so check for the certificate instead of the conn type
+	pconn.mtx.Lock()
+	stripped := pconn.servedCert != nil
+	host := pconn.certHost
+	pconn.mtx.Unlock()
+
+	if stripped && host != "" {
+		listener.intercepted.add(strings.ToLower(host))
+	}
+}
@@ -0,0 +1,90 @@
+package puppy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestInterceptedHosts(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+	plistener.SetCACertificate(testCA(t))
+	go func() {
+		for {
+			c, err := plistener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c.Read(nil)
+				c.Close()
+			}()
+		}
+	}()
+
+	if hosts := plistener.InterceptedHosts(); len(hosts) != 0 {
+		t.Fatalf("expected no intercepted hosts, got %v", hosts)
+	}
+	for _, host := range []string{"a.example.com", "b.example.com", "A.example.com", "c.example.com"} {
+		tlsc, err := testConnectTLS(t, addr, host+":443", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsc.Close()
+	}
+
+	expected := []string{"c.example.com", "a.example.com", "b.example.com"}
+	if hosts := plistener.InterceptedHosts(); !reflect.DeepEqual(hosts, expected) {
+		t.Fatalf("expected intercepted hosts %v, got %v", expected, hosts)
+	}
+}
+
+func TestInterceptedHostsTransparent(t *testing.T) {
+	plistener := NewProxyListener(nil)
+	defer plistener.Close()
+	plistener.SetCACertificate(testCA(t))
+	addr := testTransparentListener(t, plistener, "transparent.example", 443, false)
+
+	tlsc := tls.Client(testDial(t, addr), &tls.Config{InsecureSkipVerify: true})
+	defer tlsc.Close()
+	go tlsc.Write([]byte("GET / HTTP/1.1\r\nHost: transparent.example\r\n\r\n"))
+	testAccept(t, plistener).Close()
+
+	expected := []string{"transparent.example"}
+	if hosts := plistener.InterceptedHosts(); !reflect.DeepEqual(hosts, expected) {
+		t.Fatalf("expected intercepted hosts %v, got %v", expected, hosts)
+	}
+}
+
+func TestInterceptedHostsSkipsTunnels(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+	plistener.SetCACertificate(testCA(t))
+	plistener.SetLogOnlyMode(true)
+
+	tlsc, err := testConnectTLS(t, addr, server.Listener.Addr().String(), nil)
+	testErr(t, err)
+	tlsc.Close()
+
+	if hosts := plistener.InterceptedHosts(); len(hosts) != 0 {
+		t.Fatalf("expected tunneled hosts not to be listed, got %v", hosts)
+	}
+}
+
+func TestInterceptedHostsBounded(t *testing.T) {
+	hosts := newHostLRU(3)
+	for _, host := range []string{"a", "b", "c", "a", "d"} {
+		hosts.add(host)
+	}
+
+	expected := []string{"d", "a", "c"}
+	if got := hosts.list(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+}
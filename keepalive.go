@@ -0,0 +1,98 @@
+package puppy
+
+/*
+Passing each request on a keep-alive connection on as its own ProxyConn
+*/
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// The connection given to the consumer for a single request when splitting keep-alive connections. Reads return the request and then io.EOF. Writes go straight to the client. Closing it does not close the client connection
+type requestConn struct {
+	net.Conn
+	body      *io.PipeReader
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *requestConn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+func (c *requestConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.body.Close()
+	})
+	return nil
+}
+
+// Pass a single request from a keep-alive connection on to the consumer as its own ProxyConn. Blocks until the consumer closes it. Returns false if the client connection can't be used for any more requests
+func (listener *ProxyListener) emitRequestConn(pconn *proxyConn, req *http.Request) bool {
+	pr, pw := io.Pipe()
+	rc := &requestConn{
+		Conn:   pconn.buffered().Conn,
+		body:   pr,
+		closed: make(chan struct{}),
+	}
+
+	child := newProxyConn(rc, pconn.Logger())
+	pconn.mtx.Lock()
+	child.Addr = &proxyAddr{Host: pconn.Addr.Host, Port: pconn.Addr.Port, UseTLS: pconn.Addr.UseTLS}
+	child.origin = pconn.origin
+	child.caCert = pconn.caCert
+	child.signer = pconn.signer
+	child.certCache = pconn.certCache
+	child.memory = pconn.memory
+	child.destRewriter = pconn.destRewriter
+	child.certHost = pconn.certHost
+	child.extraSANs = pconn.extraSANs
+	child.clientAddr = pconn.clientAddr
+	child.acceptedAt = pconn.acceptedAt
+	child.handOff = pconn.handOff
+	child.listenerId = pconn.listenerId
+	child.peekTimeout = pconn.peekTimeout
+	child.readTimeout = pconn.readTimeout
+	pconn.mtx.Unlock()
+
+	written := make(chan error, 1)
+	go func() {
+		err := req.Write(pw)
+		pw.CloseWithError(io.EOF)
+		written <- err
+	}()
+
+	listener.logConnf(pconn, "Passing request on connection %d to the consumer as connection %d", pconn.Id(), child.Id())
+	listener.emitConn(child)
+	select {
+	case <-rc.closed:
+	case <-listener.outputConnDone:
+		child.Close()
+		return false
+	}
+
+	// Any of the request that wasn't read is still on the client connection
+	if err := <-written; err != nil {
+		return false
+	}
+	return true
+}
+
+// SetSplitKeepAlive sets whether each request on a plaintext keep-alive connection is passed on as its own ProxyConn with its own destination. Reading from one of these ProxyConns returns a single request followed by io.EOF and writing to it sends data to the client. Once the consumer is done with the request it must close the ProxyConn, which does not close the client connection, and the next request from the client is passed on as a new ProxyConn. Has no effect on CONNECT tunnels, transparent listeners, or in inspect-only or raw header mode
+func (listener *ProxyListener) SetSplitKeepAlive(split bool) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.splitKeepAlive = split
+}
+
+func (listener *ProxyListener) getSplitKeepAlive() bool {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.splitKeepAlive
+}
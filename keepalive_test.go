@@ -0,0 +1,55 @@
+package puppy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSplitKeepAlive(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	plistener.SetSplitKeepAlive(true)
+
+	c := testDial(t, addr)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	fmt.Fprintf(c, "POST http://first.example/ HTTP/1.1\r\nHost: first.example\r\nContent-Length: 5\r\n\r\nhello")
+	fmt.Fprintf(c, "GET http://second.example:8080/ HTTP/1.1\r\nHost: second.example:8080\r\n\r\n")
+
+	for i, expected := range []string{
+		EncodeRemoteAddr("first.example", 80, false),
+		EncodeRemoteAddr("second.example", 8080, false),
+	} {
+		pconn := testAccept(t, plistener)
+		checkStr(t, pconn.RemoteAddr().String(), expected)
+
+		pr := bufio.NewReader(pconn)
+		req, err := http.ReadRequest(pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		if i == 0 {
+			checkStr(t, string(body), "hello")
+		}
+		// Each ProxyConn only has one request
+		if _, err := pr.ReadByte(); err != io.EOF {
+			t.Errorf("expected io.EOF after request, got %v", err)
+		}
+
+		textResponse(200, fmt.Sprintf("response %d", i)).Write(pconn)
+		pconn.Close()
+
+		rsp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rspBody, _ := ioutil.ReadAll(rsp.Body)
+		checkStr(t, string(rspBody), fmt.Sprintf("response %d", i))
+	}
+}
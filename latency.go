@@ -0,0 +1,67 @@
+package puppy
+
+/*
+Artificial latency for simulating slow or jittery links
+*/
+
+import (
+	"math/rand"
+	"os"
+	"time"
+)
+
+// SetArtificialLatency delays each Read and Write on the connection by base plus a random amount of up to jitter. Delays end early with a timeout error if the connection's deadline passes. Passing zero for both disables the delay
+func (pconn *proxyConn) SetArtificialLatency(base, jitter time.Duration) {
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+
+	pconn.latencyBase = base
+	pconn.latencyJitter = jitter
+}
+
+// Wait for the artificial latency before a read or write. Returns an error if the deadline passes first
+func (pconn *proxyConn) injectLatency(read bool) error {
+	pconn.mtx.Lock()
+	base := pconn.latencyBase
+	jitter := pconn.latencyJitter
+	deadline := pconn.writeDeadline
+	if read {
+		deadline = pconn.readDeadline
+	}
+	pconn.mtx.Unlock()
+
+	if base <= 0 && jitter <= 0 {
+		return nil
+	}
+	delay := base
+	if jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(jitter)))
+	}
+
+	if !deadline.IsZero() {
+		if remaining := time.Until(deadline); remaining < delay {
+			if remaining > 0 {
+				time.Sleep(remaining)
+			}
+			return os.ErrDeadlineExceeded
+		}
+	}
+	time.Sleep(delay)
+	return nil
+}
+
+// SetArtificialLatency sets the artificial latency given to new connections. See ProxyConn.SetArtificialLatency
+func (listener *ProxyListener) SetArtificialLatency(base, jitter time.Duration) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.latencyBase = base
+	listener.latencyJitter = jitter
+}
+
+func (listener *ProxyListener) getArtificialLatency() (time.Duration, time.Duration) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.latencyBase, listener.latencyJitter
+}
@@ -0,0 +1,50 @@
+package puppy
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestArtificialLatency(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	pconn := newProxyConn(server, log.New(ioutil.Discard, "", 0))
+	defer pconn.Close()
+	go io.Copy(ioutil.Discard, client)
+
+	base := 30 * time.Millisecond
+	jitter := 30 * time.Millisecond
+	pconn.SetArtificialLatency(base, jitter)
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		if _, err := pconn.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		// Only the lower bound is checked since a busy machine can delay the write by any amount
+		if elapsed := time.Since(start); elapsed < base {
+			t.Errorf("write took %s, expected at least %s", elapsed, base)
+		}
+	}
+}
+
+func TestArtificialLatencyDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	pconn := newProxyConn(server, log.New(ioutil.Discard, "", 0))
+	defer pconn.Close()
+
+	pconn.SetArtificialLatency(5*time.Second, 0)
+	pconn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	_, err := pconn.Read(make([]byte, 10))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("read waited %s past its deadline", elapsed)
+	}
+}
@@ -0,0 +1,59 @@
+package puppy
+
+/*
+Closing connections once they have been open for too long
+*/
+
+import (
+	"time"
+)
+
+// SetMaxConnectionLifetime sets the longest a connection can be open for after it is accepted by the listener regardless of whether it is active. Connections open for longer are closed with a CloseReason of CloseReasonLifetimeExceeded. A value of zero (the default) means connections can be open forever. Can be overridden for a connection with its SetMaxLifetime method.
+func (listener *ProxyListener) SetMaxConnectionLifetime(d time.Duration) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.maxConnLifetime = d
+}
+
+func (listener *ProxyListener) getMaxConnectionLifetime() time.Duration {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.maxConnLifetime
+}
+
+// Close the connection once it has been open for the given amount of time
+func (pconn *proxyConn) limitLifetime(d time.Duration) {
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+
+	if pconn.closeReason != "" {
+		return
+	}
+	if pconn.lifetimeTimer != nil {
+		pconn.lifetimeTimer.Stop()
+	}
+	pconn.lifetimeTimer = time.AfterFunc(d, func() {
+		pconn.Logger().Println("Connection", pconn.Id(), "exceeded its maximum lifetime, closing")
+		pconn.closeWithReason(CloseReasonLifetimeExceeded)
+	})
+}
+
+func (pconn *proxyConn) SetMaxLifetime(d time.Duration) {
+	pconn.mtx.Lock()
+	if pconn.lifetimeTimer != nil {
+		pconn.lifetimeTimer.Stop()
+		pconn.lifetimeTimer = nil
+	}
+	pconn.mtx.Unlock()
+	if d <= 0 {
+		return
+	}
+
+	remaining := d - time.Since(pconn.acceptedAt)
+	if remaining < 0 {
+		remaining = 0
+	}
+	pconn.limitLifetime(remaining)
+}
@@ -0,0 +1,62 @@
+package puppy
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestMaxConnectionLifetime(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	plistener.SetMaxConnectionLifetime(100 * time.Millisecond)
+
+	c := testDial(t, addr)
+	defer c.Close()
+	c.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	pconn := testAccept(t, plistener)
+	checkStr(t, pconn.CloseReason(), "")
+
+	// The connection stays busy but still gets closed
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		for {
+			if _, err := pconn.Write([]byte("busy")); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	io.Copy(ioutil.Discard, c)
+	checkStr(t, pconn.CloseReason(), CloseReasonLifetimeExceeded)
+
+	pconn.Close()
+	checkStr(t, pconn.CloseReason(), CloseReasonLifetimeExceeded)
+}
+
+func TestSetMaxLifetime(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	plistener.SetMaxConnectionLifetime(time.Hour)
+
+	start := time.Now()
+	c := testDial(t, addr)
+	defer c.Close()
+	c.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	pconn := testAccept(t, plistener)
+	pconn.SetMaxLifetime(200 * time.Millisecond)
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		for {
+			if _, err := pconn.Write([]byte("busy")); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	io.Copy(ioutil.Discard, c)
+	checkStr(t, pconn.CloseReason(), CloseReasonLifetimeExceeded)
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("connection closed after %s, expected about 200ms", elapsed)
+	}
+}
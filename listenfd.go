@@ -0,0 +1,26 @@
+package puppy
+
+/*
+Listening on sockets inherited from another process, such as with systemd socket activation or a graceful restart
+*/
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// ListenerFromFd makes a listener from a listening socket file descriptor inherited from another process so that it can be passed to AddListener. The name is only used in error messages. ListenerFromFd takes ownership of the descriptor and closes it whether or not it succeeds. The returned listener uses its own non-blocking duplicate of the socket, so closing the listener stops it from accepting connections without affecting other processes that share the socket
+func ListenerFromFd(fd uintptr, name string) (net.Listener, error) {
+	f := os.NewFile(fd, name)
+	if f == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d for %s", fd, name)
+	}
+	defer f.Close()
+
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on inherited socket %s: %s", name, err)
+	}
+	return l, nil
+}
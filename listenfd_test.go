@@ -0,0 +1,60 @@
+//go:build !windows
+// +build !windows
+
+package puppy
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestListenerFromFd(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testErr(t, err)
+	f, err := l.(*net.TCPListener).File()
+	testErr(t, err)
+	// ListenerFromFd closes the descriptor so it can't be one the os.File still owns
+	fd, err := syscall.Dup(int(f.Fd()))
+	testErr(t, err)
+	f.Close()
+	addr := l.Addr().String()
+	// Only the duplicate passed on should be left listening, the way it would be after an exec
+	l.Close()
+
+	inherited, err := ListenerFromFd(uintptr(fd), "inherited")
+	testErr(t, err)
+	checkStr(t, inherited.Addr().String(), addr)
+
+	plistener := NewProxyListener(nil)
+	defer plistener.Close()
+	testErr(t, plistener.AddListener(inherited))
+
+	c := testDial(t, addr)
+	defer c.Close()
+	fmt.Fprint(c, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	pconn := testAccept(t, plistener)
+	defer pconn.Close()
+	checkStr(t, pconn.RemoteAddr().String(), EncodeRemoteAddr("example.com", 80, false))
+}
+
+func TestListenerFromFdNotListening(t *testing.T) {
+	// A connected socket from a socketpair is not something that can accept connections
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	testErr(t, err)
+	defer syscall.Close(fds[1])
+	if l, err := ListenerFromFd(uintptr(fds[0]), "socketpair"); err == nil {
+		if _, err := l.Accept(); err == nil {
+			t.Error("accepted a connection on one end of a socketpair")
+		}
+		l.Close()
+	}
+
+	var pipe [2]int
+	testErr(t, syscall.Pipe(pipe[:]))
+	defer syscall.Close(pipe[1])
+	if _, err := ListenerFromFd(uintptr(pipe[0]), "pipe"); err == nil {
+		t.Error("expected an error making a listener from a pipe")
+	}
+}
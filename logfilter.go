@@ -0,0 +1,42 @@
+package puppy
+
+/*
+Limiting which connections get informational log lines
+*/
+
+import (
+	"fmt"
+)
+
+// LogFilter decides whether informational log lines about a connection are written to the listener's logger. Since it is consulted for each line, a connection's destination can be used once it is known
+type LogFilter func(pconn ProxyConn) bool
+
+// SetLogFilter sets which connections the listener writes informational log lines about, such as connections being accepted or passed through. Errors are logged for every connection. If nil, every connection is logged
+func (listener *ProxyListener) SetLogFilter(filter LogFilter) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.logFilter = filter
+}
+
+func (listener *ProxyListener) getLogFilter() LogFilter {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.logFilter
+}
+
+// Check whether informational log lines should be written about a connection
+func (listener *ProxyListener) logsConn(pconn ProxyConn) bool {
+	filter := listener.getLogFilter()
+	return filter == nil || filter(pconn)
+}
+
+// Write an informational log line about a connection if it passes the log filter
+func (listener *ProxyListener) logConnf(pconn ProxyConn, format string, v ...interface{}) {
+	if !listener.logsConn(pconn) {
+		return
+	}
+	// Report the caller's line rather than this one
+	listener.logger.Output(2, fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,69 @@
+package puppy
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogFilter(t *testing.T) {
+	listenerLog := &testLogBuffer{}
+	plistener := NewProxyListener(log.New(listenerLog, "", 0))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testErr(t, plistener.AddListener(l))
+	defer plistener.Close()
+	plistener.SetLogFilter(func(pconn ProxyConn) bool {
+		host, _, _, _ := DecodeRemoteAddr(pconn.RemoteAddr().String())
+		return host == "logged.example"
+	})
+
+	accept := func(host string) ProxyConn {
+		c := testDial(t, l.Addr().String())
+		t.Cleanup(func() { c.Close() })
+		fmt.Fprintf(c, "GET http://%s/ HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+		pconn := testAccept(t, plistener)
+		t.Cleanup(func() { pconn.Close() })
+		return pconn
+	}
+	logged := accept("logged.example")
+	filtered := accept("filtered.example")
+
+	// Errors are logged no matter what the filter says
+	c := testDial(t, l.Addr().String())
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("not a request\r\n\r\n"))
+	http.ReadResponse(bufio.NewReader(c), nil)
+
+	out := listenerLog.String()
+	if !strings.Contains(out, fmt.Sprintf("Connection %d accepted", logged.Id())) {
+		t.Errorf("expected connection %d to be logged: %q", logged.Id(), out)
+	}
+	if strings.Contains(out, fmt.Sprintf("Connection %d accepted", filtered.Id())) {
+		t.Errorf("expected connection %d not to be logged: %q", filtered.Id(), out)
+	}
+	if !strings.Contains(out, "Received connection to: Host='logged.example'") {
+		t.Errorf("expected destination of connection %d to be logged: %q", logged.Id(), out)
+	}
+	if strings.Contains(out, "filtered.example") {
+		t.Errorf("expected nothing about connection %d to be logged: %q", filtered.Id(), out)
+	}
+	if strings.Contains(out, fmt.Sprintf("Connection %d ", filtered.Id())) {
+		t.Errorf("expected nothing about connection %d to be logged: %q", filtered.Id(), out)
+	}
+	// Only the logged connection gets a line for being received
+	if n := strings.Count(out, "Received conn from listener"); n != 1 {
+		t.Errorf("expected 1 received connection line, got %d: %q", n, out)
+	}
+	if !strings.Contains(out, "Could not translate connection") {
+		t.Errorf("expected error to be logged: %q", out)
+	}
+}
@@ -0,0 +1,20 @@
+package puppy
+
+/*
+Observing connections without intercepting any of them
+*/
+
+// SetLogOnlyMode sets whether every connection is tunneled to its destination without being intercepted. The destination of each connection is still worked out and reported with an EventInterceptionBypassed event, so this can be used to see what the listener would intercept before turning interception on
+func (listener *ProxyListener) SetLogOnlyMode(logOnly bool) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.logOnly = logOnly
+}
+
+func (listener *ProxyListener) getLogOnlyMode() bool {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.logOnly
+}
@@ -0,0 +1,121 @@
+package puppy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testBypassEvent(t *testing.T, events chan ProxyEvent, host string, port int) {
+	t.Helper()
+	select {
+	case e := <-events:
+		checkStr(t, e.Kind, EventInterceptionBypassed)
+		checkStr(t, e.Detail, string(BypassLogOnly))
+		checkStr(t, net.JoinHostPort(e.Host, fmt.Sprint(e.Port)), net.JoinHostPort(host, fmt.Sprint(port)))
+	case <-time.After(5 * time.Second):
+		t.Error("no bypass event was emitted")
+	}
+}
+
+func TestLogOnlyModeConnect(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "from upstream")
+	}))
+	defer server.Close()
+	host, port := testServerDest(t, server)
+
+	plistener, addr := testProxyListener(t)
+	plistener.SetLogOnlyMode(true)
+	events := make(chan ProxyEvent, 4)
+	plistener.SetEventHandler(func(e ProxyEvent) {
+		events <- e
+	})
+
+	tlsc, err := testConnectTLS(t, addr, server.Listener.Addr().String(), nil)
+	testErr(t, err)
+	defer tlsc.Close()
+
+	// The upstream's own certificate means nothing was decrypted along the way
+	peer := tlsc.ConnectionState().PeerCertificates
+	if len(peer) == 0 || !peer[0].Equal(server.Certificate()) {
+		t.Error("client did not get the upstream certificate")
+	}
+	testBypassEvent(t, events, host, port)
+
+	fmt.Fprintf(tlsc, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", server.Listener.Addr())
+	tlsc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rsp, err := http.ReadResponse(bufio.NewReader(tlsc), nil)
+	testErr(t, err)
+	body, _ := io.ReadAll(rsp.Body)
+	checkStr(t, string(body), "from upstream")
+}
+
+func TestLogOnlyModePlaintext(t *testing.T) {
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("X-Sent")
+		fmt.Fprint(w, "from upstream")
+	}))
+	defer server.Close()
+	host, port := testServerDest(t, server)
+
+	plistener, addr := testProxyListener(t)
+	plistener.SetLogOnlyMode(true)
+	events := make(chan ProxyEvent, 4)
+	plistener.SetEventHandler(func(e ProxyEvent) {
+		events <- e
+	})
+
+	c := testDial(t, addr)
+	defer c.Close()
+	fmt.Fprintf(c, "GET %s/ HTTP/1.1\r\nHost: %s\r\nX-Sent:  spaced \r\nConnection: close\r\n\r\n", server.URL, server.Listener.Addr())
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rsp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	testErr(t, err)
+	body, _ := io.ReadAll(rsp.Body)
+	checkStr(t, string(body), "from upstream")
+	checkStr(t, <-received, "spaced")
+	testBypassEvent(t, events, host, port)
+
+	// Turning it off goes back to intercepting
+	plistener.SetLogOnlyMode(false)
+	c2 := testDial(t, addr)
+	defer c2.Close()
+	fmt.Fprintf(c2, "GET %s/ HTTP/1.1\r\nHost: %s\r\n\r\n", server.URL, server.Listener.Addr())
+	pconn := testAccept(t, plistener)
+	defer pconn.Close()
+	checkStr(t, pconn.RemoteAddr().String(), EncodeRemoteAddr(host, port, false))
+}
+
+func TestLogOnlyModeTransparent(t *testing.T) {
+	echoAddr := testEchoServer(t)
+	echoHost, echoPortStr, _ := net.SplitHostPort(echoAddr)
+	var echoPort int
+	fmt.Sscan(echoPortStr, &echoPort)
+
+	plistener := NewProxyListener(nil)
+	defer plistener.Close()
+	plistener.SetLogOnlyMode(true)
+	events := make(chan ProxyEvent, 4)
+	plistener.SetEventHandler(func(e ProxyEvent) {
+		events <- e
+	})
+	addr := testTransparentListener(t, plistener, echoHost, echoPort, true)
+
+	c := testDial(t, addr)
+	defer c.Close()
+	msg := "\x16not intercepted"
+	c.Write([]byte(msg))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	echoed := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, echoed); err != nil || string(echoed) != msg {
+		t.Errorf("passthrough did not reach destination: %q %v", echoed, err)
+	}
+	testBypassEvent(t, events, echoHost, echoPort)
+}
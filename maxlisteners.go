@@ -0,0 +1,16 @@
+package puppy
+
+/*
+Capping how many listeners a ProxyListener accepts connections from
+*/
+
+// Returned when adding a listener to a ProxyListener that already has the maximum number of listeners set with SetMaxListeners
+const ErrTooManyListeners = ConstErr("ProxyListener has too many listeners")
+
+// SetMaxListeners sets the most listeners that can be added to the ProxyListener at once. Adding more returns ErrTooManyListeners. Listeners stop counting once they are removed or closed. Zero (the default) means there is no limit
+func (listener *ProxyListener) SetMaxListeners(n int) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.maxListeners = n
+}
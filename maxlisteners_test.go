@@ -0,0 +1,48 @@
+package puppy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMaxListeners(t *testing.T) {
+	plistener := NewProxyListener(nil)
+	defer plistener.Close()
+	plistener.SetMaxListeners(2)
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+
+	l1, l2, l3 := listen(), listen(), listen()
+	defer l3.Close()
+	testErr(t, plistener.AddListener(l1))
+	testErr(t, plistener.AddTransparentListener(l2, "example.com", 80, false))
+	if err := plistener.AddListener(l3); err != ErrTooManyListeners {
+		t.Fatalf("expected ErrTooManyListeners, got %v", err)
+	}
+
+	// Removing a listener makes room for another one
+	testErr(t, plistener.RemoveListener(l2))
+	testErr(t, plistener.AddListener(l3))
+
+	// So does a listener being closed out from under the ProxyListener
+	l4 := listen()
+	defer l4.Close()
+	l1.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := plistener.AddListener(l4)
+		if err == nil {
+			break
+		}
+		if err != ErrTooManyListeners || time.Now().After(deadline) {
+			t.Fatalf("expected closed listener to stop counting, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,50 @@
+package puppy
+
+/*
+Limiting the memory a single connection can use for buffering data
+*/
+
+import (
+	"sync/atomic"
+)
+
+// Returned when reading a request would buffer more data than the connection's memory limit allows
+const ErrConnMemoryLimit = ConstErr("connection exceeded its memory limit")
+
+// The memory used by a connection's buffers. Shared by everything that buffers data for the connection so that together they stay under the limit
+type connMemory struct {
+	limit int64
+	used  int64 // Accessed atomically
+}
+
+// Account for a buffer changing size from old to new bytes. Returns false without changing anything if growing it would go over the limit. Safe to call on a nil connMemory, which has no limit
+func (m *connMemory) resize(old, new int) bool {
+	if m == nil {
+		return true
+	}
+	delta := int64(new - old)
+	if used := atomic.AddInt64(&m.used, delta); delta > 0 && used > m.limit {
+		atomic.AddInt64(&m.used, -delta)
+		return false
+	}
+	return true
+}
+
+// SetConnMemoryLimit sets the most bytes each connection can hold in buffers used to inspect it: the original bytes of requests in inspect-only and raw header mode, the captured ClientHello, and partial websocket frames. When a request would go over the limit the connection is dropped with a 431 response. The ClientHello capture and websocket inspection stop buffering and let the connection continue instead. A limit of 0 or less means there is no limit
+func (listener *ProxyListener) SetConnMemoryLimit(bytes int) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.connMemoryLimit = bytes
+}
+
+// Make the memory accounting for a new connection. Returns nil if there is no limit
+func (listener *ProxyListener) newConnMemory() *connMemory {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	if listener.connMemoryLimit <= 0 {
+		return nil
+	}
+	return &connMemory{limit: int64(listener.connMemoryLimit)}
+}
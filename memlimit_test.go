@@ -0,0 +1,93 @@
+package puppy
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestConnMemoryLimitRequest(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+	plistener.SetInspectOnly(true)
+	plistener.SetConnMemoryLimit(8 * 1024)
+
+	t.Run("under limit", func(t *testing.T) {
+		c := testDial(t, addr)
+		defer c.Close()
+		c.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		pconn := testAccept(t, plistener)
+		defer pconn.Close()
+		checkStr(t, pconn.InspectedRequest().Host, "example.com")
+	})
+
+	t.Run("over limit", func(t *testing.T) {
+		c := testDial(t, addr)
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		go func() {
+			// The header keeps going until the connection is dropped
+			c.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n"))
+			line := "X-Filler: " + strings.Repeat("a", 1000) + "\r\n"
+			for i := 0; i < 1024; i++ {
+				if _, err := c.Write([]byte(line)); err != nil {
+					return
+				}
+			}
+		}()
+		rsp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+			t.Fatalf("expected status 431, got %d", rsp.StatusCode)
+		}
+	})
+}
+
+func TestConnMemoryLimitClientHello(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+	plistener.SetCACertificate(testCA(t))
+	// Too small for any ClientHello
+	plistener.SetConnMemoryLimit(64)
+	conns := testAcceptAsync(plistener)
+
+	tlsc, err := testConnectTLS(t, addr, "example.com:443", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsc.Close()
+
+	var pconn ProxyConn
+	select {
+	case pconn = <-conns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for connection")
+	}
+	if _, ok := pconn.RawClientHello(); ok {
+		t.Error("expected ClientHello capture to give up at the memory limit")
+	}
+}
+
+func TestConnMemoryLimitWebSocket(t *testing.T) {
+	mem := &connMemory{limit: 64}
+	parser := newWSFrameParser(ToServer, func(f WSFrame) {
+		t.Errorf("unexpected frame delivered")
+	}, mem)
+
+	frame := testWSFrame(true, websocket.BinaryMessage, make([]byte, 100), nil)
+	if err := parser.feed(frame[:80]); err != ErrConnMemoryLimit {
+		t.Fatalf("expected ErrConnMemoryLimit, got %v", err)
+	}
+	if used := atomic.LoadInt64(&mem.used); used != 0 {
+		t.Errorf("expected abandoned buffers to be released, %d bytes still counted", used)
+	}
+	// Data keeps flowing after inspection is abandoned
+	testErr(t, parser.feed(frame[80:]))
+}
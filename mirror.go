@@ -0,0 +1,84 @@
+package puppy
+
+/*
+Making upstream TLS handshakes look like the handshake of the client being intercepted
+*/
+
+import (
+	"crypto/tls"
+)
+
+// Keep the parameters of the ClientHello a client sent when TLS was stripped from its connection
+func (pconn *proxyConn) recordHelloInfo(hello *tls.ClientHelloInfo) {
+	info := &tls.ClientHelloInfo{
+		CipherSuites:      append([]uint16(nil), hello.CipherSuites...),
+		ServerName:        hello.ServerName,
+		SupportedCurves:   append([]tls.CurveID(nil), hello.SupportedCurves...),
+		SupportedPoints:   append([]uint8(nil), hello.SupportedPoints...),
+		SignatureSchemes:  append([]tls.SignatureScheme(nil), hello.SignatureSchemes...),
+		SupportedProtos:   append([]string(nil), hello.SupportedProtos...),
+		SupportedVersions: append([]uint16(nil), hello.SupportedVersions...),
+	}
+
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+	pconn.helloInfo = info
+}
+
+func (pconn *proxyConn) getHelloInfo() *tls.ClientHelloInfo {
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+
+	return pconn.helloInfo
+}
+
+// Configure a client TLS config to offer what a client offered in its ClientHello, as far as the standard library allows. Values the standard library does not implement, including GREASE values, are dropped
+func mirrorTLSConfig(config *tls.Config, hello *tls.ClientHelloInfo) {
+	if hello.ServerName != "" {
+		config.ServerName = hello.ServerName
+	}
+	config.NextProtos = append([]string(nil), hello.SupportedProtos...)
+
+	known := make(map[uint16]bool)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.ID] = true
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		known[suite.ID] = true
+	}
+	var suites []uint16
+	for _, id := range hello.CipherSuites {
+		if known[id] {
+			suites = append(suites, id)
+		}
+	}
+	if len(suites) > 0 {
+		config.CipherSuites = suites
+	}
+
+	var curves []tls.CurveID
+	for _, curve := range hello.SupportedCurves {
+		switch curve {
+		case tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521, tls.X25519MLKEM768:
+			curves = append(curves, curve)
+		}
+	}
+	if len(curves) > 0 {
+		config.CurvePreferences = curves
+	}
+
+	var minVersion, maxVersion uint16
+	for _, v := range hello.SupportedVersions {
+		switch v {
+		case tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13:
+			if minVersion == 0 || v < minVersion {
+				minVersion = v
+			}
+			if v > maxVersion {
+				maxVersion = v
+			}
+		}
+	}
+	config.MinVersion = minVersion
+	config.MaxVersion = maxVersion
+}
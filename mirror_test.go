@@ -0,0 +1,104 @@
+package puppy
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorClientHello(t *testing.T) {
+	cert, err := NewCACertSigner(testCA(t)).SignHost([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(chan *tls.ClientHelloInfo, 1)
+	upstream, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"puppy-test"},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			seen <- hello
+			return nil, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			c, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			c.(*tls.Conn).Handshake()
+			c.Close()
+		}
+	}()
+
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+	plistener.SetCACertificate(testCA(t))
+	conns := testAcceptAsync(plistener)
+	clientSuites := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	tlsc, err := testConnectTLS(t, addr, "example.com:443", &tls.Config{
+		ServerName:         "example.com",
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"puppy-test", "http/1.1"},
+		CipherSuites:       clientSuites,
+		MaxVersion:         tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsc.Close()
+	var pconn ProxyConn
+	select {
+	case pconn = <-conns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for connection")
+	}
+
+	host, portStr, _ := net.SplitHostPort(upstream.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	conn, err := plistener.DialUpstreamWithOptions(host, port, true, &DialOptions{Client: pconn, MirrorClientHello: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	hello := <-seen
+	checkStr(t, strings.Join(hello.SupportedProtos, ","), "puppy-test,http/1.1")
+	checkStr(t, hello.ServerName, "example.com")
+	suites := make(map[uint16]bool)
+	for _, id := range hello.CipherSuites {
+		suites[id] = true
+	}
+	for _, id := range clientSuites {
+		if !suites[id] {
+			t.Errorf("expected upstream to be offered cipher suite %s", tls.CipherSuiteName(id))
+		}
+	}
+	if len(hello.CipherSuites) != len(clientSuites) {
+		t.Errorf("expected %d cipher suites, got %d", len(clientSuites), len(hello.CipherSuites))
+	}
+	for _, v := range hello.SupportedVersions {
+		if v == tls.VersionTLS13 {
+			t.Error("expected TLS 1.3 to not be offered")
+		}
+	}
+	checkStr(t, conn.(*tls.Conn).ConnectionState().NegotiatedProtocol, "puppy-test")
+
+	// Without mirroring the standard library defaults are used
+	plain, err := plistener.DialUpstream(host, port, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	hello = <-seen
+	if len(hello.SupportedProtos) != 0 {
+		t.Errorf("expected no ALPN protocols, got %v", hello.SupportedProtos)
+	}
+}
@@ -0,0 +1,36 @@
+package puppy
+
+/*
+Choosing what happens to plaintext requests that don't say where they are going
+*/
+
+// MissingHostMode is what a listener does with plaintext requests that have no Host header and no absolute URI
+type MissingHostMode int
+
+const (
+	// Respond with 400 Bad Request and close the connection
+	MissingHostError MissingHostMode = iota
+	// Close the connection without responding
+	MissingHostDrop
+	// Handle the connection as if it came from a transparent listener for the destination given to SetOnMissingHost
+	MissingHostUseTransparentDest
+)
+
+// SetOnMissingHost sets what happens to plaintext requests that do not say where they are going. The destination is only used with MissingHostUseTransparentDest. Without a destination, MissingHostUseTransparentDest behaves like MissingHostError
+func (listener *ProxyListener) SetOnMissingHost(mode MissingHostMode, destHost string, destPort int, useTLS bool) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.missingHostMode = mode
+	listener.missingHostDest = nil
+	if destHost != "" {
+		listener.missingHostDest = &proxyAddr{Host: destHost, Port: destPort, UseTLS: useTLS}
+	}
+}
+
+func (listener *ProxyListener) getOnMissingHost() (MissingHostMode, *proxyAddr) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.missingHostMode, listener.missingHostDest
+}
@@ -0,0 +1,59 @@
+package puppy
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOnMissingHost(t *testing.T) {
+	const request = "GET /nohost HTTP/1.0\r\n\r\n"
+
+	t.Run("error", func(t *testing.T) {
+		_, addr := testProxyListener(t)
+		c := testDial(t, addr)
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write([]byte(request))
+
+		rsp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsp.StatusCode != 400 {
+			t.Fatalf("expected status 400, got %d", rsp.StatusCode)
+		}
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		plistener, addr := testProxyListener(t)
+		plistener.SetOnMissingHost(MissingHostDrop, "", 0, false)
+		c := testDial(t, addr)
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write([]byte(request))
+
+		if n, err := c.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("expected connection to be closed, read %d bytes", n)
+		}
+	})
+
+	t.Run("use transparent dest", func(t *testing.T) {
+		plistener, addr := testProxyListener(t)
+		plistener.SetOnMissingHost(MissingHostUseTransparentDest, "fallback.example", 8080, false)
+		c := testDial(t, addr)
+		defer c.Close()
+		c.Write([]byte(request))
+
+		pconn := testAccept(t, plistener)
+		checkStr(t, pconn.RemoteAddr().String(), EncodeRemoteAddr("fallback.example", 8080, false))
+		checkStr(t, pconn.OriginKind().String(), OriginTransparentStatic.String())
+		line, err := bufio.NewReader(pconn).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStr(t, strings.TrimSpace(line), "GET /nohost HTTP/1.1")
+	})
+}
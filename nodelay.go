@@ -0,0 +1,32 @@
+package puppy
+
+/*
+Turning Nagle's algorithm on or off for client and upstream connections
+*/
+
+import (
+	"net"
+)
+
+// SetTCPNoDelay sets whether Nagle's algorithm is disabled on accepted client connections and connections made by DialUpstream. Connections that are not TCP are left alone. If this is never called, connections keep Go's default of having Nagle's algorithm disabled
+func (listener *ProxyListener) SetTCPNoDelay(noDelay bool) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.tcpNoDelay = &noDelay
+}
+
+// Apply the TCP_NODELAY setting to a connection if one was set and the connection is TCP
+func (listener *ProxyListener) applyTCPNoDelay(c net.Conn) {
+	listener.mtx.Lock()
+	noDelay := listener.tcpNoDelay
+	listener.mtx.Unlock()
+
+	tcpConn, ok := c.(*net.TCPConn)
+	if noDelay == nil || !ok {
+		return
+	}
+	if err := tcpConn.SetNoDelay(*noDelay); err != nil {
+		listener.logger.Println("Could not set TCP_NODELAY:", err)
+	}
+}
@@ -0,0 +1,62 @@
+//go:build !windows
+// +build !windows
+
+package puppy
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// Read the TCP_NODELAY option of a connection's socket
+func testNoDelay(t *testing.T, c net.Conn) bool {
+	tcpConn, ok := c.(*net.TCPConn)
+	if !ok {
+		t.Fatalf("expected a TCP connection, got %T", c)
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		value, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value != 0
+}
+
+func TestTCPNoDelay(t *testing.T) {
+	for _, noDelay := range []bool{false, true} {
+		plistener, addr := testProxyListener(t)
+		defer plistener.Close()
+		plistener.SetTCPNoDelay(noDelay)
+
+		c := testDial(t, addr)
+		defer c.Close()
+		c.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		pconn := testAccept(t, plistener)
+		if got := testNoDelay(t, pconn.NetConn()); got != noDelay {
+			t.Errorf("expected accepted connection to have TCP_NODELAY=%v, got %v", noDelay, got)
+		}
+
+		host, portStr, _ := net.SplitHostPort(addr)
+		port, _ := strconv.Atoi(portStr)
+		upstream, err := plistener.DialUpstream(host, port, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer upstream.Close()
+		if got := testNoDelay(t, upstream); got != noDelay {
+			t.Errorf("expected upstream connection to have TCP_NODELAY=%v, got %v", noDelay, got)
+		}
+	}
+}
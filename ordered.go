@@ -0,0 +1,58 @@
+package puppy
+
+/*
+Translating connections one at a time so they come out of Accept in the order they arrived
+*/
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// SetOrderedTranslation sets whether connections are translated one at a time in the order they were accepted from the listeners. Each connection is handed to Accept, tunneled, or dropped before the next one is looked at. This makes the order of connections from Accept deterministic but only one connection is translated at a time, so a client that is slow to send its request or a consumer that is slow to call Accept holds up every connection behind it. Should only be used for testing and recording where ordering matters more than throughput
+func (listener *ProxyListener) SetOrderedTranslation(ordered bool) {
+	var value int32
+	if ordered {
+		value = 1
+	}
+	atomic.StoreInt32(&listener.ordered, value)
+}
+
+// Atomic rather than locked since the translator calls it for every connection and the translator never takes listener.mtx
+func (listener *ProxyListener) getOrderedTranslation() bool {
+	return atomic.LoadInt32(&listener.ordered) == 1
+}
+
+// Lets the translator know when it can move on to the next connection. A nil handOff is never waited on
+type handOff struct {
+	once sync.Once
+	done chan struct{}
+}
+
+func (listener *ProxyListener) newHandOff() *handOff {
+	if !listener.getOrderedTranslation() {
+		return nil
+	}
+	return &handOff{done: make(chan struct{})}
+}
+
+// Mark the connection as no longer holding up the translator. Safe to call more than once
+func (h *handOff) release() {
+	if h == nil {
+		return
+	}
+	h.once.Do(func() {
+		close(h.done)
+	})
+}
+
+// Wait until the connection is released or the listener is shutting down
+func (h *handOff) wait(shutdown <-chan struct{}) {
+	if h == nil {
+		return
+	}
+	select {
+	case <-h.done:
+	case <-shutdown:
+	}
+}
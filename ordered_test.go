@@ -0,0 +1,97 @@
+package puppy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// Dial a connection that sends its request late, then one that sends it right away, and return the host of the first connection from Accept
+func testFirstAccepted(t *testing.T, plistener *ProxyListener, addr string) string {
+	slow := testDial(t, addr)
+	defer slow.Close()
+	// Give the listener time to pass the slow connection on to the translator
+	time.Sleep(50 * time.Millisecond)
+
+	fast := testDial(t, addr)
+	defer fast.Close()
+	fmt.Fprint(fast, "GET http://fast.example/ HTTP/1.1\r\nHost: fast.example\r\n\r\n")
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(slow, "GET http://slow.example/ HTTP/1.1\r\nHost: slow.example\r\n\r\n")
+	}()
+
+	first := testAccept(t, plistener)
+	defer first.Close()
+	second := testAccept(t, plistener)
+	defer second.Close()
+	host, _, _, err := DecodeRemoteAddr(first.RemoteAddr().String())
+	testErr(t, err)
+	return host
+}
+
+func TestOrderedTranslation(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	plistener.SetOrderedTranslation(true)
+	checkStr(t, testFirstAccepted(t, plistener, addr), "slow.example")
+
+	// A tunnel stops holding up the connections behind it once it is set up
+	echoAddr := testEchoServer(t)
+	plistener.SetInterceptCIDR(nil, testCIDRs(t, "127.0.0.0/8"))
+	tunnel := testDial(t, addr)
+	defer tunnel.Close()
+	fmt.Fprintf(tunnel, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echoAddr, echoAddr)
+	time.Sleep(50 * time.Millisecond)
+
+	c := testDial(t, addr)
+	defer c.Close()
+	fmt.Fprint(c, "GET http://after.example/ HTTP/1.1\r\nHost: after.example\r\n\r\n")
+	pconn := testAccept(t, plistener)
+	defer pconn.Close()
+	checkStr(t, pconn.RemoteAddr().String(), EncodeRemoteAddr("after.example", 80, false))
+}
+
+func TestUnorderedTranslation(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	checkStr(t, testFirstAccepted(t, plistener, addr), "fast.example")
+}
+
+func TestCloseWhileTranslating(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		plistener, addr := testProxyListener(t)
+		// Keep connections arriving so the translator is picking one up while Close runs
+		stop := make(chan struct{})
+		dialed := make(chan struct{})
+		go func() {
+			defer close(dialed)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				c, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer c.Close()
+			}
+		}()
+		time.Sleep(time.Millisecond)
+
+		closed := make(chan struct{})
+		go func() {
+			plistener.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Close did not return with connections being translated on iteration %d", i)
+		}
+		close(stop)
+		<-dialed
+	}
+}
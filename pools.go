@@ -0,0 +1,223 @@
+package puppy
+
+/*
+Named groups of connections that share connection and bandwidth quotas
+*/
+
+import (
+	"sync"
+	"time"
+)
+
+// ConnectionPoolFunc returns the name of the pool a connection belongs to. Connections in pools without limits are not restricted
+type ConnectionPoolFunc func(pconn ProxyConn) string
+
+// A group of connections sharing the same limits
+type connPool struct {
+	mtx      sync.Mutex
+	name     string
+	maxConns int
+	active   int
+	limiter  *rateLimiter
+	// Pools with limits are kept even when they have no connections so the limits aren't forgotten
+	limited bool
+	owner   *connPools
+}
+
+// The pools of a ProxyListener by name. Pools are made for connections as they are assigned to them and dropped once they have no connections unless they have limits, so pool names picked from something like the client address don't pile up. Has its own lock so pools can be dropped as connections are closed without needing the listener's
+type connPools struct {
+	mtx   sync.Mutex
+	pools map[string]*connPool
+}
+
+// Get a pool by name, creating it if it doesn't exist yet. Must be called while holding the lock
+func (ps *connPools) get(name string) *connPool {
+	if ps.pools == nil {
+		ps.pools = make(map[string]*connPool)
+	}
+	pool, ok := ps.pools[name]
+	if !ok {
+		pool = &connPool{name: name, owner: ps}
+		ps.pools[name] = pool
+	}
+	return pool
+}
+
+// Reserve a connection slot in a pool. Returns the pool and false if it is full
+func (ps *connPools) acquire(name string) (*connPool, bool) {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+
+	// Acquired while holding the lock so the pool can't be dropped in between
+	pool := ps.get(name)
+	if !pool.acquire() {
+		ps.drop(pool)
+		return pool, false
+	}
+	return pool, true
+}
+
+func (ps *connPools) setLimits(name string, maxConns int, bytesPerSec int) {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+
+	pool := ps.get(name)
+	pool.setLimits(maxConns, bytesPerSec)
+	ps.drop(pool)
+}
+
+// Forget a pool if it has no connections and no limits. Must be called while holding the lock
+func (ps *connPools) drop(pool *connPool) {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	if pool.active == 0 && !pool.limited && ps.pools[pool.name] == pool {
+		delete(ps.pools, pool.name)
+	}
+}
+
+// The number of pools being kept
+func (ps *connPools) len() int {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+
+	return len(ps.pools)
+}
+
+// Reserve a connection slot in the pool. Returns false if the pool is full
+func (p *connPool) acquire() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.maxConns > 0 && p.active >= p.maxConns {
+		return false
+	}
+	p.active++
+	return true
+}
+
+// Give up a connection slot reserved with acquire
+func (p *connPool) release() {
+	p.mtx.Lock()
+	if p.active > 0 {
+		p.active--
+	}
+	p.mtx.Unlock()
+
+	if p.owner != nil {
+		p.owner.mtx.Lock()
+		p.owner.drop(p)
+		p.owner.mtx.Unlock()
+	}
+}
+
+func (p *connPool) setLimits(maxConns int, bytesPerSec int) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.maxConns = maxConns
+	p.limited = maxConns > 0 || bytesPerSec > 0
+	if bytesPerSec > 0 {
+		p.limiter = newRateLimiter(bytesPerSec)
+	} else {
+		p.limiter = nil
+	}
+}
+
+func (p *connPool) getLimiter() *rateLimiter {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.limiter
+}
+
+// Limits the rate that bytes can pass through a set of connections. Allows bursts of up to one second of data
+type rateLimiter struct {
+	mtx    sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// Account for n bytes passing through the limiter, sleeping until the rate is back under the limit
+func (r *rateLimiter) take(n int) {
+	r.mtx.Lock()
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.last = now
+	r.tokens -= float64(n)
+	var wait time.Duration
+	if r.tokens < 0 {
+		wait = time.Duration(-r.tokens / r.rate * float64(time.Second))
+	}
+	r.mtx.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// SetConnectionPool sets the function used to assign each new connection to a named pool. Limits for each pool can be set with SetPoolLimits
+func (listener *ProxyListener) SetConnectionPool(f ConnectionPoolFunc) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.connPoolFunc = f
+}
+
+func (listener *ProxyListener) getConnectionPool() ConnectionPoolFunc {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.connPoolFunc
+}
+
+// SetPoolLimits sets the maximum number of open connections and the maximum combined bytes per second read and written by the connections in a pool. A limit of 0 or less means there is no limit. Connections over the connection limit are rejected. A pool with limits is kept until both limits are set to 0 or less
+func (listener *ProxyListener) SetPoolLimits(pool string, maxConns int, bytesPerSec int) {
+	listener.pools.setLimits(pool, maxConns, bytesPerSec)
+}
+
+func (pconn *proxyConn) Pool() string {
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+
+	if pconn.pool == nil {
+		return ""
+	}
+	return pconn.pool.name
+}
+
+func (pconn *proxyConn) getRateLimiter() *rateLimiter {
+	pconn.mtx.Lock()
+	pool := pconn.pool
+	pconn.mtx.Unlock()
+
+	if pool == nil {
+		return nil
+	}
+	return pool.getLimiter()
+}
+
+// Give up the connection's slot in its pool. Safe to call more than once
+func (pconn *proxyConn) releasePool() {
+	pconn.mtx.Lock()
+	pool := pconn.pool
+	released := pconn.poolReleased
+	pconn.poolReleased = true
+	pconn.mtx.Unlock()
+
+	if pool != nil && !released {
+		pool.release()
+	}
+}
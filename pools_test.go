@@ -0,0 +1,123 @@
+package puppy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestConnectionPools(t *testing.T) {
+	plistener, addrA := testProxyListener(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plistener.AddListener(l); err != nil {
+		t.Fatal(err)
+	}
+	addrB := l.Addr().String()
+
+	// Pool connections by the listener they came in on
+	plistener.SetConnectionPool(func(pconn ProxyConn) string {
+		if pconn.LocalAddr().String() == addrA {
+			return "a"
+		}
+		return "b"
+	})
+	plistener.SetPoolLimits("a", 1, 0)
+	plistener.SetPoolLimits("b", 2, 20000)
+
+	request := "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	open := func(addr string) net.Conn {
+		c := testDial(t, addr)
+		c.Write([]byte(request))
+		return c
+	}
+
+	a1 := open(addrA)
+	defer a1.Close()
+	pa1 := testAccept(t, plistener)
+	checkStr(t, pa1.Pool(), "a")
+
+	// Pool a is full
+	a2 := open(addrA)
+	defer a2.Close()
+	a2.SetDeadline(time.Now().Add(5 * time.Second))
+	rsp, err := http.ReadResponse(bufio.NewReader(a2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", rsp.StatusCode)
+	}
+
+	// Pool b has room for two
+	b1 := open(addrB)
+	defer b1.Close()
+	pb1 := testAccept(t, plistener)
+	b2 := open(addrB)
+	defer b2.Close()
+	pb2 := testAccept(t, plistener)
+	checkStr(t, pb1.Pool(), "b")
+	checkStr(t, pb2.Pool(), "b")
+
+	// Closing a connection frees up its slot
+	pa1.Close()
+	a3 := open(addrA)
+	defer a3.Close()
+	pa3 := testAccept(t, plistener)
+	defer pa3.Close()
+
+	// Pool b is rate limited but pool a is not
+	data := make([]byte, 30000)
+	go io.Copy(ioutil.Discard, a3)
+	start := time.Now()
+	if _, err := pa3.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 200*time.Millisecond {
+		t.Errorf("unlimited pool was rate limited")
+	}
+
+	go io.Copy(ioutil.Discard, b1)
+	start = time.Now()
+	if _, err := pb1.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 400*time.Millisecond {
+		t.Errorf("rate limited pool wrote %d bytes in %s", len(data), time.Since(start))
+	}
+}
+
+func TestConnectionPoolsDropped(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+	plistener.SetConnectionPool(func(pconn ProxyConn) string {
+		// A pool for every client like one keyed on the client address would have
+		return pconn.Info().ClientAddr.String()
+	})
+	plistener.SetPoolLimits("limited", 1, 0)
+
+	for i := 0; i < 3; i++ {
+		c := testDial(t, addr)
+		c.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		pconn := testAccept(t, plistener)
+		if n := plistener.pools.len(); n != 2 {
+			t.Errorf("expected 2 pools while a connection is open, got %d", n)
+		}
+		pconn.Close()
+		c.Close()
+	}
+	if n := plistener.pools.len(); n != 1 {
+		t.Errorf("expected only the pool with limits to be kept, got %d pools", n)
+	}
+
+	plistener.SetPoolLimits("limited", 0, 0)
+	if n := plistener.pools.len(); n != 0 {
+		t.Errorf("expected the pool to be dropped once its limits were removed, got %d pools", n)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -88,6 +89,9 @@ type InterceptingProxy struct {
 
 	messageStorage map[int]*savedStorage
 	globWatcher *globalWatcher
+
+	recompress      bool
+	recompressLevel int
 }
 
 // ProxyCredentials are a username/password combination used to represent an HTTP BasicAuth session
@@ -707,6 +711,16 @@ func (iproxy *InterceptingProxy) ServeHTTP(w http.ResponseWriter, r *http.Reques
 
 	mangleResponse := func(req *ProxyRequest, rsp *ProxyResponse) (*ProxyResponse, bool, error) {
 		reqCopy := req.Clone()
+		// Interceptors see and are compared against the decompressed response when recompressing
+		origRsp := rsp
+		recompress, recompressLevel := iproxy.getResponseRecompress()
+		if recompress {
+			if decoded := decompressResponse(rsp); decoded != nil {
+				rsp = decoded
+			} else {
+				recompress = false
+			}
+		}
 		newRsp := rsp.Clone()
 		rspSubs := iproxy.getResponseSubs()
 		iproxy.logger.Printf("%d interceptors", len(rspSubs))
@@ -726,6 +740,11 @@ func (iproxy *InterceptingProxy) ServeHTTP(w http.ResponseWriter, r *http.Reques
 		if newRsp != nil {
 			if !rsp.Eq(newRsp) {
 				iproxy.logger.Println("Response for", req.FullURL(), "modified by interceptor")
+				if recompress && newRsp.Header.Get("Content-Encoding") == "" {
+					if err := recompressResponse(newRsp, recompressLevel); err != nil {
+						return nil, false, fmt.Errorf("error compressing modified response: %s", err)
+					}
+				}
 				// it was mangled
 				return newRsp, true, nil
 			}
@@ -735,7 +754,7 @@ func (iproxy *InterceptingProxy) ServeHTTP(w http.ResponseWriter, r *http.Reques
 		}
 
 		// it wasn't changed
-		return rsp, false, nil
+		return origRsp, false, nil
 	}
 
 	mangleWS := func(req *ProxyRequest, rsp *ProxyResponse, ws *ProxyWSMessage) (*ProxyWSMessage, bool, error) {
@@ -969,8 +988,15 @@ func (iproxy *InterceptingProxy) ServeHTTP(w http.ResponseWriter, r *http.Reques
 				w.Header().Add(k, vv)
 			}
 		}
+		// The body is always sent in full so make sure the headers describe it even if an interceptor changed them
+		body := req.ServerResponse.BodyBytes()
+		status := req.ServerResponse.StatusCode
+		if req.Method != "HEAD" && status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified {
+			w.Header().Del("Transfer-Encoding")
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
 		w.WriteHeader(req.ServerResponse.StatusCode)
-		w.Write(req.ServerResponse.BodyBytes())
+		w.Write(body)
 		return
 	}
 }
@@ -2,16 +2,20 @@ package puppy
 
 import (
 	"bufio"
-	"bytes"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/deckarep/golang-set"
@@ -45,6 +49,9 @@ type ProxyConn interface {
 	Id() int
 	Logger() *log.Logger
 
+	// Replace the logger used for messages about this connection, for example with one that tags lines with a trace id. Other connections keep using the listener's logger. Passing nil discards the connection's log messages
+	SetLogger(*log.Logger)
+
 	// Set the CA certificate to be used to sign TLS connections
 	SetCACertificate(*tls.Certificate)
 
@@ -56,6 +63,111 @@ type ProxyConn interface {
 
 	// End transparent mode
 	EndTransparentMode()
+
+	// The protocol the client is speaking. Connections that are not ProtocolHTTP are passed on without any request being read from them
+	Protocol() Protocol
+
+	// Why the connection was closed. Returns an empty string if it is still open
+	CloseReason() string
+
+	// How the destination of the connection was determined
+	OriginKind() OriginKind
+
+	// The request that was read from the connection when the listener is in inspect-only mode. Reading from the connection returns the exact data sent by the client, including the inspected request. The body of the returned request cannot be read. Returns nil if no request was inspected.
+	InspectedRequest() *http.Request
+
+	// Decode websocket frames read from and written to the connection and pass them to the given function. Should be set once the connection has been upgraded. Only data that passes through the connection after the hook is set is decoded. Passing nil stops decoding
+	SetWebSocketHook(hook func(frame WSFrame))
+
+	// The address of the client that opened the connection. RemoteAddr returns the destination of the connection instead
+	ClientAddr() net.Addr
+
+	// The name of the pool the connection was assigned to. Returns an empty string if the listener does not assign pools
+	Pool() string
+
+	// The header of the request that was read from the connection when the listener is in raw header mode. Returns nil if no header was read
+	RawHeader() *RawRequestHeader
+
+	// Delay each Read and Write by base plus a random amount of up to jitter. Delays are cut short by the connection's deadlines
+	SetArtificialLatency(base, jitter time.Duration)
+
+	// The connection wrapped by the ProxyConn. Once TLS has been stripped this is the *tls.Conn used to decrypt the connection. Data that the ProxyConn has already buffered will not be returned by reading from the underlying connection directly
+	NetConn() net.Conn
+
+	// A snapshot of the connection's id, addresses, and how it was intercepted
+	Info() ConnInfo
+
+	// The number of bytes read from and written to the ProxyConn. Once TLS is stripped these are the decrypted bytes
+	BytesRead() int64
+	BytesWritten() int64
+
+	// The TLS records containing the ClientHello the client sent when TLS was stripped from the connection, exactly as they were sent. Returns false if TLS was not stripped, the handshake has not started yet, or the ClientHello was too big to capture
+	RawClientHello() ([]byte, bool)
+
+	// The hostname the certificate served to the client was made for when TLS was stripped. This is the host the client asked for, which may differ from the destination if it was rewritten. Returns an empty string if TLS was not stripped
+	CertHost() string
+
+	// Where the connection is going. The same as what is encoded in RemoteAddr
+	Destination() (host string, port int, useTLS bool)
+
+	// Close the connection once d has passed since it was accepted, even if it is busy. Replaces the maximum lifetime set on the listener. Zero means the connection can be open forever
+	SetMaxLifetime(d time.Duration)
+
+	// When the client connection was accepted. Connections split from a keep-alive connection share the time of the connection they came from
+	AcceptedAt() time.Time
+
+	// The events that happen to the connection in the order they happened, from being accepted to being closed. Includes the ProxyEvents about the connection that are sent to the listener's event handler. Holds up to 256 events that haven't been received and drops newer ones rather than slowing the connection down, but the event for the connection being closed is never dropped. Closed after the connection is closed. Every call returns the same channel so events are only received once
+	Transcript() <-chan ProxyEvent
+}
+
+// Reasons a ProxyConn can be closed
+const (
+	CloseReasonClosed           = "closed"
+	CloseReasonLifetimeExceeded = "lifetime exceeded"
+	CloseReasonFaultInjected    = "fault injected"
+)
+
+// Protocol is the application protocol spoken by the client over a ProxyConn
+type Protocol int
+
+const (
+	// HTTP/1.x, the default
+	ProtocolHTTP Protocol = iota
+	// HTTP/2 with prior knowledge over cleartext. The connection starts with the HTTP/2 connection preface
+	ProtocolH2C
+	// Something that isn't HTTP. Only produced by transparent listeners using UnknownProtocolEmit or by a ProtocolClassifier
+	ProtocolUnknown
+	// A TLS connection. Only used by a ProtocolClassifier to have TLS stripped from the connection. The Protocol of a ProxyConn is the protocol spoken inside of TLS
+	ProtocolTLS
+)
+
+// A fatal internal_error alert record. Sent to clients when TLS can't be stripped because a certificate could not be signed
+var tlsInternalErrorAlert = []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x50}
+
+// The port used for CONNECT requests that do not include one
+const defaultConnectPort = 443
+
+// The most bytes read from a connection when checking for an HTTP method
+const maxMethodSniffLength = 32
+
+// Returned when adding a listener to a ProxyListener that has been closed
+const ErrListenerClosed = ConstErr("ProxyListener is closed")
+
+// How long to keep retrying when peeking to see if a client is starting TLS fails with a transient error if SetPeekTimeout hasn't been used
+const tlsPeekTimeout = 10 * time.Second
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolHTTP:
+		return "http"
+	case ProtocolH2C:
+		return "h2c"
+	case ProtocolUnknown:
+		return "unknown"
+	case ProtocolTLS:
+		return "tls"
+	}
+	return "unknown"
 }
 
 type proxyAddr struct {
@@ -65,15 +177,55 @@ type proxyAddr struct {
 }
 
 type proxyConn struct {
-	Addr    *proxyAddr
-	logger  *log.Logger
-	id      int
-	conn    net.Conn      // Wrapped connection
-	readReq *http.Request // A replaced request
-	caCert  *tls.Certificate
-	mtx     sync.Mutex
+	// Accessed atomically so they must stay at the start of the struct to be aligned
+	bytesRead    int64
+	bytesWritten int64
+
+	Addr   *proxyAddr
+	logger *log.Logger
+	id     int
+	conn   net.Conn       // Wrapped connection
+	replay *io.PipeReader // A request that was read from the connection and is being serialized again
+	caCert *tls.Certificate
+	mtx    sync.Mutex
 
 	transparentMode bool
+	protocol        Protocol
+	closeReason     string
+	lifetimeTimer   *time.Timer
+	acceptedAt      time.Time
+	origin          OriginKind
+	extraSANs       ExtraSANsFunc
+	inspectedReq    *http.Request
+	wsFromClient    *wsFrameParser
+	wsToClient      *wsFrameParser
+	maxRequestLine  int
+	clientAddr      net.Addr
+	pool            *connPool
+	poolReleased    bool
+	rawHeaderMode   bool
+	rawHeader       *RawRequestHeader
+	latencyBase     time.Duration
+	latencyJitter   time.Duration
+	readDeadline    time.Time
+	writeDeadline   time.Time
+	servedCert      *x509.Certificate
+	tlsUpgrade      *startTLSWatcher
+	signer          CertSigner
+	sniPolicy       SNIMismatchPolicy
+	onSNIMismatch   func(sni string)
+	onClose         []func()
+	helloRecorder   *helloRecorder
+	certCache       *certCache
+	memory          *connMemory
+	helloInfo       *tls.ClientHelloInfo
+	destRewriter    DestinationRewriter
+	certHost        string
+	handOff         *handOff
+	peekTimeout     time.Duration
+	readTimeout     time.Duration
+	transcript      *transcript
+	listenerId      int
 }
 
 // Encode the destination information to be stored in the remote address
@@ -141,40 +293,122 @@ func (c bufferedConn) Read(p []byte) (int, error) {
 //// Implement net.Conn
 
 func (c *proxyConn) Read(b []byte) (n int, err error) {
-	if c.readReq != nil {
-		buf := new(bytes.Buffer)
-		c.readReq.Write(buf)
-		s := buf.String()
-		n = 0
-		for n = 0; n < len(b) && n < len(s); n++ {
-			b[n] = s[n]
+	if replay := c.getReplay(); replay != nil {
+		n, err = replay.Read(b)
+		c.transcript.recordBytes(EventBytesRead, c.id, atomic.AddInt64(&c.bytesRead, int64(n)), n)
+		if err != io.EOF {
+			return n, err
+		}
+		// The whole request has been replayed so go back to reading from the connection
+		c.mtx.Lock()
+		c.replay = nil
+		c.mtx.Unlock()
+		if n > 0 {
+			return n, nil
 		}
-		c.readReq = nil
-		return n, nil
 	}
 	if c.conn == nil {
 		return 0, fmt.Errorf("ProxyConn %d does not have an active connection", c.Id())
 	}
-	return c.conn.Read(b)
+	if err := c.injectLatency(true); err != nil {
+		return 0, err
+	}
+	watcher := c.getTLSUpgrade()
+	if watcher != nil {
+		if err := c.maybeUpgradeTLS(watcher); err != nil {
+			return 0, err
+		}
+	}
+	n, err = c.conn.Read(b)
+	if n > 0 {
+		c.transcript.recordBytes(EventBytesRead, c.id, atomic.AddInt64(&c.bytesRead, int64(n)), n)
+		c.inspectWS(b[:n], true)
+		if watcher != nil {
+			watcher.clientData(b[:n])
+		}
+		if limiter := c.getRateLimiter(); limiter != nil {
+			limiter.take(n)
+		}
+	}
+	return n, err
 }
 
 func (c *proxyConn) Write(b []byte) (n int, err error) {
-	return c.conn.Write(b)
+	if err := c.injectLatency(false); err != nil {
+		return 0, err
+	}
+	if limiter := c.getRateLimiter(); limiter != nil {
+		limiter.take(len(b))
+	}
+	// Look for the server accepting STARTTLS before the client can see it so that its handshake is never read as plaintext
+	watcher := c.getTLSUpgrade()
+	accepted := watcher != nil && watcher.serverData(b)
+	n, err = c.conn.Write(b)
+	if n > 0 {
+		c.transcript.recordBytes(EventBytesWritten, c.id, atomic.AddInt64(&c.bytesWritten, int64(n)), n)
+		c.inspectWS(b[:n], false)
+	}
+	if accepted {
+		watcher.onAccepted()
+	}
+	return n, err
 }
 
 func (c *proxyConn) Close() error {
-	return c.conn.Close()
+	return c.closeWithReason(CloseReasonClosed)
+}
+
+// Close the connection and record why it was closed. Only the first reason is kept
+func (c *proxyConn) closeWithReason(reason string) error {
+	c.mtx.Lock()
+	var onClose []func()
+	first := c.closeReason == ""
+	if first {
+		c.closeReason = reason
+		onClose = c.onClose
+		c.onClose = nil
+	}
+	if c.lifetimeTimer != nil {
+		c.lifetimeTimer.Stop()
+	}
+	conn := c.conn
+	replay := c.replay
+	c.mtx.Unlock()
+
+	if replay != nil {
+		// Stop the goroutine serializing the request
+		replay.Close()
+	}
+	c.releasePool()
+	for _, f := range onClose {
+		f()
+	}
+	err := conn.Close()
+	if first {
+		c.transcript.finish(c.id, reason)
+	}
+	return err
 }
 
 func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.mtx.Lock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.mtx.Unlock()
 	return c.conn.SetDeadline(t)
 }
 
 func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mtx.Lock()
+	c.readDeadline = t
+	c.mtx.Unlock()
 	return c.conn.SetReadDeadline(t)
 }
 
 func (c *proxyConn) SetWriteDeadline(t time.Time) error {
+	c.mtx.Lock()
+	c.writeDeadline = t
+	c.mtx.Unlock()
 	return c.conn.SetWriteDeadline(t)
 }
 
@@ -203,6 +437,16 @@ func (pconn *proxyConn) Logger() *log.Logger {
 	return pconn.logger
 }
 
+func (pconn *proxyConn) SetLogger(logger *log.Logger) {
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+	pconn.logger = logger
+}
+
 func (pconn *proxyConn) SetCACertificate(cert *tls.Certificate) {
 	pconn.mtx.Lock()
 	defer pconn.mtx.Unlock()
@@ -214,42 +458,143 @@ func (pconn *proxyConn) StartMaybeTLS(hostname string) (bool, error) {
 	// Prepares to start doing TLS if the client starts. Returns whether TLS was started
 
 	// Wrap the ProxyConn's net.Conn in a bufferedConn
+	bufConn := pconn.buffered()
 	pconn.mtx.Lock()
-	defer pconn.mtx.Unlock()
+	timeout := pconn.peekTimeout
+	prevDeadline := pconn.readDeadline
+	pconn.mtx.Unlock()
 
-	bufConn := bufferedConn{bufio.NewReader(pconn.conn), pconn.conn}
-	usingTLS := false
-
-	// Guess if we're doing TLS
-	byte, err := bufConn.Peek(1)
+	// Guess if we're doing TLS. The lock isn't held while waiting for the client so the connection can still be closed
+	first, err := peekFirstByte(bufConn, timeout, prevDeadline)
 	if err != nil {
 		return false, err
 	}
-	if byte[0] == '\x16' {
-		usingTLS = true
+	if first != '\x16' {
+		return false, nil
 	}
 
-	if usingTLS {
-		if err != nil {
-			return false, err
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+	if err := pconn.startTLS(bufConn, hostname); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Peek at the first byte of a connection, retrying on transient errors for up to tlsPeekTimeout. If timeout is set, the client only gets that long to send the byte and errors are retried for that long instead. prevDeadline is the read deadline to put back afterwards. Returns io.EOF if the client closed the connection
+func peekFirstByte(bufConn bufferedConn, timeout time.Duration, prevDeadline time.Time) (byte, error) {
+	retry := tlsPeekTimeout
+	if timeout > 0 {
+		retry = timeout
+		defer limitReadDeadline(bufConn, prevDeadline, timeout)()
+	}
+	start := time.Now()
+	wait := 10 * time.Millisecond
+	for {
+		b, err := bufConn.Peek(1)
+		if err == nil {
+			return b[0], nil
+		}
+		if err == io.EOF {
+			return 0, err
 		}
+		if !isTransientErr(err) || time.Since(start)+wait > retry {
+			return 0, err
+		}
+		time.Sleep(wait)
+		if wait < time.Second {
+			wait *= 2
+		}
+	}
+}
 
-		cert, err := signHost(*pconn.caCert, []string{hostname})
-		if err != nil {
-			return false, err
+// Whether an error from reading a connection may go away if the read is retried. Deadlines that were set on purpose are not retried
+func isTransientErr(err error) bool {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	terr, ok := err.(interface{ Temporary() bool })
+	return ok && terr.Temporary()
+}
+
+// Strip TLS from the connection without checking whether the client is trying to start TLS
+func (pconn *proxyConn) forceTLS(hostname string) error {
+	bufConn := pconn.buffered()
+
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+	return pconn.startTLS(bufConn, hostname)
+}
+
+// Wrap the connection in a TLS server using a certificate for the given hostname. Must be called while holding the lock
+func (pconn *proxyConn) startTLS(bufConn bufferedConn, hostname string) error {
+	cert, err := pconn.signCert(hostname)
+	if err != nil {
+		// Let the client know the handshake failed on our end instead of just hanging up on it
+		bufConn.Write(tlsInternalErrorAlert)
+		return err
+	}
+
+	config := &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{cert},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			pconn.recordHelloInfo(hello)
+			return pconn.checkSNI(hello, hostname)
+		},
+	}
+	pconn.helloRecorder = &helloRecorder{Conn: bufConn, mem: pconn.memory}
+	tlsConn := tls.Server(pconn.helloRecorder, config)
+	pconn.conn = tlsConn
+	pconn.transcript.record(ProxyEvent{Kind: EventTLSStripped, ConnId: pconn.id, Host: hostname})
+	return nil
+}
+
+// Sign a certificate for a hostname and any extra SANs and record it as the certificate served to the client. Errors are a *SignHostError. Must be called while holding the lock
+func (pconn *proxyConn) signCert(hostname string) (tls.Certificate, error) {
+	if pconn.signer == nil && pconn.caCert == nil {
+		return tls.Certificate{}, &SignHostError{Host: hostname, Err: fmt.Errorf("ProxyConn %d does not have a CA certificate to sign TLS connections with", pconn.id)}
+	}
+	cert, leaf, err := signHostCert(pconn.signer, pconn.caCert, pconn.certCache, pconn.extraSANs, hostname)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	pconn.servedCert = leaf
+	pconn.certHost = hostname
+	return cert, nil
+}
+
+// Sign a certificate for a hostname and any extra SANs. Uses the signer if there is one and the CA certificate through the cache otherwise. Errors are a *SignHostError
+func signHostCert(signer CertSigner, ca *tls.Certificate, cache *certCache, extraSANs ExtraSANsFunc, hostname string) (tls.Certificate, *x509.Certificate, error) {
+	if signer == nil {
+		if ca == nil {
+			return tls.Certificate{}, nil, &SignHostError{Host: hostname, Err: fmt.Errorf("no CA certificate to sign TLS connections with")}
+		}
+		if cache != nil {
+			signer = cachingCertSigner{cache: cache, ca: ca}
+		} else {
+			signer = NewCACertSigner(ca)
 		}
+	}
 
-		config := &tls.Config{
-			InsecureSkipVerify: true,
-			Certificates:       []tls.Certificate{cert},
+	hosts := []string{hostname}
+	if extraSANs != nil {
+		dnsNames, ipAddrs := extraSANs(hostname)
+		hosts = append(hosts, dnsNames...)
+		for _, ip := range ipAddrs {
+			hosts = append(hosts, ip.String())
 		}
-		tlsConn := tls.Server(bufConn, config)
-		pconn.conn = tlsConn
-		return true, nil
-	} else {
-		pconn.conn = bufConn
-		return false, nil
 	}
+
+	cert, err := signer.SignHost(hosts)
+	if err != nil {
+		return tls.Certificate{}, nil, &SignHostError{Host: hostname, Err: err}
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, nil, &SignHostError{Host: hostname, Err: err}
+	}
+	return cert, leaf, nil
 }
 
 func (pconn *proxyConn) SetTransparentMode(destHost string, destPort int, useTLS bool) {
@@ -270,20 +615,201 @@ func (pconn *proxyConn) EndTransparentMode() {
 	pconn.transparentMode = false
 }
 
+func (pconn *proxyConn) Protocol() Protocol {
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+
+	return pconn.protocol
+}
+
+func (pconn *proxyConn) BytesRead() int64 {
+	return atomic.LoadInt64(&pconn.bytesRead)
+}
+
+func (pconn *proxyConn) BytesWritten() int64 {
+	return atomic.LoadInt64(&pconn.bytesWritten)
+}
+
+// Whether TLS has been stripped from the connection
+func (pconn *proxyConn) tlsStripped() bool {
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+
+	return pconn.servedCert != nil
+}
+
+func (pconn *proxyConn) NetConn() net.Conn {
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+
+	if bufConn, ok := pconn.conn.(bufferedConn); ok {
+		return bufConn.Conn
+	}
+	return pconn.conn
+}
+
+func (pconn *proxyConn) ClientAddr() net.Addr {
+	return pconn.clientAddr
+}
+
+func (pconn *proxyConn) Destination() (string, int, bool) {
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+
+	return pconn.Addr.Host, pconn.Addr.Port, pconn.Addr.UseTLS
+}
+
+func (pconn *proxyConn) CloseReason() string {
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+
+	return pconn.closeReason
+}
+
+func (pconn *proxyConn) AcceptedAt() time.Time {
+	// Never changes after the connection is created
+	return pconn.acceptedAt
+}
+
 func newProxyConn(c net.Conn, l *log.Logger) *proxyConn {
     // converts a connection into a proxyConn
 	a := proxyAddr{Host: "", Port: -1, UseTLS: false}
-	p := proxyConn{Addr: &a, logger: l, conn: c, readReq: nil}
+	p := proxyConn{Addr: &a, logger: l, conn: c}
 	p.id = getNextConnId()
 	p.transparentMode = false
+	p.clientAddr = c.RemoteAddr()
+	p.acceptedAt = time.Now()
+	p.transcript = newTranscript()
+	p.transcript.record(ProxyEvent{Kind: EventConnAccepted, ConnId: p.id, Detail: p.clientAddr.String()})
 	return &p
 }
 
+// Wrap the connection in a bufferedConn if it isn't in one already so that data can be peeked without losing it
+func (pconn *proxyConn) buffered() bufferedConn {
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+
+	bufConn, ok := pconn.conn.(bufferedConn)
+	if !ok {
+		bufConn = pconn.newBufferedConn(pconn.conn)
+		pconn.conn = bufConn
+	}
+	return bufConn
+}
+
+// Wrap a connection in a bufferedConn with a buffer big enough to check the request line length. Must be called while holding the lock
+func (pconn *proxyConn) newBufferedConn(c net.Conn) bufferedConn {
+	size := 4096
+	if pconn.maxRequestLine+2 > size {
+		size = pconn.maxRequestLine + 2
+	}
+	return bufferedConn{bufio.NewReaderSize(c, size), c}
+}
+
+func (pconn *proxyConn) readRequest() (*http.Request, error) {
+	return http.ReadRequest(pconn.buffered().reader)
+}
+
+// Check whether the connection starts with something that looks like an HTTP method followed by a space without consuming any data. Reads at most maxMethodSniffLength bytes
+func (pconn *proxyConn) peekHTTPMethod() (bool, error) {
+	bufConn := pconn.buffered()
+	for n := 1; n <= maxMethodSniffLength; n++ {
+		b, err := bufConn.Peek(n)
+		if err != nil {
+			return false, err
+		}
+		c := b[n-1]
+		if c == ' ' {
+			return n > 1, nil
+		}
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) >= 0 {
+			// Not a token character
+			return false, nil
+		}
+	}
+	return false, nil
+}
+
+// Read the next request from the connection. If inspect is true, the data read from the connection is recorded so that the original bytes can be put back
+func (pconn *proxyConn) nextRequest(inspect bool) (*http.Request, *peekedRequest, error) {
+	pconn.mtx.Lock()
+	timeout := pconn.readTimeout
+	prevDeadline := pconn.readDeadline
+	pconn.mtx.Unlock()
+	defer limitReadDeadline(pconn.buffered(), prevDeadline, timeout)()
+
+	if err := pconn.checkRequestLine(); err != nil {
+		return nil, nil, err
+	}
+
+	if !inspect {
+		req, err := pconn.readRequest()
+		if err == nil {
+			pconn.recordRequest(req)
+		}
+		return req, nil, err
+	}
+
+	bufConn := pconn.buffered()
+	rec := &recordingReader{r: bufConn.reader, recording: true, mem: pconn.memory}
+	peeked := &peekedRequest{
+		pconn:    pconn,
+		original: bufConn,
+		rec:      rec,
+	}
+	reader := bufio.NewReader(rec)
+	pconn.mtx.Lock()
+	pconn.conn = bufferedConn{reader, bufConn.Conn}
+	pconn.mtx.Unlock()
+
+	var req *http.Request
+	if pconn.rawHeaderMode {
+		header, err := readRawHeader(reader)
+		if err != nil {
+			peeked.restore()
+			return nil, nil, err
+		}
+		req = header.request()
+		pconn.mtx.Lock()
+		pconn.rawHeader = header
+		pconn.mtx.Unlock()
+	} else {
+		var err error
+		req, err = http.ReadRequest(reader)
+		if err != nil {
+			peeked.restore()
+			return nil, nil, err
+		}
+	}
+	// The parser has only consumed the header so anything still buffered is the start of the body
+	peeked.headerLen = rec.recorded.Len() - reader.Buffered()
+	pconn.recordRequest(req)
+	return req, peeked, nil
+}
+
 func (pconn *proxyConn) returnRequest(req *http.Request) {
+	// Serialize the request as it is read so that its body is streamed from the connection instead of being read all at once
+	pr, pw := io.Pipe()
+	go func() {
+		// Writing through a buffer this small passes body data on as soon as it arrives
+		bw := bufio.NewWriterSize(pw, 1)
+		err := req.Write(bw)
+		if err == nil {
+			err = bw.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+	pconn.replay = pr
+}
+
+func (pconn *proxyConn) getReplay() *io.PipeReader {
 	pconn.mtx.Lock()
 	defer pconn.mtx.Unlock()
 
-	pconn.readReq = req
+	return pconn.replay
 }
 
 /*
@@ -308,26 +834,112 @@ type ProxyListener struct {
 	outputConnDone chan struct{}
 	inputConnDone  chan struct{}
 	listenWg       sync.WaitGroup
+	running        int32
+	pending        int32
+	translating    translations
+	done           chan struct{}
+	doneOnce       sync.Once
 	caCert         *tls.Certificate
+	responder      Responder
+	rawHook        RawRequestHook
+	interceptCIDRs []*net.IPNet
+	bypassCIDRs    []*net.IPNet
+	tlsByPort      func(port int) bool
+
+	unknownProtocolMode UnknownProtocolMode
+	unknownProtocolWait time.Duration
+
+	maxConnLifetime time.Duration
+	extraSANs       ExtraSANsFunc
+	inspectOnly     bool
+	logOnly         bool
+	fallback        bool
+	failedHosts     map[string]time.Time
+	silentErrors    bool
+	ordered         int32
+	errorBody       ErrorBodyFunc
+	maxRequestLine  int
+	connPoolFunc    ConnectionPoolFunc
+	pools           connPools
+	badGateway      BadGatewayResponder
+	rawHeaderMode   bool
+	latencyBase     time.Duration
+	latencyJitter   time.Duration
+	eventHandler    func(ProxyEvent)
+	faults          *faultInjector
+	classifier      ProtocolClassifier
+	readAhead       int
+	splitKeepAlive  bool
+	requireTLS      bool
+	missingHostMode MissingHostMode
+	missingHostDest *proxyAddr
+	repeaters       map[string]*repeater
+	startTLSPorts   map[int]StartTLSProto
+	certSigner      CertSigner
+	sniPolicy       SNIMismatchPolicy
+	activeConns     map[int]*proxyConn
+	tcpNoDelay      *bool
+	maxListeners    int
+	destRewriter    DestinationRewriter
+	certCache       *certCache
+	lifecycle       func(ListenerEvent)
+	logFilter       LogFilter
+	connectResponse ConnectResponseWriter
+	connMemoryLimit int
+	upstreamPool    *upstreamPool
+	resolver        ResolverFunc
+	resolved        map[string]resolvedHost
+	upstreamSNI     UpstreamSNIFunc
+	intercepted     *hostLRU
+	peekTimeout     time.Duration
+	readTimeout     time.Duration
 }
 
 type inputConn struct {
-	listener *ProxyListener
-	conn     net.Conn
+	listener   *ProxyListener
+	listenerId int
+	conn       net.Conn
+	options    ListenerOptions
 
 	transparentMode bool
 	transparentAddr *proxyAddr
+
+	// Whether to detect if the connection is transparent or from a client using the listener as a proxy. Transparent connections go to transparentAddr
+	hybrid bool
+
+	// Released once the connection stops holding up ordered translation
+	handOff *handOff
 }
 
 type listenerData struct {
 	Id       int
 	Listener net.Listener
+	Options  ListenerOptions
+
+	// Set atomically by whatever takes the listener out of the ProxyListener so it is only reported once
+	ended int32
+	// Closed once the listener's added event has been sent
+	announced chan struct{}
+
+	// Where transparent connections from the listener go. Nil if the listener doesn't have a destination
+	destMtx sync.Mutex
+	dest    *proxyAddr
+}
+
+// ListenerOptions are settings for a single listener in a ProxyListener that override the settings of the ProxyListener
+type ListenerOptions struct {
+	// The CA certificate used to sign TLS connections accepted by the listener. If nil, the ProxyListener's CA certificate is used
+	CA *tls.Certificate
+
+	// A name for the listener that is included in ListenerEvents
+	Name string
 }
 
 func newListenerData(listener net.Listener) *listenerData {
 	l := listenerData{}
 	l.Id = getNextListenerId()
 	l.Listener = listener
+	l.announced = make(chan struct{})
 	return &l
 }
 
@@ -341,29 +953,39 @@ func NewProxyListener(logger *log.Logger) *ProxyListener {
 	}
 	l := ProxyListener{logger: useLogger, State: ProxyStarting}
 	l.inputListeners = mapset.NewSet()
+	l.certCache = newCertCache()
+	l.intercepted = newHostLRU(maxInterceptedHosts)
 
 	l.outputConns = make(chan ProxyConn)
 	l.inputConns = make(chan *inputConn)
 	l.outputConnDone = make(chan struct{})
 	l.inputConnDone = make(chan struct{})
+	l.done = make(chan struct{})
 
 	// Translate connections
-	l.listenWg.Add(1)
+	l.startGoroutine()
 	go func() {
 		l.logger.Println("Starting connection translator...")
-		defer l.listenWg.Done()
+		defer l.goroutineDone()
 		for {
 			select {
 			case <-l.outputConnDone:
 				l.logger.Println("Output channel closed. Shutting down translator.")
 				return
 			case inconn := <-l.inputConns:
+				inconn.handOff = l.newHandOff()
+				l.translating.add(inconn.conn)
 				go func() {
+					defer l.translating.done(inconn.conn)
+					defer inconn.handOff.release()
 					err := l.translateConn(inconn)
 					if err != nil {
 						l.logger.Println("Could not translate connection:", err)
+						l.reportTranslateError(inconn, err)
+						inconn.conn.Close()
 					}
 				}()
+				inconn.handOff.wait(l.outputConnDone)
 			}
 		}
 	}()
@@ -388,32 +1010,83 @@ func (listener *ProxyListener) Accept() (net.Conn, error) {
 		listener.logger.Println("Cannot accept connection, ProxyListener is closed")
 		return nil, fmt.Errorf("Connection is closed")
 	case c := <-listener.outputConns:
-		listener.logger.Println("Connection", c.Id(), "accepted from ProxyListener")
+		listener.logConnf(c, "Connection %d accepted from ProxyListener", c.Id())
 		return c, nil
 	}
 }
 
-// Close closes all of the listeners associated with the ProxyListener
+// Close closes all of the listeners associated with the ProxyListener. Closing a ProxyListener that is already closed does nothing. Connections that are still being translated or tunneled are left to finish on their own and Done is closed once they have
 func (listener *ProxyListener) Close() error {
+	removed, ok := listener.beginClose()
+	if !ok {
+		return nil
+	}
+	listener.listenWg.Wait()
+	listener.finishClose(removed)
+	return nil
+}
+
+// Stop accepting connections and close every listener. Returns the listeners that were removed and false if the ProxyListener was already closed
+func (listener *ProxyListener) beginClose() ([]*listenerData, bool) {
 	listener.mtx.Lock()
 	defer listener.mtx.Unlock()
 
+	if listener.State == ProxyStopped {
+		return nil, false
+	}
+
 	listener.logger.Println("Closing ProxyListener...")
 	listener.State = ProxyStopped
+	// Senders on the connection channels stop when the done channels are closed so the connection channels are left open
 	close(listener.outputConnDone)
 	close(listener.inputConnDone)
-	close(listener.outputConns)
-	close(listener.inputConns)
 
+	var removed []*listenerData
 	it := listener.inputListeners.Iterator()
 	for elem := range it.C {
 		l := elem.(*listenerData)
+		if l.claimEnd() {
+			removed = append(removed, l)
+		}
 		l.Listener.Close()
 		listener.logger.Println("Closed listener", l.Id)
 	}
+	for _, l := range removed {
+		listener.inputListeners.Remove(l)
+	}
+	listener.closeRepeaters()
+	if listener.upstreamPool != nil {
+		listener.upstreamPool.close()
+		listener.upstreamPool = nil
+	}
 	listener.logger.Println("ProxyListener closed")
-	listener.listenWg.Wait()
-	return nil
+	return removed, true
+}
+
+// Finish closing once the listeners and translator have stopped
+func (listener *ProxyListener) finishClose(removed []*listenerData) {
+	for _, l := range removed {
+		listener.reportListenerEnded(l, ListenerRemoved)
+	}
+	closeDone := func() {
+		listener.doneOnce.Do(func() {
+			close(listener.done)
+		})
+	}
+	if listener.translating.idle() {
+		closeDone()
+		return
+	}
+	// Close doesn't wait for connections that are being translated or tunneled but Done does
+	go func() {
+		listener.translating.wait()
+		closeDone()
+	}()
+}
+
+// Done returns a channel which is closed once the ProxyListener has been closed and all of its listeners and goroutines have shut down, including the ones translating or tunneling connections. Connections that have been returned by Accept are not waited for
+func (listener *ProxyListener) Done() <-chan struct{} {
+	return listener.done
 }
 
 func (listener *ProxyListener) Addr() net.Addr {
@@ -422,148 +1095,525 @@ func (listener *ProxyListener) Addr() net.Addr {
 
 // AddListener adds a listener for the ProxyListener to listen on
 func (listener *ProxyListener) AddListener(inlisten net.Listener) error {
+	return listener.AddListenerWithOptions(inlisten, ListenerOptions{})
+}
+
+// AddListenerWithOptions adds a listener for the ProxyListener to listen on using settings specific to that listener
+func (listener *ProxyListener) AddListenerWithOptions(inlisten net.Listener, options ListenerOptions) error {
 	listener.mtx.Lock()
-	defer listener.mtx.Unlock()
-	return listener.addListener(inlisten, false, nil)
+	il, err := listener.addListener(inlisten, false, nil, options)
+	listener.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	listener.reportListenerAdded(il)
+	return nil
 }
 
-// AddTransparentListener is the same as AddListener, but all of the connections will be in transparent mode
+// AddTransparentListener is the same as AddListener, but all of the connections will be in transparent mode. Connections which start with the HTTP/2 connection preface are accepted with a Protocol of ProtocolH2C without reading a request. TLS is stripped from connections that look like they are starting a TLS handshake unless SetTLSByPort decides otherwise, and stripped connections go to the destination over TLS even if useTLS is false. useTLS only decides for connections that TLS isn't stripped from
 func (listener *ProxyListener) AddTransparentListener(inlisten net.Listener, destHost string, destPort int, useTLS bool) error {
-	listener.mtx.Lock()
-	defer listener.mtx.Unlock()
 	addr := &proxyAddr{
 		Host:   destHost,
 		Port:   destPort,
 		UseTLS: useTLS,
 	}
-	return listener.addListener(inlisten, true, addr)
+	listener.mtx.Lock()
+	il, err := listener.addListener(inlisten, true, addr, ListenerOptions{})
+	listener.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	listener.reportListenerAdded(il)
+	return nil
 }
 
-func (listener *ProxyListener) addListener(inlisten net.Listener, transparentMode bool, destAddr *proxyAddr) error {
+// Start accepting connections from a listener. Listeners that are not in transparent mode but have a destination are hybrid listeners. The caller must hold the lock and report the listener as added once it has released it
+func (listener *ProxyListener) addListener(inlisten net.Listener, transparentMode bool, destAddr *proxyAddr, options ListenerOptions) (*listenerData, error) {
+	if listener.State == ProxyStopped {
+		return nil, ErrListenerClosed
+	}
+	if listener.maxListeners > 0 && listener.inputListeners.Cardinality() >= listener.maxListeners {
+		return nil, ErrTooManyListeners
+	}
 	listener.logger.Println("Adding listener to ProxyListener:", inlisten)
 	il := newListenerData(inlisten)
+	il.Options = options
+	il.dest = destAddr
 	l := listener
-	listener.listenWg.Add(1)
+	listener.startGoroutine()
 	go func() {
-		defer l.listenWg.Done()
 		for {
 			c, err := il.Listener.Accept()
 			if err != nil {
 				// TODO: verify that the connection is actually closed and not some other error
 				l.logger.Println("Listener", il.Id, "closed")
+				// The set has its own lock so this is safe while Close has the listener locked
+				closed := il.claimEnd()
+				if closed {
+					l.inputListeners.Remove(il)
+				}
+				// Reporting needs the lock so stop counting as running first
+				l.goroutineDone()
+				if closed {
+					l.reportListenerEnded(il, ListenerClosed)
+				}
 				return
 			}
-			l.logger.Println("Received conn form listener", il.Id)
 			newConn := &inputConn{
 				conn:            c,
 				listener:        nil,
+				listenerId:      il.Id,
+				options:         il.Options,
 				transparentMode: transparentMode,
-				transparentAddr: destAddr,
+				transparentAddr: il.transparentDest(),
+				hybrid:          !transparentMode && destAddr != nil,
+			}
+			select {
+			case l.inputConns <- newConn:
+			case <-l.inputConnDone:
+				// The translator will never pick up the connection
+				c.Close()
+				l.goroutineDone()
+				return
 			}
-			l.inputConns <- newConn
 		}
 	}()
 	listener.inputListeners.Add(il)
 	l.logger.Println("Listener", il.Id, "added to ProxyListener")
-	return nil
+	return il, nil
 }
 
 // RemoveListener closes a listener and removes it from the ProxyListener. Does not kill active connections.
 func (listener *ProxyListener) RemoveListener(inlisten net.Listener) error {
 	listener.mtx.Lock()
-	defer listener.mtx.Unlock()
 
-	listener.inputListeners.Remove(inlisten)
+	// The set is locked while it is being iterated over so remove the listener afterwards
+	var found []*listenerData
+	it := listener.inputListeners.Iterator()
+	for elem := range it.C {
+		if il := elem.(*listenerData); il.Listener == inlisten && il.claimEnd() {
+			found = append(found, il)
+		}
+	}
+	for _, il := range found {
+		listener.inputListeners.Remove(il)
+	}
 	inlisten.Close()
 	listener.logger.Println("Listener removed:", inlisten)
+	listener.mtx.Unlock()
+
+	for _, il := range found {
+		listener.reportListenerEnded(il, ListenerRemoved)
+	}
 	return nil
 }
 
 // TKTK working here
 // Take in a connection, strip TLS, get destination info, and push a ProxyConn to the listener.outputConnection channel
-func (listener *ProxyListener) translateConn(inconn *inputConn) error {
+func (listener *ProxyListener) translateConn(inconn *inputConn) (err error) {
+	listener.applyTCPNoDelay(inconn.conn)
 	pconn := newProxyConn(inconn.conn, listener.logger)
-	pconn.SetCACertificate(listener.GetCACertificate())
+	defer func() {
+		if terr, ok := err.(*translateError); ok {
+			if pconn.tlsStripped() {
+				// The client is in the middle of a TLS connection so an HTTP response would be garbage to it
+				err = terr.err
+			} else {
+				terr.connId = pconn.Id()
+			}
+		}
+		if err != nil {
+			pconn.releasePool()
+		}
+		var signErr *SignHostError
+		if errors.As(err, &signErr) {
+			listener.emitEventFor(pconn, ProxyEvent{Kind: EventSignHostFailed, Detail: signErr.Err.Error(), Host: signErr.Host})
+		}
+	}()
+	if inconn.options.CA != nil {
+		pconn.SetCACertificate(inconn.options.CA)
+	} else {
+		pconn.SetCACertificate(listener.GetCACertificate())
+	}
+	pconn.extraSANs = listener.getExtraSANs()
+	pconn.signer = listener.getCertSigner()
+	pconn.certCache = listener.certCache
+	pconn.destRewriter = listener.getDestinationRewriter()
+	pconn.maxRequestLine = listener.getMaxRequestLineLength()
+	pconn.peekTimeout = listener.getPeekTimeout()
+	pconn.readTimeout = listener.getRequestReadTimeout()
+	pconn.latencyBase, pconn.latencyJitter = listener.getArtificialLatency()
+	pconn.memory = listener.newConnMemory()
+	pconn.handOff = inconn.handOff
+	pconn.listenerId = inconn.listenerId
+	if inconn.hybrid {
+		transparent, err := listener.detectTransparent(pconn)
+		if err != nil {
+			listener.logger.Println("Could not detect whether connection is transparent:", err)
+			return err
+		}
+		inconn.transparentMode = transparent
+	}
 	if inconn.transparentMode {
 		pconn.SetTransparentMode(inconn.transparentAddr.Host,
 			inconn.transparentAddr.Port,
 			inconn.transparentAddr.UseTLS)
+		pconn.origin = OriginTransparentStatic
+	}
+
+	if poolFunc := listener.getConnectionPool(); poolFunc != nil {
+		pool, ok := listener.pools.acquire(poolFunc(pconn))
+		if !ok {
+			err := fmt.Errorf("connection pool %s is full", pool.name)
+			if inconn.transparentMode && inconn.transparentAddr.UseTLS {
+				// Nothing has been read yet so the listener's setting is the only way to tell whether the client is starting TLS
+				return err
+			}
+			return &translateError{statusCode: http.StatusServiceUnavailable, err: err}
+		}
+		pconn.mtx.Lock()
+		pconn.pool = pool
+		pconn.mtx.Unlock()
+	}
+
+	if listener.injectFault(pconn, FaultOnAccept) {
+		return nil
 	}
 
 	var host string = ""
 	var port int = -1
 	var useTLS bool = false
+	var tunneled bool = false
 
-	request, err := http.ReadRequest(bufio.NewReader(pconn))
-	if err != nil {
-		listener.logger.Println(err)
-		return err
+	if inconn.transparentMode {
+		if reason, ok := listener.bypassReason(inconn.transparentAddr.Host); ok {
+			err := listener.passthrough(pconn, inconn.transparentAddr.Host, inconn.transparentAddr.Port, reason)
+			if terr, ok := err.(*translateError); ok && inconn.transparentAddr.UseTLS {
+				// The client is expecting a TLS connection so it can't be sent an HTTP response
+				return terr.err
+			}
+			return err
+		}
 	}
 
-	// Get parsed host and port
-	parsed_host, sport, err := net.SplitHostPort(request.URL.Host)
-	if err != nil {
-		// Assume that that URL.Host is the hostname and doesn't contain a port
-		host = request.URL.Host
-		port = -1
-	} else {
-		parsed_port, err := strconv.Atoi(sport)
+	if inconn.transparentMode {
+		protocol, err := listener.sniffTransparent(pconn, inconn.transparentAddr)
 		if err != nil {
-			// Assume that that URL.Host is the hostname and doesn't contain a port
-			return fmt.Errorf("Error parsing hostname: %s", err)
+			listener.logger.Println("Could not determine protocol of transparent connection:", err)
+			return err
+		}
+		listener.recordIntercepted(pconn)
+		if protocol != ProtocolHTTP {
+			pconn.mtx.Lock()
+			pconn.protocol = protocol
+			pconn.mtx.Unlock()
+			listener.emitConn(pconn)
+			return nil
 		}
-		host = parsed_host
-		port = parsed_port
 	}
 
-	// Handle CONNECT and TLS
+	// Raw header mode needs the original bytes put back the same way inspect-only mode does
+	pconn.rawHeaderMode = listener.getRawHeaderMode()
+	// Log-only mode and the raw request hook need the original bytes too
+	inspectOnly := listener.getInspectOnly() || pconn.rawHeaderMode || listener.getLogOnlyMode() || listener.getRawRequestHook() != nil
+	request, peeked, err := pconn.nextRequest(inspectOnly)
+	if err != nil {
+		listener.logger.Println(err)
+		return requestReadError(err)
+	}
+
 	if request.Method == "CONNECT" {
+		peeked.discard()
+		host, port, _, err = requestDest(request)
+		if err != nil {
+			return err
+		}
+		if listener.injectFault(pconn, FaultBeforeConnectResponse) {
+			return nil
+		}
+
+		var upstream net.Conn
+		reason, bypass := listener.bypassReason(host)
+		if !pconn.transparentMode && bypass {
+			// Dial before responding so the client finds out if the destination is unreachable
+			dialHost, dialPort := listener.rewriteDest(host, port)
+			upstream, err = listener.dialTunnel(dialHost, dialPort, false)
+			if err != nil {
+				return &translateError{
+					statusCode: http.StatusBadGateway,
+					err:        fmt.Errorf("could not dial passthrough destination: %s", err),
+				}
+			}
+		}
+
 		// Respond that we connected
-		resp := http.Response{Status: "Connection established", Proto: "HTTP/1.1", ProtoMajor: 1, StatusCode: 200}
-		err := resp.Write(inconn.conn)
+		err := listener.getConnectResponseWriter()(inconn.conn, host, port)
 		if err != nil {
 			listener.logger.Println("Could not write CONNECT response:", err)
+			if upstream != nil {
+				upstream.Close()
+			}
 			return err
 		}
 
-		usedTLS, err := pconn.StartMaybeTLS(host)
+		if upstream != nil {
+			listener.logConnf(pconn, "Passing connection %d through to: Host='%s', Port=%d", pconn.Id(), host, port)
+			listener.reportBypass(pconn, host, port, reason)
+			pconn.handOff.release()
+			relay(pconn, upstream)
+			return nil
+		}
+		tunneled = true
+
+		if listener.watchStartTLS(pconn, port) {
+			pconn.setDest(host, port, false, OriginConnect)
+			listener.emitConn(pconn)
+			return nil
+		}
+		listener.watchSNI(pconn, host, port)
+		protocol, err := listener.classifyConn(pconn, host)
 		if err != nil {
 			listener.logger.Println("Error starting maybeTLS:", err)
 			return err
 		}
-		useTLS = usedTLS
-	} else {
-		// Put the request back
-		pconn.returnRequest(request)
-		useTLS = false
-	}
+		useTLS = protocol == ProtocolTLS
+		if !useTLS && listener.getRequireTLSAfterConnect() {
+			listener.logger.Printf("Dropping connection %d: client sent cleartext through CONNECT tunnel to %s:%d", pconn.Id(), host, port)
+			return ErrCleartextAfterConnect
+		}
+		if err := listener.checkHandshake(pconn, host); err != nil {
+			listener.logger.Println("Could not finish TLS handshake on connection", pconn.Id(), ":", err)
+			return err
+		}
+		if host, err = listener.applySNIPolicy(pconn, host); err != nil {
+			listener.logger.Println("Could not finish TLS handshake on connection", pconn.Id(), ":", err)
+			return err
+		}
+		listener.recordIntercepted(pconn)
+		pconn.setDest(host, port, useTLS, OriginConnect)
+		if protocol == ProtocolH2C || protocol == ProtocolUnknown {
+			pconn.mtx.Lock()
+			pconn.protocol = protocol
+			pconn.mtx.Unlock()
+			listener.emitConn(pconn)
+			return nil
+		}
 
-	// Guess the port if we have to
-	if port == -1 {
-		if useTLS {
-			port = 443
-		} else {
-			port = 80
+		// Only read the first request from the tunnel if something needs to look at it
+		request = nil
+		if listener.getResponder() != nil || inspectOnly {
+			request, peeked, err = pconn.nextRequest(inspectOnly)
+			if err != nil {
+				listener.logger.Println("Could not read request from tunnel:", err)
+				return err
+			}
 		}
 	}
 
-	if !pconn.transparentMode {
-		pconn.Addr.Host = host
-		pconn.Addr.Port = port
-		pconn.Addr.UseTLS = useTLS
+	// Inspecting needs the original bytes which only the connection as a whole can give back
+	splitKeepAlive := listener.getSplitKeepAlive() && !tunneled && !pconn.transparentMode && !inspectOnly
+	for request != nil {
+		if listener.injectFault(pconn, FaultMidRequest) {
+			return nil
+		}
+		if !tunneled && !pconn.transparentMode {
+			// Each request on a plaintext connection carries its own destination
+			var origin OriginKind
+			host, port, origin, err = requestDest(request)
+			if err != nil {
+				return err
+			}
+			if host == "" {
+				switch mode, dest := listener.getOnMissingHost(); {
+				case mode == MissingHostDrop:
+					listener.logger.Println("Dropping connection", pconn.Id(), "with no destination host")
+					pconn.Close()
+					return nil
+				case mode == MissingHostUseTransparentDest && dest != nil:
+					pconn.SetTransparentMode(dest.Host, dest.Port, dest.UseTLS)
+					pconn.origin = OriginTransparentStatic
+					host, port = dest.Host, dest.Port
+				default:
+					return &translateError{
+						statusCode: http.StatusBadRequest,
+						err:        fmt.Errorf("request has no Host header or absolute URI"),
+					}
+				}
+			}
+			pconn.setDest(host, port, false, origin)
+			if reason, ok := listener.bypassReason(host); ok {
+				pconn.putBackRequest(request, peeked)
+				return listener.passthrough(pconn, pconn.Addr.Host, pconn.Addr.Port, reason)
+			}
+		}
+
+		if pconn.rawHeaderMode {
+			// Where the body ends is up to whoever reads the connection so nothing after the header can be answered here
+			if err := listener.hookRawRequest(pconn, request, peeked); err != nil {
+				pconn.Close()
+				return err
+			}
+			pconn.putBackRequest(request, peeked)
+			break
+		}
+
+		handled, err := listener.respond(pconn, request)
+		if err != nil {
+			pconn.Close()
+			return err
+		}
+		if !handled && !splitKeepAlive {
+			if err := listener.hookRawRequest(pconn, request, peeked); err != nil {
+				pconn.Close()
+				return err
+			}
+			pconn.putBackRequest(request, peeked)
+			break
+		}
+		if !handled && !listener.emitRequestConn(pconn, request) {
+			pconn.Close()
+			return nil
+		}
+		peeked.discard()
+		if request.Close {
+			pconn.Close()
+			return nil
+		}
+
+		request, peeked, err = pconn.nextRequest(inspectOnly)
+		if err != nil {
+			if !tunneled && !pconn.transparentMode {
+				if terr, ok := requestReadError(err).(*translateError); ok {
+					return terr
+				}
+			}
+			// The client is done with the connection
+			pconn.Close()
+			return nil
+		}
 	}
 
+	listener.emitConn(pconn)
+	return nil
+}
+
+// Put a translated connection in the output channel
+func (listener *ProxyListener) emitConn(pconn *proxyConn) {
 	var useTLSStr string
 	if pconn.Addr.UseTLS {
 		useTLSStr = "YES"
 	} else {
 		useTLSStr = "NO"
 	}
-	pconn.Logger().Printf("Received connection to: Host='%s', Port=%d, UseTls=%s", pconn.Addr.Host, pconn.Addr.Port, useTLSStr)
+	if listener.logsConn(pconn) {
+		// Logged once the destination is known so the log filter can decide on it
+		pconn.Logger().Println("Received conn from listener", pconn.listenerId)
+		pconn.Logger().Printf("Received connection to: Host='%s', Port=%d, UseTls=%s, Protocol=%s, Origin=%s", pconn.Addr.Host, pconn.Addr.Port, useTLSStr, pconn.Protocol(), pconn.OriginKind())
+	}
 
-	// Put the conn in the output channel
-	listener.outputConns <- pconn
-	return nil
+	if lifetime := listener.getMaxConnectionLifetime(); lifetime > 0 {
+		pconn.SetMaxLifetime(lifetime)
+	}
+	listener.trackConn(pconn)
+	atomic.AddInt32(&listener.pending, 1)
+	select {
+	case listener.outputConns <- pconn:
+	case <-listener.outputConnDone:
+		pconn.Close()
+	}
+	atomic.AddInt32(&listener.pending, -1)
+	pconn.handOff.release()
+}
+
+// Strip TLS from a transparent connection if needed and figure out what protocol the client is speaking without consuming any data
+func (listener *ProxyListener) sniffTransparent(pconn *proxyConn, destAddr *proxyAddr) (Protocol, error) {
+	mode, waitTimeout := listener.getUnknownProtocolMode()
+	if mode == UnknownProtocolEmit && waitTimeout > 0 {
+		// Don't wait forever for protocols where the server talks first
+		pconn.SetReadDeadline(time.Now().Add(waitTimeout))
+		defer pconn.SetReadDeadline(time.Time{})
+	}
+	if listener.watchStartTLS(pconn, destAddr.Port) {
+		return ProtocolUnknown, nil
+	}
+	unknown := func(err error) (Protocol, error) {
+		if neterr, ok := err.(net.Error); ok && neterr.Timeout() && mode == UnknownProtocolEmit {
+			return ProtocolUnknown, nil
+		}
+		return ProtocolUnknown, err
+	}
+
+	// Strip TLS based on the destination port or on whether it looks like the client is starting TLS
+	var err error
+	if tlsByPort := listener.getTLSByPort(); tlsByPort != nil {
+		if tlsByPort(destAddr.Port) {
+			err = pconn.forceTLS(destAddr.Host)
+		}
+	} else {
+		var protocol Protocol
+		protocol, err = listener.classifyConn(pconn, destAddr.Host)
+		if err == nil && (protocol == ProtocolH2C || protocol == ProtocolUnknown) {
+			return protocol, nil
+		}
+	}
+	if err == nil {
+		err = listener.checkHandshake(pconn, destAddr.Host)
+	}
+	if err != nil {
+		return unknown(err)
+	}
+	if pconn.tlsStripped() {
+		// The client expects TLS so the decrypted traffic shouldn't go to the destination in plaintext
+		pconn.mtx.Lock()
+		pconn.Addr.UseTLS = true
+		pconn.mtx.Unlock()
+	}
+
+	isH2C, err := pconn.peekH2CPreface()
+	if err != nil {
+		return unknown(err)
+	}
+	if isH2C {
+		return ProtocolH2C, nil
+	}
+
+	isHTTP, err := pconn.peekHTTPMethod()
+	if err != nil {
+		return unknown(err)
+	}
+	if isHTTP {
+		return ProtocolHTTP, nil
+	}
+	if mode == UnknownProtocolEmit {
+		return ProtocolUnknown, nil
+	}
+	return ProtocolUnknown, fmt.Errorf("connection does not look like HTTP")
+}
+
+// Set the destination of a connection, guessing the port if we have to. Does nothing for connections in transparent mode
+func (pconn *proxyConn) setDest(host string, port int, useTLS bool, origin OriginKind) {
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+
+	if pconn.transparentMode {
+		return
+	}
+	pconn.origin = origin
+
+	// CONNECT destinations always come with a port so only guess it for other requests
+	if port == -1 && origin != OriginConnect {
+		if useTLS {
+			port = 443
+		} else {
+			port = 80
+		}
+	}
+	if pconn.destRewriter != nil {
+		host, port = pconn.destRewriter(host, port)
+	}
+	pconn.Addr.Host = host
+	pconn.Addr.Port = port
+	pconn.Addr.UseTLS = useTLS
 }
 
 // SetCACertificate sets which certificate the listener should be used when spoofing TLS
@@ -0,0 +1,602 @@
+package puppy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func testProxyListener(t *testing.T) (*ProxyListener, string) {
+	plistener := NewProxyListener(nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plistener.AddListener(l); err != nil {
+		t.Fatal(err)
+	}
+	return plistener, l.Addr().String()
+}
+
+func testAccept(t *testing.T, plistener *ProxyListener) ProxyConn {
+	conns := make(chan ProxyConn, 1)
+	go func() {
+		c, err := plistener.Accept()
+		if err == nil {
+			conns <- c.(ProxyConn)
+		}
+	}()
+	select {
+	case c := <-conns:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for connection")
+	}
+	return nil
+}
+
+// Accept a connection in the background. Reading nothing from the connection makes it finish its TLS handshake if TLS is being stripped
+func testAcceptAsync(plistener *ProxyListener) <-chan ProxyConn {
+	conns := make(chan ProxyConn, 1)
+	go func() {
+		c, err := plistener.Accept()
+		if err != nil {
+			return
+		}
+		c.Read(nil)
+		conns <- c.(ProxyConn)
+	}()
+	return conns
+}
+
+func testDial(t *testing.T, addr string) net.Conn {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func textResponse(code int, body string) *http.Response {
+	return &http.Response{
+		StatusCode:    code,
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		Header:        make(http.Header),
+	}
+}
+
+func testCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	ret := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret = append(ret, ipnet)
+	}
+	return ret
+}
+
+func testEchoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func testTransparentListener(t *testing.T, plistener *ProxyListener, destHost string, destPort int, useTLS bool) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plistener.AddTransparentListener(l, destHost, destPort, useTLS); err != nil {
+		t.Fatal(err)
+	}
+	return l.Addr().String()
+}
+
+var testCAOnce sync.Once
+var testCACert *tls.Certificate
+
+func testCA(t *testing.T) *tls.Certificate {
+	testCAOnce.Do(func() {
+		pair, err := GenerateCACerts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		testCACert = &tls.Certificate{
+			Certificate: [][]byte{pair.Certificate},
+			PrivateKey:  pair.PrivateKey,
+		}
+	})
+	return testCACert
+}
+
+func TestDone(t *testing.T) {
+	plistener, _ := testProxyListener(t)
+	select {
+	case <-plistener.Done():
+		t.Fatal("done channel closed before listener was closed")
+	default:
+	}
+
+	go plistener.Close()
+	select {
+	case <-plistener.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for listener to shut down")
+	}
+}
+
+func TestDoneWaitsForTranslations(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+
+	// Never sends anything so its translation is stuck waiting for the first byte
+	stuck := testDial(t, addr)
+	defer stuck.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	plistener.Close()
+	select {
+	case <-plistener.Done():
+		t.Fatal("done channel closed while a connection was still being translated")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	stuck.Close()
+	select {
+	case <-plistener.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for listener to shut down")
+	}
+}
+
+func TestCloseDuringStartMaybeTLS(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	pconn := newProxyConn(server, log.New(ioutil.Discard, "", 0))
+
+	started := make(chan error, 1)
+	go func() {
+		_, err := pconn.StartMaybeTLS("example.com")
+		started <- err
+	}()
+	// Give StartMaybeTLS time to start waiting for the client
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		pconn.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close blocked while StartMaybeTLS was waiting for the client")
+	}
+	select {
+	case err := <-started:
+		if err == nil {
+			t.Error("expected StartMaybeTLS to fail once the connection was closed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("StartMaybeTLS did not return after the connection was closed")
+	}
+}
+
+func TestReplayChunkedRequest(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+
+	c := testDial(t, addr)
+	defer c.Close()
+	c.Write([]byte("POST http://example.com/upload HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n"))
+	pconn := testAccept(t, plistener)
+	pconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// Read a byte at a time to make sure nothing is lost when the replayed request doesn't fit in a single read
+	r := bufio.NewReader(iotest.OneByteReader(pconn))
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStr(t, req.URL.Path, "/upload")
+
+	// The start of the body can be read before the client has finished sending it
+	start := make([]byte, 5)
+	if _, err := io.ReadFull(req.Body, start); err != nil {
+		t.Fatal(err)
+	}
+	checkStr(t, string(start), "hello")
+
+	c.Write([]byte("6\r\n world\r\n0\r\n\r\nGET http://example.com/next HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	rest, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStr(t, string(rest), " world")
+
+	next, err := http.ReadRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStr(t, next.URL.Path, "/next")
+}
+
+func TestCloseTwice(t *testing.T) {
+	plistener, _ := testProxyListener(t)
+	testErr(t, plistener.Close())
+	testErr(t, plistener.Close())
+	if plistener.State != ProxyStopped {
+		t.Errorf("unexpected listener state %d", plistener.State)
+	}
+}
+
+// CONNECT to the given host through the listener and complete a TLS handshake
+func testConnectTLS(t *testing.T, addr string, connectHost string, config *tls.Config) (*tls.Conn, error) {
+	c := testDial(t, addr)
+	r := bufio.NewReader(c)
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", connectHost, connectHost)
+	rsp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if rsp.StatusCode != 200 {
+		c.Close()
+		return nil, fmt.Errorf("unexpected CONNECT status %d", rsp.StatusCode)
+	}
+	if config == nil {
+		config = &tls.Config{InsecureSkipVerify: true}
+	}
+	tlsc := tls.Client(c, config)
+	tlsc.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := tlsc.Handshake(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	tlsc.SetDeadline(time.Time{})
+	return tlsc, nil
+}
+
+func TestNetConn(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	plistener.SetCACertificate(testCA(t))
+
+	c := testDial(t, addr)
+	defer c.Close()
+	fmt.Fprintf(c, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	pconn := testAccept(t, plistener)
+	defer pconn.Close()
+	if _, ok := pconn.NetConn().(*net.TCPConn); !ok {
+		t.Errorf("expected *net.TCPConn, got %T", pconn.NetConn())
+	}
+
+	conns := testAcceptAsync(plistener)
+	tlsc, err := testConnectTLS(t, addr, "example.com:443", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsc.Close()
+	select {
+	case pconn := <-conns:
+		defer pconn.Close()
+		if _, ok := pconn.NetConn().(*tls.Conn); !ok {
+			t.Errorf("expected *tls.Conn, got %T", pconn.NetConn())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for connection")
+	}
+}
+
+// A connection that fails its first reads with a temporary error then delivers its data after a delay
+type testFlakyConn struct {
+	net.Conn
+	failures int
+	delay    time.Duration
+}
+
+type testTemporaryErr struct{}
+
+func (testTemporaryErr) Error() string   { return "temporary failure" }
+func (testTemporaryErr) Timeout() bool   { return false }
+func (testTemporaryErr) Temporary() bool { return true }
+
+func (c *testFlakyConn) Read(b []byte) (int, error) {
+	if c.failures > 0 {
+		c.failures--
+		return 0, testTemporaryErr{}
+	}
+	if c.delay > 0 {
+		time.Sleep(c.delay)
+		c.delay = 0
+	}
+	return c.Conn.Read(b)
+}
+
+func TestStartMaybeTLSRetry(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	flaky := &testFlakyConn{Conn: server, failures: 3, delay: 50 * time.Millisecond}
+	pconn := newProxyConn(flaky, log.New(ioutil.Discard, "", 0))
+	defer pconn.Close()
+
+	go client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	usedTLS, err := pconn.StartMaybeTLS("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usedTLS {
+		t.Error("plaintext connection detected as TLS")
+	}
+
+	// Client going away is reported straight away
+	client2, server2 := net.Pipe()
+	pconn2 := newProxyConn(server2, log.New(ioutil.Discard, "", 0))
+	client2.Close()
+	if _, err := pconn2.StartMaybeTLS("example.com"); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestConnectPortWithTLS(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	plistener.SetCACertificate(testCA(t))
+
+	conns := testAcceptAsync(plistener)
+	tlsc, err := testConnectTLS(t, addr, "example.com:8080", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsc.Close()
+	select {
+	case pconn := <-conns:
+		defer pconn.Close()
+		checkStr(t, pconn.RemoteAddr().String(), EncodeRemoteAddr("example.com", 8080, true))
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for connection")
+	}
+}
+
+func TestListenerCA(t *testing.T) {
+	plistener, globalAddr := testProxyListener(t)
+	plistener.SetCACertificate(testCA(t))
+
+	pair, err := GenerateCACerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenerCA := &tls.Certificate{
+		Certificate: [][]byte{pair.Certificate},
+		PrivateKey:  pair.PrivateKey,
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plistener.AddListenerWithOptions(l, ListenerOptions{CA: listenerCA}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		addr string
+		ca   *tls.Certificate
+	}{
+		{"global", globalAddr, testCA(t)},
+		{"listener", l.Addr().String(), listenerCA},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testAcceptAsync(plistener)
+			tlsc, err := testConnectTLS(t, tt.addr, "example.com:443", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tlsc.Close()
+
+			ca, err := x509.ParseCertificate(tt.ca.Certificate[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert := tlsc.ConnectionState().PeerCertificates[0]
+			if err := cert.CheckSignatureFrom(ca); err != nil {
+				t.Errorf("certificate not signed by expected CA: %s", err)
+			}
+		})
+	}
+}
+
+func TestCloseWithPendingConnections(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	plistener, addr := testProxyListener(t)
+
+	// Nothing accepts these so they are all waiting to be handed off when the listener closes
+	var clients []net.Conn
+	for i := 0; i < 20; i++ {
+		c := testDial(t, addr)
+		defer c.Close()
+		fmt.Fprintf(c, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		clients = append(clients, c)
+	}
+
+	// Keep connecting while the listener shuts down
+	stop := make(chan struct{})
+	dialerDone := make(chan struct{})
+	go func() {
+		defer close(dialerDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if c, err := net.Dial("tcp", addr); err == nil {
+				c.Close()
+			}
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if err := plistener.Close(); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	<-dialerDone
+
+	for _, c := range clients {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := ioutil.ReadAll(c); err != nil {
+			t.Errorf("pending connection was not closed: %s", err)
+		}
+	}
+
+	// Everything started by the listener should be gone
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > baseline {
+		t.Errorf("%d goroutines leaked", n-baseline)
+	}
+}
+
+func TestBytesTransferred(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	plistener.SetCACertificate(testCA(t))
+
+	conns := testAcceptAsync(plistener)
+	tlsc, err := testConnectTLS(t, addr, "example.com:443", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsc.Close()
+	pconn := <-conns
+	defer pconn.Close()
+
+	// The handshake is not counted since the bytes are encrypted
+	if pconn.BytesRead() != 0 || pconn.BytesWritten() != 0 {
+		t.Errorf("expected no bytes before sending data, got %d read and %d written", pconn.BytesRead(), pconn.BytesWritten())
+	}
+
+	sent := strings.Repeat("a", 1000)
+	go tlsc.Write([]byte(sent))
+	if _, err := io.ReadFull(pconn, make([]byte, len(sent))); err != nil {
+		t.Fatal(err)
+	}
+	go io.ReadFull(tlsc, make([]byte, 250))
+	if _, err := pconn.Write([]byte(strings.Repeat("b", 250))); err != nil {
+		t.Fatal(err)
+	}
+
+	if pconn.BytesRead() != 1000 {
+		t.Errorf("expected 1000 bytes read, got %d", pconn.BytesRead())
+	}
+	if pconn.BytesWritten() != 250 {
+		t.Errorf("expected 250 bytes written, got %d", pconn.BytesWritten())
+	}
+}
+
+func TestAddListenerAfterClose(t *testing.T) {
+	plistener, _ := testProxyListener(t)
+	plistener.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := plistener.AddListener(l); err != ErrListenerClosed {
+		t.Errorf("expected ErrListenerClosed from AddListener, got %v", err)
+	}
+	if err := plistener.AddTransparentListener(l, "example.com", 80, false); err != ErrListenerClosed {
+		t.Errorf("expected ErrListenerClosed from AddTransparentListener, got %v", err)
+	}
+}
+
+// A log destination that can be read while connections are still logging to it
+type testLogBuffer struct {
+	mtx sync.Mutex
+	buf strings.Builder
+}
+
+func (b *testLogBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *testLogBuffer) String() string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.String()
+}
+
+func TestSetLogger(t *testing.T) {
+	listenerLog := &testLogBuffer{}
+	plistener := NewProxyListener(log.New(listenerLog, "", 0))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testErr(t, plistener.AddListener(l))
+	defer plistener.Close()
+
+	var pconns []ProxyConn
+	for i := 0; i < 2; i++ {
+		c := testDial(t, l.Addr().String())
+		defer c.Close()
+		c.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		pconns = append(pconns, testAccept(t, plistener))
+	}
+	traced, untraced := pconns[0], pconns[1]
+	tracedLog := &testLogBuffer{}
+	traced.SetLogger(log.New(tracedLog, "[trace-1234] ", 0))
+
+	for _, pconn := range pconns {
+		pconn.SetMaxLifetime(time.Millisecond)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for traced.CloseReason() == "" || untraced.CloseReason() == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for connections to close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tracedMsg := fmt.Sprint("Connection ", traced.Id(), " exceeded")
+	untracedMsg := fmt.Sprint("Connection ", untraced.Id(), " exceeded")
+	if logged := tracedLog.String(); !strings.Contains(logged, "[trace-1234] "+tracedMsg) || strings.Contains(logged, untracedMsg) {
+		t.Errorf("unexpected per-connection log: %q", logged)
+	}
+	if logged := listenerLog.String(); strings.Contains(logged, tracedMsg) || !strings.Contains(logged, untracedMsg) {
+		t.Errorf("unexpected listener log: %q", logged)
+	}
+}
@@ -0,0 +1,160 @@
+package puppy
+
+/*
+Lenient reading of request headers that keeps the exact bytes sent by the client
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The longest request header that will be read in raw header mode
+const maxRawHeaderLength = 1024 * 1024
+
+// RawRequestHeader is a request line and header read without normalizing anything. Used for cases such as request smuggling research where ambiguous headers need to be preserved exactly
+type RawRequestHeader struct {
+	// The exact bytes of the request line and header fields, including the blank line that ends the header
+	Raw []byte
+
+	// The parts of the request line
+	Method string
+	Target string
+	Proto  string
+
+	// The header fields in the order they were sent. Duplicate and conflicting fields are kept as-is
+	Fields []RawHeaderField
+}
+
+// RawHeaderField is a single header field. The name is exactly as it was sent, including any whitespace before the colon
+type RawHeaderField struct {
+	Name  string
+	Value string
+}
+
+// Values returns the values of every field with the given name, ignoring case and whitespace around the name
+func (h *RawRequestHeader) Values(name string) []string {
+	var values []string
+	for _, f := range h.Fields {
+		if strings.EqualFold(strings.TrimSpace(f.Name), name) {
+			values = append(values, f.Value)
+		}
+	}
+	return values
+}
+
+// Read a request header from a reader without rejecting anything other than a missing request line
+func readRawHeader(r *bufio.Reader) (*RawRequestHeader, error) {
+	var raw bytes.Buffer
+	var lines []string
+	tooLong := fmt.Errorf("request header exceeds %d bytes", maxRawHeaderLength)
+	for {
+		// Read the line a buffer at a time so a line that never ends can't grow without limit
+		start := raw.Len()
+		for {
+			chunk, err := r.ReadSlice('\n')
+			raw.Write(chunk)
+			if raw.Len() > maxRawHeaderLength {
+				return nil, tooLong
+			}
+			if err == nil {
+				break
+			}
+			if err != bufio.ErrBufferFull {
+				return nil, err
+			}
+		}
+		line := raw.Bytes()[start:]
+
+		trimmed := strings.TrimRight(string(line), "\r\n")
+		if trimmed == "" {
+			if len(lines) == 0 {
+				// Ignore blank lines before the request line like the standard library does
+				continue
+			}
+			break
+		}
+		lines = append(lines, trimmed)
+	}
+
+	header := &RawRequestHeader{Raw: raw.Bytes()}
+	parts := strings.SplitN(lines[0], " ", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed request line: %q", lines[0])
+	}
+	header.Method, header.Target, header.Proto = parts[0], parts[1], parts[2]
+
+	for _, line := range lines[1:] {
+		if (line[0] == ' ' || line[0] == '\t') && len(header.Fields) > 0 {
+			// Obsolete line folding
+			prev := &header.Fields[len(header.Fields)-1]
+			prev.Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		field := RawHeaderField{Name: line}
+		if idx := strings.IndexByte(line, ':'); idx >= 0 {
+			field.Name = line[:idx]
+			field.Value = strings.Trim(line[idx+1:], " \t")
+		}
+		header.Fields = append(header.Fields, field)
+	}
+	return header, nil
+}
+
+// Make a best-effort request from the header. The request has no body
+func (h *RawRequestHeader) request() *http.Request {
+	req := &http.Request{
+		Method:     h.Method,
+		RequestURI: h.Target,
+		Proto:      h.Proto,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+	}
+	req.ProtoMajor, req.ProtoMinor, _ = http.ParseHTTPVersion(h.Proto)
+
+	for _, f := range h.Fields {
+		name := strings.TrimSpace(f.Name)
+		req.Header.Add(name, f.Value)
+		if req.Host == "" && strings.EqualFold(name, "Host") {
+			req.Host = f.Value
+		}
+	}
+
+	if requestTargetForm(req) == targetAuthority {
+		req.URL = &url.URL{Host: h.Target}
+	} else if u, err := url.ParseRequestURI(h.Target); err == nil {
+		req.URL = u
+	} else {
+		req.URL = &url.URL{Path: h.Target}
+	}
+	if req.Host == "" {
+		req.Host = req.URL.Host
+	}
+	return req
+}
+
+func (pconn *proxyConn) RawHeader() *RawRequestHeader {
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+
+	return pconn.rawHeader
+}
+
+// SetRawHeaderMode sets whether request headers are read without the validation and normalization done by the standard library. When enabled, the header is available from the RawHeader method of the ProxyConn, reading from the ProxyConn produces the exact bytes sent by the client, and the responder is not used. Conflicting Content-Length and Transfer-Encoding headers are left for the reader of the connection to deal with
+func (listener *ProxyListener) SetRawHeaderMode(raw bool) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.rawHeaderMode = raw
+}
+
+func (listener *ProxyListener) getRawHeaderMode() bool {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.rawHeaderMode
+}
@@ -0,0 +1,88 @@
+package puppy
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRawHeaderMode(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	plistener.SetRawHeaderMode(true)
+
+	// Conflicting framing headers that http.ReadRequest would reject
+	sent := "POST http://example.com/ HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"Content-Length: 4\r\n" +
+		"Content-Length: 11\r\n" +
+		"Transfer-Encoding : chunked\r\n" +
+		"transfer-encoding: identity\r\n" +
+		"\r\n" +
+		"0\r\n\r\nGET /admin HTTP/1.1\r\n\r\n"
+	c := testDial(t, addr)
+	defer c.Close()
+	c.Write([]byte(sent))
+
+	pconn := testAccept(t, plistener)
+	defer pconn.Close()
+	checkStr(t, pconn.RemoteAddr().String(), EncodeRemoteAddr("example.com", 80, false))
+
+	header := pconn.RawHeader()
+	if header == nil {
+		t.Fatal("no raw header")
+	}
+	checkStr(t, string(header.Raw), sent[:strings.Index(sent, "\r\n\r\n")+4])
+	checkStr(t, header.Method, "POST")
+	checkStr(t, header.Target, "http://example.com/")
+	checkStr(t, strings.Join(header.Values("Content-Length"), ","), "4,11")
+	checkStr(t, strings.Join(header.Values("Transfer-Encoding"), ","), "chunked,identity")
+	if len(header.Fields) != 5 {
+		t.Fatalf("expected 5 fields, got %d", len(header.Fields))
+	}
+	checkStr(t, header.Fields[3].Name, "Transfer-Encoding ")
+
+	read := make([]byte, len(sent))
+	if _, err := io.ReadFull(pconn, read); err != nil {
+		t.Fatal(err)
+	}
+	checkStr(t, string(read), sent)
+}
+
+func TestReadRawHeaderMalformed(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	plistener.SetRawHeaderMode(true)
+
+	c := testDial(t, addr)
+	defer c.Close()
+	c.Write([]byte("NOTAREQUEST\r\n\r\n"))
+
+	rsp := make([]byte, 12)
+	if _, err := io.ReadFull(c, rsp); err != nil {
+		t.Fatal(err)
+	}
+	checkStr(t, string(rsp), "HTTP/1.1 400")
+}
+
+// Sends the same byte forever and counts how many were read
+type endlessReader struct {
+	read int
+}
+
+func (r *endlessReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 'a'
+	}
+	r.read += len(b)
+	return len(b), nil
+}
+
+func TestReadRawHeaderEndlessLine(t *testing.T) {
+	r := &endlessReader{}
+	if _, err := readRawHeader(bufio.NewReader(r)); err == nil {
+		t.Fatal("expected a header that never ends to be rejected")
+	}
+	if r.read > maxRawHeaderLength+64*1024 {
+		t.Errorf("read %d bytes of a header limited to %d", r.read, maxRawHeaderLength)
+	}
+}
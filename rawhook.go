@@ -0,0 +1,76 @@
+package puppy
+
+/*
+Giving inspectors the exact bytes of a request before the parser normalizes them
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+)
+
+// RawRequestHook is given the exact bytes of the request line and header of a request along with the parsed request. If it returns nil, the request is passed on unchanged. Otherwise the returned bytes are read from the ProxyConn verbatim in place of the original header, followed by whatever came after it. The parsed request is not updated to match
+type RawRequestHook func(raw []byte, req *http.Request, pc ProxyConn) []byte
+
+// SetRawRequestHook sets a function which is given the raw bytes of each request that is passed on as a ProxyConn. Requests answered by the responder are not given to the hook. Setting a hook reads requests the same way inspect-only mode does. Set to nil to disable
+func (listener *ProxyListener) SetRawRequestHook(hook RawRequestHook) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.rawHook = hook
+}
+
+func (listener *ProxyListener) getRawRequestHook() RawRequestHook {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.rawHook
+}
+
+// Give a request that is about to be put back to the raw request hook and replace its header with whatever the hook returns
+func (listener *ProxyListener) hookRawRequest(pconn *proxyConn, req *http.Request, peeked *peekedRequest) (err error) {
+	hook := listener.getRawRequestHook()
+	if hook == nil || peeked == nil {
+		return nil
+	}
+
+	var replaced []byte
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("raw request hook panicked: %v", r)
+			}
+		}()
+		replaced = hook(peeked.header(), req, pconn)
+	}()
+	if err != nil {
+		listener.logger.Println("Error in raw request hook for connection", pconn.Id(), ":", err)
+		return err
+	}
+	if replaced != nil && !peeked.replaceHeader(replaced) {
+		return ErrConnMemoryLimit
+	}
+	return nil
+}
+
+// A copy of the bytes the request line and header were read from
+func (p *peekedRequest) header() []byte {
+	return append([]byte(nil), p.rec.recorded.Bytes()[:p.headerLen]...)
+}
+
+// Swap out the recorded header for different bytes. Returns false if the new header doesn't fit in the connection's memory budget
+func (p *peekedRequest) replaceHeader(raw []byte) bool {
+	recorded := p.rec.recorded.Bytes()
+	if !p.rec.mem.resize(len(recorded), len(recorded)-p.headerLen+len(raw)) {
+		return false
+	}
+
+	var replaced bytes.Buffer
+	replaced.Grow(len(recorded) - p.headerLen + len(raw))
+	replaced.Write(raw)
+	replaced.Write(recorded[p.headerLen:])
+	p.rec.recorded = replaced
+	p.headerLen = len(raw)
+	return true
+}
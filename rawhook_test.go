@@ -0,0 +1,117 @@
+package puppy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRawRequestHook(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	plistener.SetRawHeaderMode(true)
+	type hooked struct {
+		raw    string
+		method string
+	}
+	calls := make(chan hooked, 1)
+	plistener.SetRawRequestHook(func(raw []byte, req *http.Request, pc ProxyConn) []byte {
+		calls <- hooked{string(raw), req.Method}
+		return nil
+	})
+
+	// Smuggling-style framing that the standard parser would reject or normalize
+	header := "POST http://example.com/ HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"Content-Length: 4\r\n" +
+		"Transfer-Encoding : chunked\r\n" +
+		"transfer-encoding:\tidentity\r\n" +
+		"\r\n"
+	sent := header + "0\r\n\r\nGET /admin HTTP/1.1\r\n\r\n"
+	c := testDial(t, addr)
+	defer c.Close()
+	c.Write([]byte(sent))
+
+	pconn := testAccept(t, plistener)
+	defer pconn.Close()
+	call := <-calls
+	checkStr(t, call.raw, header)
+	checkStr(t, call.method, "POST")
+
+	read := make([]byte, len(sent))
+	if _, err := io.ReadFull(pconn, read); err != nil {
+		t.Fatal(err)
+	}
+	checkStr(t, string(read), sent)
+}
+
+func TestRawRequestHookNormalized(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	calls := make(chan string, 1)
+	plistener.SetRawRequestHook(func(raw []byte, req *http.Request, pc ProxyConn) []byte {
+		calls <- string(raw)
+		return nil
+	})
+
+	// The parser canonicalizes names, unfolds lines and trims values but the hook sees what was sent
+	header := "GET http://example.com/ HTTP/1.1\n" +
+		"host: example.com\n" +
+		"x-folded: one\r\n" +
+		" two\r\n" +
+		"X-Spaced:    padded   \r\n" +
+		"\r\n"
+	c := testDial(t, addr)
+	defer c.Close()
+	c.Write([]byte(header))
+
+	pconn := testAccept(t, plistener)
+	defer pconn.Close()
+	checkStr(t, <-calls, header)
+	req := pconn.InspectedRequest()
+	if req == nil {
+		t.Fatal("no inspected request")
+	}
+	checkStr(t, req.Header.Get("X-Spaced"), "padded")
+}
+
+func TestRawRequestHookReplace(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	plistener.SetRawHeaderMode(true)
+	replacement := "POST /replaced HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: identity\r\n\r\n"
+	plistener.SetRawRequestHook(func(raw []byte, req *http.Request, pc ProxyConn) []byte {
+		return []byte(replacement)
+	})
+
+	body := "5\r\nhello\r\n0\r\n\r\n"
+	sent := "POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n" + body
+	c := testDial(t, addr)
+	defer c.Close()
+	c.Write([]byte(sent))
+
+	pconn := testAccept(t, plistener)
+	defer pconn.Close()
+	read := make([]byte, len(replacement)+len(body))
+	if _, err := io.ReadFull(pconn, read); err != nil {
+		t.Fatal(err)
+	}
+	checkStr(t, string(read), replacement+body)
+
+	// The parsed request still describes what the client sent
+	checkStr(t, pconn.RawHeader().Target, "http://example.com/")
+}
+
+func TestRawRequestHookPanic(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	plistener.SetRawRequestHook(func(raw []byte, req *http.Request, pc ProxyConn) []byte {
+		panic("broken hook")
+	})
+
+	c := testDial(t, addr)
+	defer c.Close()
+	c.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	rsp, err := io.ReadAll(c)
+	testErr(t, err)
+	if strings.Contains(string(rsp), "200") {
+		t.Errorf("request was passed on after the hook panicked: %q", rsp)
+	}
+}
@@ -0,0 +1,83 @@
+package puppy
+
+/*
+Decompressing gzipped responses so interceptors can modify them and compressing them again afterwards
+*/
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// RecompressIdentity can be passed to SetResponseRecompress to send modified responses uncompressed
+const RecompressIdentity = -3
+
+// SetResponseRecompress makes response interceptors see the decompressed body of gzipped responses. Responses that are modified by an interceptor are compressed again with the given compress/gzip level, or sent uncompressed if the level is RecompressIdentity. The Content-Encoding and Content-Length headers are updated to match the body that is sent. Responses that are not modified are sent exactly as they were received
+func (iproxy *InterceptingProxy) SetResponseRecompress(level int) error {
+	if level != RecompressIdentity && (level < gzip.HuffmanOnly || level > gzip.BestCompression) {
+		return fmt.Errorf("invalid gzip compression level %d", level)
+	}
+
+	iproxy.mtx.Lock()
+	defer iproxy.mtx.Unlock()
+	iproxy.recompress = true
+	iproxy.recompressLevel = level
+	return nil
+}
+
+// ClearResponseRecompress makes response interceptors see the bodies of responses exactly as they were received
+func (iproxy *InterceptingProxy) ClearResponseRecompress() {
+	iproxy.mtx.Lock()
+	defer iproxy.mtx.Unlock()
+	iproxy.recompress = false
+}
+
+func (iproxy *InterceptingProxy) getResponseRecompress() (bool, int) {
+	iproxy.mtx.Lock()
+	defer iproxy.mtx.Unlock()
+	return iproxy.recompress, iproxy.recompressLevel
+}
+
+// Returns a copy of a gzipped response with its body decompressed and its Content-Encoding removed. Returns nil if the response is not gzipped or cannot be decompressed
+func decompressResponse(rsp *ProxyResponse) *ProxyResponse {
+	if !strings.EqualFold(strings.TrimSpace(rsp.Header.Get("Content-Encoding")), "gzip") {
+		return nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(rsp.BodyBytes()))
+	if err != nil {
+		return nil
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil
+	}
+
+	decoded := rsp.Clone()
+	decoded.Header.Del("Content-Encoding")
+	decoded.SetBodyBytes(body)
+	return decoded
+}
+
+// Compress the body of a decompressed response again at the given level
+func recompressResponse(rsp *ProxyResponse, level int) error {
+	if level == RecompressIdentity {
+		return nil
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(rsp.BodyBytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	rsp.Header.Set("Content-Encoding", "gzip")
+	rsp.SetBodyBytes(buf.Bytes())
+	return nil
+}
@@ -0,0 +1,89 @@
+package puppy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func testGzip(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(s))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestResponseRecompress(t *testing.T) {
+	compressed := testGzip(t, "hello world")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(len(compressed)))
+		w.Write(compressed)
+	}))
+	defer server.Close()
+	host, port := testServerDest(t, server)
+
+	tests := []struct {
+		name     string
+		level    int
+		modify   bool
+		encoding string
+		body     string
+	}{
+		{name: "recompressed", level: gzip.BestCompression, modify: true, encoding: "gzip", body: "hello puppy"},
+		{name: "identity", level: RecompressIdentity, modify: true, encoding: "", body: "hello puppy"},
+		{name: "unmodified", level: gzip.BestCompression, modify: false, encoding: "gzip", body: "hello world"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			iproxy := NewInterceptingProxy(nil)
+			defer iproxy.Close()
+			testErr(t, iproxy.SetResponseRecompress(test.level))
+			iproxy.AddRspInterceptor(func(req *ProxyRequest, rsp *ProxyResponse) (*ProxyResponse, error) {
+				checkStr(t, string(rsp.BodyBytes()), "hello world")
+				if test.modify {
+					rsp.SetBodyBytes([]byte("hello puppy"))
+				}
+				return rsp, nil
+			})
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = EncodeRemoteAddr(host, port, false)
+			rec := httptest.NewRecorder()
+			iproxy.ServeHTTP(rec, r)
+
+			result := rec.Result()
+			checkStr(t, result.Header.Get("Content-Encoding"), test.encoding)
+			body, _ := ioutil.ReadAll(result.Body)
+			checkStr(t, result.Header.Get("Content-Length"), strconv.Itoa(len(body)))
+			if !test.modify && !bytes.Equal(body, compressed) {
+				t.Error("expected unmodified response to be sent as it was received")
+			}
+			if test.encoding == "gzip" {
+				gr, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, err = ioutil.ReadAll(gr)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			checkStr(t, string(body), test.body)
+		})
+	}
+
+	iproxy := NewInterceptingProxy(nil)
+	defer iproxy.Close()
+	if err := iproxy.SetResponseRecompress(42); err == nil {
+		t.Error("expected an error for an invalid compression level")
+	}
+}
@@ -0,0 +1,146 @@
+package puppy
+
+/*
+Resending saved requests to their destination and returning the response
+*/
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How long a repeated request may take if no timeout is given in its RepeatOptions
+const defaultRepeatTimeout = 30 * time.Second
+
+// How long an idle upstream connection is kept for reuse by later repeated requests
+const repeatIdleTimeout = 90 * time.Second
+
+// The most destinations that transports are kept for. The least recently used one is dropped to make room for a new one
+const maxRepeatTransports = 64
+
+// RepeatOptions controls how Repeat sends a request
+type RepeatOptions struct {
+	// How long to wait for the whole exchange, including dialing and reading the response body. Defaults to 30 seconds
+	Timeout time.Duration
+
+	// Open a new connection for the request and close it afterwards instead of reusing an idle connection to the same destination
+	DisableKeepAlive bool
+}
+
+// Repeat sends a request to the given destination using the listener's dial path and returns the response. Connections to the same destination are reused between calls. The request's URL is rewritten to point at the destination but its Host header is sent as-is. The response body must be closed
+func (listener *ProxyListener) Repeat(req *http.Request, host string, port int, useTLS bool, opts *RepeatOptions) (*http.Response, error) {
+	if opts == nil {
+		opts = &RepeatOptions{}
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultRepeatTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	deadline, _ := ctx.Deadline()
+	out := req.Clone(context.WithValue(ctx, repeatDeadlineKey{}, deadline))
+	out.RequestURI = ""
+	out.URL.Host = net.JoinHostPort(host, strconv.Itoa(port))
+	out.URL.Scheme = "http"
+	if useTLS {
+		out.URL.Scheme = "https"
+	}
+	if out.Host == "" {
+		out.Host = req.URL.Host
+	}
+	out.Close = out.Close || opts.DisableKeepAlive
+
+	resp, err := listener.repeatTransport(host, port, useTLS).RoundTrip(out)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// Get the transport for a destination, creating it if needed. Every connection it makes goes to that destination regardless of the request URL
+func (listener *ProxyListener) repeatTransport(host string, port int, useTLS bool) *http.Transport {
+	key := EncodeRemoteAddr(host, port, useTLS)
+
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	if r, ok := listener.repeaters[key]; ok {
+		r.lastUsed = time.Now()
+		return r.transport
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// The transport keeps dialing after the request is canceled so the request's deadline is applied to connection setup here
+		if deadline, ok := ctx.Value(repeatDeadlineKey{}).(time.Time); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+		return listener.dialUpstreamContext(ctx, network, host, port, useTLS, nil)
+	}
+	t := &http.Transport{
+		DialContext:        dial,
+		DialTLSContext:     dial,
+		DisableCompression: true,
+		IdleConnTimeout:    repeatIdleTimeout,
+	}
+	if listener.repeaters == nil {
+		listener.repeaters = make(map[string]*repeater)
+	}
+	if len(listener.repeaters) >= maxRepeatTransports {
+		listener.evictRepeater()
+	}
+	listener.repeaters[key] = &repeater{transport: t, lastUsed: time.Now()}
+	return t
+}
+
+// The context key for when connecting for a repeated request has to give up
+type repeatDeadlineKey struct{}
+
+// A transport for repeating requests to one destination
+type repeater struct {
+	transport *http.Transport
+	lastUsed  time.Time
+}
+
+// Drop the least recently used transport. Requests still using it finish normally and its remaining connections are closed once they have been idle for repeatIdleTimeout. Assumes the listener's lock is held
+func (listener *ProxyListener) evictRepeater() {
+	var oldestKey string
+	var oldest *repeater
+	for key, r := range listener.repeaters {
+		if oldest == nil || r.lastUsed.Before(oldest.lastUsed) {
+			oldestKey, oldest = key, r
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	oldest.transport.CloseIdleConnections()
+	delete(listener.repeaters, oldestKey)
+}
+
+// Close the idle connections kept for repeated requests. Assumes the listener's lock is held
+func (listener *ProxyListener) closeRepeaters() {
+	for _, r := range listener.repeaters {
+		r.transport.CloseIdleConnections()
+	}
+	listener.repeaters = nil
+}
+
+// Releases a request's context once its response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
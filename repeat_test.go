@@ -0,0 +1,148 @@
+package puppy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testServerDest(t *testing.T, server *httptest.Server) (string, int) {
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+
+func TestRepeat(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(r.Method + " " + r.Host + " " + r.URL.RequestURI() + " " + string(body)))
+	})
+
+	for _, useTLS := range []bool{false, true} {
+		server := httptest.NewUnstartedServer(handler)
+		var newConns int32
+		server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(&newConns, 1)
+			}
+		}
+		if useTLS {
+			server.StartTLS()
+		} else {
+			server.Start()
+		}
+		defer server.Close()
+		host, port := testServerDest(t, server)
+		plistener, _ := testProxyListener(t)
+		defer plistener.Close()
+
+		for i := 0; i < 2; i++ {
+			req, err := http.NewRequest("POST", "http://saved.example/path?q=1", strings.NewReader("body"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := plistener.Repeat(req, host, port, useTLS, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			checkStr(t, string(body), "POST saved.example /path?q=1 body")
+		}
+		if n := atomic.LoadInt32(&newConns); n != 1 {
+			t.Errorf("expected connection to be reused with TLS=%v, got %d connections", useTLS, n)
+		}
+	}
+}
+
+func TestRepeatTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	host, port := testServerDest(t, server)
+	plistener, _ := testProxyListener(t)
+	defer plistener.Close()
+
+	req, _ := http.NewRequest("GET", "http://saved.example/", nil)
+	start := time.Now()
+	if _, err := plistener.Repeat(req, host, port, false, &RepeatOptions{Timeout: 100 * time.Millisecond}); err == nil {
+		t.Fatal("expected repeated request to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("timeout took %s", elapsed)
+	}
+}
+
+func TestRepeatTimeoutCoversDial(t *testing.T) {
+	// Accepts connections but never answers the TLS handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+	host, portStr, _ := net.SplitHostPort(l.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	plistener, _ := testProxyListener(t)
+	defer plistener.Close()
+
+	req, _ := http.NewRequest("GET", "https://saved.example/", nil)
+	start := time.Now()
+	if _, err := plistener.Repeat(req, host, port, true, &RepeatOptions{Timeout: 100 * time.Millisecond}); err == nil {
+		t.Fatal("expected repeated request to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("timeout took %s", elapsed)
+	}
+
+	// The dial gives up too instead of waiting on the handshake forever
+	c := <-accepted
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(c); err != nil {
+		t.Errorf("dial was not abandoned: %s", err)
+	}
+}
+
+func TestRepeatTransportsBounded(t *testing.T) {
+	plistener, _ := testProxyListener(t)
+	defer plistener.Close()
+
+	first := plistener.repeatTransport("first.example", 80, false)
+	for i := 0; i < maxRepeatTransports+10; i++ {
+		plistener.repeatTransport("saved.example", 1000+i, false)
+	}
+	plistener.mtx.Lock()
+	count := len(plistener.repeaters)
+	_, kept := plistener.repeaters[EncodeRemoteAddr("first.example", 80, false)]
+	plistener.mtx.Unlock()
+	if count != maxRepeatTransports {
+		t.Errorf("expected %d transports, got %d", maxRepeatTransports, count)
+	}
+	if kept {
+		t.Error("least recently used transport was not dropped")
+	}
+	if plistener.repeatTransport("first.example", 80, false) == first {
+		t.Error("dropped transport was reused")
+	}
+}
@@ -0,0 +1,64 @@
+package puppy
+
+/*
+Limiting how long a request line clients can send
+*/
+
+import (
+	"bytes"
+)
+
+// Returned when a client sends a request line longer than the maximum set with SetMaxRequestLineLength
+const ErrRequestLineTooLong = ConstErr("request line too long")
+
+// SetMaxRequestLineLength sets the longest request line, not including the line ending, that clients are allowed to send. Connections with longer request lines are closed with ErrRequestLineTooLong. A length of 0 or less means there is no limit
+func (listener *ProxyListener) SetMaxRequestLineLength(length int) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.maxRequestLine = length
+}
+
+func (listener *ProxyListener) getMaxRequestLineLength() int {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.maxRequestLine
+}
+
+// Make sure that the next request line is not longer than the maximum length without consuming anything
+func (pconn *proxyConn) checkRequestLine() error {
+	pconn.mtx.Lock()
+	max := pconn.maxRequestLine
+	pconn.mtx.Unlock()
+	if max <= 0 {
+		return nil
+	}
+
+	bufConn := pconn.buffered()
+	scanned := 0
+	for n := 1; ; n++ {
+		b, err := bufConn.Peek(n)
+		if idx := bytes.IndexByte(b[scanned:], '\n'); idx >= 0 {
+			line := bytes.TrimRight(b[:scanned+idx], "\r")
+			if len(line) > max {
+				return ErrRequestLineTooLong
+			}
+			return nil
+		}
+		if err != nil {
+			// Let the request parser report the problem
+			return nil
+		}
+		if len(b) > max+1 {
+			return ErrRequestLineTooLong
+		}
+		scanned = len(b)
+		if buffered := bufConn.reader.Buffered(); buffered > n {
+			n = buffered
+		}
+		if n > max+1 {
+			n = max + 1
+		}
+	}
+}
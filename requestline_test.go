@@ -0,0 +1,44 @@
+package puppy
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxRequestLineLength(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	plistener.SetMaxRequestLineLength(100)
+
+	t.Run("too long", func(t *testing.T) {
+		c := testDial(t, addr)
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(c, "GET http://example.com/%s HTTP/1.1\r\nHost: example.com\r\n\r\n", strings.Repeat("a", 10000))
+
+		rsp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rsp.StatusCode != http.StatusRequestURITooLong {
+			t.Errorf("expected status 414, got %d", rsp.StatusCode)
+		}
+	})
+
+	t.Run("within limit", func(t *testing.T) {
+		c := testDial(t, addr)
+		defer c.Close()
+		fmt.Fprintf(c, "GET http://example.com/%s HTTP/1.1\r\nHost: example.com\r\n\r\n", strings.Repeat("a", 50))
+
+		pconn := testAccept(t, plistener)
+		defer pconn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(pconn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStr(t, req.URL.Path, "/"+strings.Repeat("a", 50))
+	})
+}
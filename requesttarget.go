@@ -0,0 +1,129 @@
+package puppy
+
+/*
+Working out where a request is going and how that was decided
+*/
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// OriginKind is how the destination of a ProxyConn was determined
+type OriginKind int
+
+const (
+	OriginUnknown OriginKind = iota
+	// The target of a CONNECT request
+	OriginConnect
+	// The URL of a request with an absolute URI (ie "GET http://example.com/ HTTP/1.1")
+	OriginAbsoluteURI
+	// The Host header of a request without a host in its target (ie "GET / HTTP/1.1")
+	OriginHostHeader
+	// The fixed destination of a transparent listener
+	OriginTransparentStatic
+)
+
+func (o OriginKind) String() string {
+	switch o {
+	case OriginConnect:
+		return "connect"
+	case OriginAbsoluteURI:
+		return "absolute-uri"
+	case OriginHostHeader:
+		return "host-header"
+	case OriginTransparentStatic:
+		return "transparent-static"
+	}
+	return "unknown"
+}
+
+func (pconn *proxyConn) OriginKind() OriginKind {
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+
+	return pconn.origin
+}
+
+// The forms the target of a request can take. See RFC 7230 section 5.3
+const (
+	targetOrigin = iota
+	targetAbsolute
+	targetAuthority
+	targetAsterisk
+)
+
+// Figure out which form the target of a request is in
+func requestTargetForm(request *http.Request) int {
+	uri := request.RequestURI
+	switch {
+	case uri == "*":
+		return targetAsterisk
+	case strings.HasPrefix(uri, "/"):
+		return targetOrigin
+	case strings.Contains(uri, "://"):
+		return targetAbsolute
+	}
+	return targetAuthority
+}
+
+// Get the host and port a request is intended for and where they came from. Returns a port of -1 if the request does not specify one
+func requestDest(request *http.Request) (string, int, OriginKind, error) {
+	hostport := request.URL.Host
+	var origin OriginKind
+	switch requestTargetForm(request) {
+	case targetAuthority:
+		if request.Method != "CONNECT" {
+			return "", -1, OriginUnknown, &translateError{
+				statusCode: http.StatusBadRequest,
+				err:        fmt.Errorf("authority-form request target used with %s", request.Method),
+			}
+		}
+		// The target is the whole authority and has no scheme to default the port from, so it is parsed on its own
+		host, port, err := connectDest(request.RequestURI)
+		if err != nil {
+			return "", -1, OriginConnect, &translateError{statusCode: http.StatusBadRequest, err: err}
+		}
+		return host, port, OriginConnect, nil
+	case targetAbsolute:
+		origin = OriginAbsoluteURI
+	case targetOrigin, targetAsterisk:
+		// Nothing in the target, so the Host header is all we have to go on
+		hostport = request.Host
+		origin = OriginHostHeader
+	}
+
+	parsed_host, sport, err := net.SplitHostPort(hostport)
+	if err != nil {
+		// Assume that that URL.Host is the hostname and doesn't contain a port
+		return hostport, -1, origin, nil
+	}
+	parsed_port, err := strconv.Atoi(sport)
+	if err != nil {
+		return "", -1, origin, fmt.Errorf("Error parsing hostname: %s", err)
+	}
+	return parsed_host, parsed_port, origin, nil
+}
+
+// Get the host and port from the authority-form target of a CONNECT request. Clients should always send a port but one that is missing is taken to be the HTTPS port. IPv6 literals can be given with or without brackets when there is no port
+func connectDest(authority string) (string, int, error) {
+	host, sport, err := net.SplitHostPort(authority)
+	if err != nil {
+		host = authority
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
+		if host == "" || (strings.ContainsAny(host, ":[]") && net.ParseIP(host) == nil) {
+			return "", -1, fmt.Errorf("invalid CONNECT target %q", authority)
+		}
+		return host, defaultConnectPort, nil
+	}
+	port, err := strconv.Atoi(sport)
+	if err != nil || port < 1 || port > 65535 || host == "" {
+		return "", -1, fmt.Errorf("invalid CONNECT target %q", authority)
+	}
+	return host, port, nil
+}
@@ -0,0 +1,117 @@
+package puppy
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRequestTargetForms(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+
+	tests := []struct {
+		name       string
+		request    string
+		statusCode int
+		dest       string
+		origin     OriginKind
+		replayed   string
+	}{
+		{
+			name:     "origin-form",
+			request:  "GET /foo?bar=baz HTTP/1.1\r\nHost: example.com:8080\r\n\r\n",
+			dest:     EncodeRemoteAddr("example.com", 8080, false),
+			origin:   OriginHostHeader,
+			replayed: "GET /foo?bar=baz HTTP/1.1",
+		},
+		{
+			name:     "absolute-form",
+			request:  "GET http://example.com/foo HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			dest:     EncodeRemoteAddr("example.com", 80, false),
+			origin:   OriginAbsoluteURI,
+			replayed: "GET /foo HTTP/1.1",
+		},
+		{
+			name:       "authority-form",
+			request:    "CONNECT example.com:8443 HTTP/1.1\r\nHost: example.com:8443\r\n\r\n",
+			statusCode: 200,
+			dest:       EncodeRemoteAddr("example.com", 8443, false),
+			origin:     OriginConnect,
+			replayed:   "GET /tunneled HTTP/1.1",
+		},
+		{
+			name:       "authority-form without port",
+			request:    "CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			statusCode: 200,
+			dest:       EncodeRemoteAddr("example.com", 443, false),
+			origin:     OriginConnect,
+			replayed:   "GET /tunneled HTTP/1.1",
+		},
+		{
+			name:       "authority-form with IPv6 literal",
+			request:    "CONNECT [2001:db8::1]:8443 HTTP/1.1\r\nHost: [2001:db8::1]:8443\r\n\r\n",
+			statusCode: 200,
+			dest:       EncodeRemoteAddr("2001:db8::1", 8443, false),
+			origin:     OriginConnect,
+			replayed:   "GET /tunneled HTTP/1.1",
+		},
+		{
+			name:       "authority-form with IPv6 literal without port",
+			request:    "CONNECT [2001:db8::1] HTTP/1.1\r\nHost: [2001:db8::1]\r\n\r\n",
+			statusCode: 200,
+			dest:       EncodeRemoteAddr("2001:db8::1", 443, false),
+			origin:     OriginConnect,
+			replayed:   "GET /tunneled HTTP/1.1",
+		},
+		{
+			name:       "authority-form with invalid port",
+			request:    "CONNECT example.com:https HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			statusCode: 400,
+		},
+		{
+			name:       "authority-form without CONNECT",
+			request:    "GET example.com:80 HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			statusCode: 400,
+		},
+		{
+			name:     "asterisk-form",
+			request:  "OPTIONS * HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			dest:     EncodeRemoteAddr("example.com", 80, false),
+			origin:   OriginHostHeader,
+			replayed: "OPTIONS * HTTP/1.1",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := testDial(t, addr)
+			defer c.Close()
+			r := bufio.NewReader(c)
+			c.Write([]byte(test.request))
+
+			if test.statusCode != 0 {
+				rsp, err := http.ReadResponse(r, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rsp.StatusCode != test.statusCode {
+					t.Fatalf("expected status %d, got %d", test.statusCode, rsp.StatusCode)
+				}
+				if rsp.StatusCode != 200 {
+					return
+				}
+				c.Write([]byte("GET /tunneled HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+			}
+
+			pconn := testAccept(t, plistener)
+			checkStr(t, pconn.RemoteAddr().String(), test.dest)
+			checkStr(t, pconn.OriginKind().String(), test.origin.String())
+			line, err := bufio.NewReader(pconn).ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkStr(t, strings.TrimSpace(line), test.replayed)
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package puppy
+
+/*
+Looking up the addresses of destinations with a resolver other than the system one
+*/
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long the addresses returned by a ResolverFunc are reused for
+const resolverCacheTTL = 30 * time.Second
+
+// The most hostnames whose addresses are cached at once
+const maxResolverCacheEntries = 1024
+
+// ResolverFunc looks up the addresses of a hostname. The LookupIPAddr method of a *net.Resolver can be used as one
+type ResolverFunc func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+// A cached lookup
+type resolvedHost struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+// SetResolver sets the function used to look up the addresses of destinations that are hostnames when DialUpstream, Dialer, tunnels, and Repeat connect to them. Successful lookups are cached for 30 seconds. The hostname is still used as the server name for TLS. If nil, the system resolver is used
+func (listener *ProxyListener) SetResolver(resolver ResolverFunc) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.resolver = resolver
+	listener.resolved = nil
+}
+
+func (listener *ProxyListener) getResolver() ResolverFunc {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.resolver
+}
+
+// Look up a hostname with the resolver, using a cached result if there is a fresh one
+func (listener *ProxyListener) resolve(ctx context.Context, resolver ResolverFunc, host string) ([]net.IPAddr, error) {
+	key := strings.ToLower(host)
+	listener.mtx.Lock()
+	cached, ok := listener.resolved[key]
+	listener.mtx.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.addrs, nil
+	}
+
+	addrs, err := resolver(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+	if listener.resolved == nil {
+		listener.resolved = make(map[string]resolvedHost)
+	}
+	if len(listener.resolved) >= maxResolverCacheEntries {
+		now := time.Now()
+		for h, entry := range listener.resolved {
+			if now.After(entry.expires) {
+				delete(listener.resolved, h)
+			}
+		}
+		if len(listener.resolved) >= maxResolverCacheEntries {
+			listener.resolved = make(map[string]resolvedHost)
+		}
+	}
+	listener.resolved[key] = resolvedHost{addrs: addrs, expires: time.Now().Add(resolverCacheTTL)}
+	return addrs, nil
+}
+
+// Connect to a destination, looking up hostnames with the resolver if one is set. Each address is tried in turn until one connects
+func (listener *ProxyListener) dialResolved(ctx context.Context, network string, host string, port int) (net.Conn, error) {
+	var dialer net.Dialer
+	resolver := listener.getResolver()
+	if resolver == nil || net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return dialer.DialContext(ctx, network, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+
+	addrs, err := listener.resolve(ctx, resolver, host)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve %s: %s", host, err)
+	}
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), strconv.Itoa(port)))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,66 @@
+package puppy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestResolver(t *testing.T) {
+	server := newTestUpstreamServer(t)
+	plistener := NewProxyListener(nil)
+	defer plistener.Close()
+
+	var lookups int32
+	plistener.SetResolver(func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		atomic.AddInt32(&lookups, 1)
+		if host != "upstream.test" {
+			return nil, errors.New("no such host")
+		}
+		// The first address refuses connections so the next one has to be tried
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.2")}, {IP: net.ParseIP(server.host)}}, nil
+	})
+
+	for i := 0; i < 2; i++ {
+		conn, err := plistener.DialUpstream("upstream.test", server.port, false)
+		testErr(t, err)
+		testEcho(t, conn)
+		conn.Close()
+	}
+	if n := atomic.LoadInt32(&lookups); n != 1 {
+		t.Errorf("expected the lookup to be cached, got %d lookups", n)
+	}
+
+	// Stale results are looked up again
+	plistener.mtx.Lock()
+	plistener.resolved["upstream.test"] = resolvedHost{addrs: []net.IPAddr{{IP: net.ParseIP("127.0.0.2")}}}
+	plistener.mtx.Unlock()
+	conn, err := plistener.DialUpstream("upstream.test", server.port, false)
+	testErr(t, err)
+	conn.Close()
+	if n := atomic.LoadInt32(&lookups); n != 2 {
+		t.Errorf("expected an expired lookup to be redone, got %d lookups", n)
+	}
+
+	if _, err := plistener.DialUpstream("missing.test", server.port, false); err == nil {
+		t.Error("expected an error dialing a host the resolver doesn't know")
+	}
+
+	// Addresses are used as-is
+	conn, err = plistener.DialUpstream(server.host, server.port, false)
+	testErr(t, err)
+	conn.Close()
+	if n := atomic.LoadInt32(&lookups); n != 3 {
+		t.Errorf("expected IP addresses not to be looked up, got %d lookups", n)
+	}
+
+	// Setting a new resolver forgets cached results
+	plistener.SetResolver(func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return nil, errors.New("resolver is down")
+	})
+	if _, err := plistener.DialUpstream("upstream.test", server.port, false); err == nil {
+		t.Error("expected a cached result from the previous resolver not to be used")
+	}
+}
@@ -0,0 +1,85 @@
+package puppy
+
+/*
+Answering requests at the listener without producing a ProxyConn
+*/
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// Responder is a function that can answer a request on behalf of the listener. If it returns true, the returned response is written to the client and the request does not produce a ProxyConn
+type Responder func(req *http.Request, pc ProxyConn) (*http.Response, bool)
+
+// Pass a request to the responder. Returns whether the responder wrote a response to the client
+func (listener *ProxyListener) respond(pconn *proxyConn, req *http.Request) (handled bool, err error) {
+	responder := listener.getResponder()
+	if responder == nil {
+		return false, nil
+	}
+
+	var resp *http.Response
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("responder panicked: %v", r)
+			}
+		}()
+		resp, handled = responder(req, pconn)
+	}()
+	if err != nil {
+		listener.logger.Println("Error in responder for connection", pconn.Id(), ":", err)
+		return false, err
+	}
+	if !handled {
+		return false, nil
+	}
+	if resp == nil {
+		return true, fmt.Errorf("responder handled request without returning a response")
+	}
+
+	if resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if resp.ProtoMajor == 0 {
+		resp.Proto = "HTTP/1.1"
+		resp.ProtoMajor = 1
+		resp.ProtoMinor = 1
+	}
+	if resp.Request == nil {
+		resp.Request = req
+	}
+
+	// Make sure the request body doesn't get mistaken for the next request
+	if req.Body != nil {
+		io.Copy(ioutil.Discard, req.Body)
+		req.Body.Close()
+	}
+
+	if err := resp.Write(pconn); err != nil {
+		return true, fmt.Errorf("could not write responder response: %s", err)
+	}
+	if resp.Close {
+		req.Close = true
+	}
+	listener.logConnf(pconn, "Connection %d answered by responder", pconn.Id())
+	return true, nil
+}
+
+// SetResponder sets a function which is given the first request of each connection (and each following request on a kept-alive connection) before a ProxyConn is created for it. If the responder returns a response and true, the response is written to the client instead and no ProxyConn is created for the request. If a connection was made with CONNECT, the responder is given the first request sent through the tunnel. Set to nil to disable.
+func (listener *ProxyListener) SetResponder(responder Responder) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.responder = responder
+}
+
+func (listener *ProxyListener) getResponder() Responder {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.responder
+}
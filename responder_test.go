@@ -0,0 +1,65 @@
+package puppy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestResponder(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	plistener.SetResponder(func(req *http.Request, pc ProxyConn) (*http.Response, bool) {
+		switch req.URL.Host {
+		case "blocked.example":
+			return textResponse(403, "blocked"), true
+		case "panic.example":
+			panic("responder failure")
+		}
+		return nil, false
+	})
+
+	// Answered requests keep the connection alive until a request is not handled
+	c := testDial(t, addr)
+	defer c.Close()
+	r := bufio.NewReader(c)
+	c.Write([]byte("GET http://blocked.example/ HTTP/1.1\r\nHost: blocked.example\r\n\r\n"))
+	rsp, err := http.ReadResponse(r, nil)
+	testErr(t, err)
+	body, _ := ioutil.ReadAll(rsp.Body)
+	if rsp.StatusCode != 403 || string(body) != "blocked" {
+		t.Errorf("unexpected responder response: %d %s", rsp.StatusCode, body)
+	}
+
+	c.Write([]byte("GET http://allowed.example:8080/ HTTP/1.1\r\nHost: allowed.example:8080\r\n\r\n"))
+	pconn := testAccept(t, plistener)
+	host, port, useTLS, err := DecodeRemoteAddr(pconn.RemoteAddr().String())
+	testErr(t, err)
+	if host != "allowed.example" || port != 8080 || useTLS {
+		t.Errorf("unexpected destination %s", pconn.RemoteAddr().String())
+	}
+	req, err := http.ReadRequest(bufio.NewReader(pconn))
+	testErr(t, err)
+	if req.Host != "allowed.example:8080" {
+		t.Errorf("unexpected returned request for %s", req.Host)
+	}
+
+	// A panicking responder closes the connection without taking down the listener
+	c2 := testDial(t, addr)
+	defer c2.Close()
+	c2.Write([]byte("GET http://panic.example/ HTTP/1.1\r\nHost: panic.example\r\n\r\n"))
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := c2.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Error("connection was not closed after responder panic")
+	}
+
+	c3 := testDial(t, addr)
+	defer c3.Close()
+	c3.Write([]byte("GET http://blocked.example/ HTTP/1.0\r\n\r\n"))
+	rsp, err = http.ReadResponse(bufio.NewReader(c3), nil)
+	testErr(t, err)
+	if rsp.StatusCode != 403 {
+		t.Errorf("unexpected status %d after responder panic", rsp.StatusCode)
+	}
+}
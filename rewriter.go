@@ -0,0 +1,38 @@
+package puppy
+
+/*
+Sending connections somewhere other than where the client asked
+*/
+
+// DestinationRewriter maps the destination a client asked for to the destination the connection should actually go to
+type DestinationRewriter func(host string, port int) (string, int)
+
+// SetDestinationRewriter sets a function that changes the destination of CONNECT requests and plaintext requests. Certificates used to strip TLS are still made for the host the client asked for so that it can validate them. Destinations of transparent listeners are never rewritten. Passing nil stops rewriting
+func (listener *ProxyListener) SetDestinationRewriter(rewriter DestinationRewriter) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.destRewriter = rewriter
+}
+
+func (listener *ProxyListener) getDestinationRewriter() DestinationRewriter {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.destRewriter
+}
+
+// Apply the destination rewriter if one is set
+func (listener *ProxyListener) rewriteDest(host string, port int) (string, int) {
+	if rewriter := listener.getDestinationRewriter(); rewriter != nil {
+		return rewriter(host, port)
+	}
+	return host, port
+}
+
+func (pconn *proxyConn) CertHost() string {
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+
+	return pconn.certHost
+}
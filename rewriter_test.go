@@ -0,0 +1,47 @@
+package puppy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDestinationRewriter(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+	plistener.SetCACertificate(testCA(t))
+	plistener.SetDestinationRewriter(func(host string, port int) (string, int) {
+		if host == "public.example" {
+			return "10.0.0.5", port + 8000
+		}
+		return host, port
+	})
+
+	conns := testAcceptAsync(plistener)
+	tlsc, err := testConnectTLS(t, addr, "public.example:443", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsc.Close()
+	checkStr(t, strings.Join(tlsc.ConnectionState().PeerCertificates[0].DNSNames, ","), "public.example")
+
+	var pconn ProxyConn
+	select {
+	case pconn = <-conns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for connection")
+	}
+	checkStr(t, pconn.CertHost(), "public.example")
+	host, port, useTLS := pconn.Destination()
+	checkStr(t, EncodeRemoteAddr(host, port, useTLS), EncodeRemoteAddr("10.0.0.5", 8443, true))
+	checkStr(t, pconn.RemoteAddr().String(), EncodeRemoteAddr("10.0.0.5", 8443, true))
+
+	// Plaintext requests are rewritten too but have no certificate
+	c := testDial(t, addr)
+	defer c.Close()
+	c.Write([]byte("GET http://public.example/ HTTP/1.1\r\nHost: public.example\r\n\r\n"))
+	pconn = testAccept(t, plistener)
+	checkStr(t, pconn.CertHost(), "")
+	host, port, useTLS = pconn.Destination()
+	checkStr(t, EncodeRemoteAddr(host, port, useTLS), EncodeRemoteAddr("10.0.0.5", 8080, false))
+}
@@ -0,0 +1,157 @@
+package puppy
+
+/*
+Shutting down a ProxyListener within a bounded amount of time
+*/
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Matches a *CloseTimeoutError with errors.Is
+const ErrCloseTimeout = ConstErr("ProxyListener did not shut down in time")
+
+// CloseTimeoutError is returned by CloseTimeout when the ProxyListener did not shut down in time. The counts are of what was still running when the time ran out, all of which was closed before returning
+type CloseTimeoutError struct {
+	// How long CloseTimeout waited
+	Timeout time.Duration
+
+	// Listener and translator goroutines that had not stopped
+	Goroutines int
+
+	// Connections that were still being translated, including ones being tunneled
+	Translating int
+
+	// Connections that had been returned by Accept and not closed
+	ActiveConns int
+}
+
+func (e *CloseTimeoutError) Error() string {
+	return fmt.Sprintf("ProxyListener did not shut down within %s: %d goroutines, %d connections being translated, and %d active connections remained", e.Timeout, e.Goroutines, e.Translating, e.ActiveConns)
+}
+
+func (e *CloseTimeoutError) Is(target error) bool {
+	return target == ErrCloseTimeout
+}
+
+// CloseTimeout closes the ProxyListener like Close but also waits for connections that are being translated or tunneled to finish. If everything hasn't stopped within the timeout, every remaining connection is closed, including ones returned by Accept, and a *CloseTimeoutError is returned without waiting any longer. Done is closed once everything has stopped
+func (listener *ProxyListener) CloseTimeout(timeout time.Duration) error {
+	removed, ok := listener.beginClose()
+	if !ok {
+		return nil
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		listener.listenWg.Wait()
+		listener.translating.wait()
+		close(stopped)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-stopped:
+		listener.finishClose(removed)
+		return nil
+	case <-timer.C:
+	}
+
+	active := listener.ActiveConns()
+	err := &CloseTimeoutError{
+		Timeout:     timeout,
+		Goroutines:  int(atomic.LoadInt32(&listener.running)),
+		Translating: listener.translating.closeAll(),
+		ActiveConns: len(active),
+	}
+	for _, pconn := range active {
+		pconn.Close()
+	}
+	listener.logger.Println(err)
+	go func() {
+		<-stopped
+		listener.finishClose(removed)
+	}()
+	return err
+}
+
+// Count a listener or translator goroutine that Close waits for
+func (listener *ProxyListener) startGoroutine() {
+	atomic.AddInt32(&listener.running, 1)
+	listener.listenWg.Add(1)
+}
+
+func (listener *ProxyListener) goroutineDone() {
+	atomic.AddInt32(&listener.running, -1)
+	listener.listenWg.Done()
+}
+
+// The client connections being translated. Has its own lock since the translator can't take the listener's lock while Close holds it
+type translations struct {
+	mtx   sync.Mutex
+	conns map[net.Conn]struct{}
+	// Signaled whenever a translation finishes
+	cond *sync.Cond
+}
+
+// Must be called while holding the lock
+func (t *translations) init() {
+	if t.conns == nil {
+		t.conns = make(map[net.Conn]struct{})
+		t.cond = sync.NewCond(&t.mtx)
+	}
+}
+
+func (t *translations) add(c net.Conn) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.init()
+	t.conns[c] = struct{}{}
+}
+
+func (t *translations) done(c net.Conn) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	delete(t.conns, c)
+	t.cond.Broadcast()
+}
+
+// Wait until no connections are being translated
+func (t *translations) wait() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.init()
+	for len(t.conns) > 0 {
+		t.cond.Wait()
+	}
+}
+
+// Whether no connections are being translated
+func (t *translations) idle() bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return len(t.conns) == 0
+}
+
+// Close the client connection of every translation. Returns how many there were
+func (t *translations) closeAll() int {
+	t.mtx.Lock()
+	conns := make([]net.Conn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mtx.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+	return len(conns)
+}
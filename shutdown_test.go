@@ -0,0 +1,61 @@
+package puppy
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestCloseTimeout(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+
+	// Never sends anything so its translation is stuck waiting for the first byte
+	stuck := testDial(t, addr)
+	defer stuck.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	err := plistener.CloseTimeout(100 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("CloseTimeout took %s", elapsed)
+	}
+	if !errors.Is(err, ErrCloseTimeout) {
+		t.Fatalf("expected a close timeout error, got %v", err)
+	}
+	var timeoutErr *CloseTimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Translating != 1 {
+		t.Errorf("expected 1 connection being translated: %v", err)
+	}
+
+	stuck.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(stuck); err != nil {
+		t.Errorf("stuck connection was not closed: %s", err)
+	}
+	select {
+	case <-plistener.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("ProxyListener did not finish shutting down after the timeout")
+	}
+	if err := plistener.CloseTimeout(time.Second); err != nil {
+		t.Errorf("expected closing again to do nothing, got %s", err)
+	}
+}
+
+func TestCloseTimeoutIdle(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	c := testDial(t, addr)
+	c.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	pconn := testAccept(t, plistener)
+	pconn.Close()
+	c.Close()
+
+	if err := plistener.CloseTimeout(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-plistener.Done():
+	default:
+		t.Error("Done was not closed")
+	}
+}
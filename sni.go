@@ -0,0 +1,113 @@
+package puppy
+
+/*
+Comparing the server name a client asks for in its TLS handshake with the host it sent a CONNECT request for
+*/
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// SNIMismatchPolicy is what a listener does when the server name in a client's TLS handshake does not match the host of its CONNECT request, as happens with domain fronting
+type SNIMismatchPolicy int
+
+const (
+	// Strip TLS with a certificate for the CONNECT host and keep it as the destination
+	SNIMismatchAllow SNIMismatchPolicy = iota
+	// Fail the handshake and close the connection
+	SNIMismatchBlock
+	// Strip TLS with a certificate for the server name and use it as the destination host
+	SNIMismatchUseSNI
+)
+
+// SetSNIMismatchPolicy sets what happens when the server name a client sends while starting TLS in a CONNECT tunnel does not match the CONNECT host. Every mismatch sends an EventSNIMismatch event regardless of the policy. Handshakes without a server name never mismatch. With any policy other than SNIMismatchAllow, the TLS handshake is finished before the ProxyConn is produced so that its destination is known
+func (listener *ProxyListener) SetSNIMismatchPolicy(policy SNIMismatchPolicy) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.sniPolicy = policy
+}
+
+func (listener *ProxyListener) getSNIMismatchPolicy() SNIMismatchPolicy {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.sniPolicy
+}
+
+// Check the server name of a TLS connection from a CONNECT tunnel against the CONNECT host once TLS is started
+func (listener *ProxyListener) watchSNI(pconn *proxyConn, host string, port int) {
+	policy := listener.getSNIMismatchPolicy()
+
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+	pconn.sniPolicy = policy
+	pconn.onSNIMismatch = func(sni string) {
+		listener.logConnf(pconn, "Connection %d sent server name %q in a tunnel to %s", pconn.Id(), sni, host)
+		listener.emitEventFor(pconn, ProxyEvent{
+			Kind:   EventSNIMismatch,
+			Detail: sni,
+			Host:   host,
+			Port:   port,
+		})
+	}
+}
+
+// Finish the TLS handshake if the SNI policy needs to know the server name before the connection is produced. Returns the destination host to use
+func (listener *ProxyListener) applySNIPolicy(pconn *proxyConn, host string) (string, error) {
+	pconn.mtx.Lock()
+	policy := pconn.sniPolicy
+	tlsConn, ok := pconn.conn.(*tls.Conn)
+	pconn.mtx.Unlock()
+	if policy == SNIMismatchAllow || !ok {
+		return host, nil
+	}
+
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+	sni := tlsConn.ConnectionState().ServerName
+	if policy == SNIMismatchUseSNI && sniMismatch(host, sni) {
+		return sni, nil
+	}
+	return host, nil
+}
+
+// Whether a server name does not refer to the given host
+func sniMismatch(host, sni string) bool {
+	if sni == "" {
+		return false
+	}
+	return !strings.EqualFold(strings.TrimSuffix(host, "."), strings.TrimSuffix(sni, "."))
+}
+
+// Handle the server name a client sent for a connection that TLS is being stripped from. Returns the config to use for the handshake, or nil to use the default one
+func (pconn *proxyConn) checkSNI(hello *tls.ClientHelloInfo, hostname string) (*tls.Config, error) {
+	pconn.mtx.Lock()
+	policy := pconn.sniPolicy
+	onMismatch := pconn.onSNIMismatch
+	pconn.mtx.Unlock()
+	if onMismatch == nil || !sniMismatch(hostname, hello.ServerName) {
+		return nil, nil
+	}
+	onMismatch(hello.ServerName)
+
+	switch policy {
+	case SNIMismatchBlock:
+		return nil, fmt.Errorf("server name %q does not match CONNECT host %q", hello.ServerName, hostname)
+	case SNIMismatchUseSNI:
+		pconn.mtx.Lock()
+		defer pconn.mtx.Unlock()
+		cert, err := pconn.signCert(hello.ServerName)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{cert},
+		}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,75 @@
+package puppy
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSNIMismatchPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   SNIMismatchPolicy
+		sni      string
+		mismatch bool
+		blocked  bool
+		certHost string
+		destHost string
+	}{
+		{name: "matching", policy: SNIMismatchBlock, sni: "front.example", certHost: "front.example", destHost: "front.example"},
+		{name: "no sni", policy: SNIMismatchBlock, sni: "", certHost: "front.example", destHost: "front.example"},
+		{name: "allow", policy: SNIMismatchAllow, sni: "hidden.example", mismatch: true, certHost: "front.example", destHost: "front.example"},
+		{name: "block", policy: SNIMismatchBlock, sni: "hidden.example", mismatch: true, blocked: true},
+		{name: "use sni", policy: SNIMismatchUseSNI, sni: "hidden.example", mismatch: true, certHost: "hidden.example", destHost: "hidden.example"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plistener, addr := testProxyListener(t)
+			defer plistener.Close()
+			plistener.SetCACertificate(testCA(t))
+			plistener.SetSNIMismatchPolicy(test.policy)
+			events := make(chan ProxyEvent, 1)
+			plistener.SetEventHandler(func(e ProxyEvent) {
+				if e.Kind == EventSNIMismatch {
+					events <- e
+				}
+			})
+
+			conns := testAcceptAsync(plistener)
+			tlsc, err := testConnectTLS(t, addr, "front.example:443", &tls.Config{ServerName: test.sni, InsecureSkipVerify: true})
+			if test.blocked {
+				if err == nil {
+					tlsc.Close()
+					t.Fatal("expected handshake to fail")
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer tlsc.Close()
+				checkStr(t, strings.Join(tlsc.ConnectionState().PeerCertificates[0].DNSNames, ","), test.certHost)
+				select {
+				case pconn := <-conns:
+					checkStr(t, pconn.RemoteAddr().String(), EncodeRemoteAddr(test.destHost, 443, true))
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for connection")
+				}
+			}
+
+			select {
+			case e := <-events:
+				if !test.mismatch {
+					t.Fatalf("unexpected mismatch event for server name %q", e.Detail)
+				}
+				checkStr(t, e.Detail, test.sni)
+				checkStr(t, e.Host, "front.example")
+			default:
+				if test.mismatch {
+					t.Fatal("expected mismatch event")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package puppy
+
+/*
+Stripping TLS from plaintext protocols that upgrade to TLS with a STARTTLS command
+*/
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+// StartTLSProto is a plaintext protocol whose STARTTLS exchange can be watched for
+type StartTLSProto int
+
+const (
+	// Don't watch for STARTTLS
+	StartTLSNone StartTLSProto = iota
+	// SMTP (RFC 3207). The client sends STARTTLS and the server replies with 220
+	StartTLSSMTP
+	// IMAP (RFC 3501). The client sends a tagged STARTTLS command and the server replies with a tagged OK
+	StartTLSIMAP
+	// XMPP (RFC 6120). The client sends a starttls element and the server replies with a proceed element
+	StartTLSXMPP
+)
+
+// The longest line or element kept while watching for a STARTTLS exchange. Longer ones are skipped
+const maxStartTLSLine = 4096
+
+func (p StartTLSProto) String() string {
+	switch p {
+	case StartTLSSMTP:
+		return "smtp"
+	case StartTLSIMAP:
+		return "imap"
+	case StartTLSXMPP:
+		return "xmpp"
+	}
+	return "none"
+}
+
+// SetStartTLSProtocol sets the protocol spoken on a port so that TLS can be stripped after a STARTTLS exchange. Connections to the port from transparent listeners or CONNECT tunnels are accepted as ProtocolUnknown without waiting for the client to send data. Once the server accepts the client's STARTTLS command, an EventStartTLS event is sent and the next Read strips TLS if the client starts a handshake. Whatever relays the connection is responsible for starting TLS with the server. Passing StartTLSNone stops watching the port
+func (listener *ProxyListener) SetStartTLSProtocol(port int, proto StartTLSProto) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	if proto == StartTLSNone {
+		delete(listener.startTLSPorts, port)
+		return
+	}
+	if listener.startTLSPorts == nil {
+		listener.startTLSPorts = make(map[int]StartTLSProto)
+	}
+	listener.startTLSPorts[port] = proto
+}
+
+func (listener *ProxyListener) getStartTLSProtocol(port int) StartTLSProto {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.startTLSPorts[port]
+}
+
+// Start watching a connection for STARTTLS if its destination port is configured for it and accept it as ProtocolUnknown. Returns false if the port is not configured
+func (listener *ProxyListener) watchStartTLS(pconn *proxyConn, port int) bool {
+	proto := listener.getStartTLSProtocol(port)
+	if proto == StartTLSNone {
+		return false
+	}
+	watcher := &startTLSWatcher{
+		proto: proto,
+		onAccepted: func() {
+			listener.emitEvent(EventStartTLS, pconn, proto.String())
+		},
+	}
+
+	pconn.mtx.Lock()
+	pconn.protocol = ProtocolUnknown
+	pconn.tlsUpgrade = watcher
+	pconn.mtx.Unlock()
+	return true
+}
+
+// Follows the plaintext part of a connection to find out when the client and server have agreed to start TLS
+type startTLSWatcher struct {
+	mtx        sync.Mutex
+	proto      StartTLSProto
+	onAccepted func()
+
+	fromClient []byte
+	fromServer []byte
+	requested  bool
+	tag        string // The tag of an IMAP STARTTLS command
+	accepted   bool
+}
+
+// Split complete lines, or elements for XMPP, off the front of a buffer. Returns the remaining partial data
+func (w *startTLSWatcher) split(buf []byte, data []byte, each func(string)) []byte {
+	end := byte('\n')
+	if w.proto == StartTLSXMPP {
+		end = '>'
+	}
+	buf = append(buf, data...)
+	for {
+		idx := bytes.IndexByte(buf, end)
+		if idx < 0 {
+			break
+		}
+		each(strings.TrimSpace(string(buf[:idx+1])))
+		buf = buf[idx+1:]
+	}
+	if len(buf) > maxStartTLSLine {
+		return nil
+	}
+	// Copy so the buffer doesn't keep the caller's slice alive
+	return append([]byte(nil), buf...)
+}
+
+// Look at data sent by the client
+func (w *startTLSWatcher) clientData(data []byte) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.accepted {
+		return
+	}
+	w.fromClient = w.split(w.fromClient, data, func(line string) {
+		switch w.proto {
+		case StartTLSSMTP:
+			if strings.EqualFold(line, "STARTTLS") {
+				w.requested = true
+			}
+		case StartTLSIMAP:
+			if fields := strings.Fields(line); len(fields) == 2 && strings.EqualFold(fields[1], "STARTTLS") {
+				w.requested = true
+				w.tag = fields[0]
+			}
+		case StartTLSXMPP:
+			if strings.Contains(line, "<starttls") {
+				w.requested = true
+			}
+		}
+	})
+}
+
+// Look at data sent to the client by the server. Returns true once the server has accepted the client's STARTTLS command
+func (w *startTLSWatcher) serverData(data []byte) bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.accepted {
+		return false
+	}
+	w.fromServer = w.split(w.fromServer, data, func(line string) {
+		if !w.requested || w.accepted {
+			return
+		}
+		switch w.proto {
+		case StartTLSSMTP:
+			if len(line) > 3 && line[3] == '-' {
+				// Only the last line of a multiline reply counts
+				return
+			}
+			w.accepted = strings.HasPrefix(line, "220")
+		case StartTLSIMAP:
+			fields := strings.Fields(line)
+			if len(fields) < 2 || fields[0] != w.tag {
+				// Untagged responses can come before the tagged one
+				return
+			}
+			w.accepted = strings.EqualFold(fields[1], "OK")
+		case StartTLSXMPP:
+			if strings.Contains(line, "<proceed") {
+				w.accepted = true
+			} else if !strings.Contains(line, "<failure") {
+				return
+			}
+		}
+		w.requested = w.accepted
+	})
+	return w.accepted
+}
+
+// Whether the server has accepted STARTTLS and the connection should be stripped on the next read
+func (w *startTLSWatcher) ready() bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	return w.accepted
+}
+
+func (pconn *proxyConn) getTLSUpgrade() *startTLSWatcher {
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+
+	return pconn.tlsUpgrade
+}
+
+// Wait for data from the client and strip TLS if the server has accepted STARTTLS by the time it arrives
+func (pconn *proxyConn) maybeUpgradeTLS(watcher *startTLSWatcher) error {
+	if _, err := pconn.buffered().Peek(1); err != nil {
+		// Let the read report the error
+		return nil
+	}
+	if !watcher.ready() {
+		return nil
+	}
+
+	pconn.mtx.Lock()
+	pconn.tlsUpgrade = nil
+	host := pconn.Addr.Host
+	pconn.mtx.Unlock()
+	_, err := pconn.StartMaybeTLS(host)
+	return err
+}
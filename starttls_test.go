@@ -0,0 +1,123 @@
+package puppy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartTLSWatcher(t *testing.T) {
+	tests := []struct {
+		name     string
+		proto    StartTLSProto
+		exchange []string // Alternates between client and server data
+		accepted bool
+	}{
+		{
+			name:     "smtp",
+			proto:    StartTLSSMTP,
+			exchange: []string{"EHLO x\r\n", "250-mock\r\n250 STARTTLS\r\n", "STARTTLS\r\n", "220 2.0.0 Ready\r\n"},
+			accepted: true,
+		},
+		{
+			name:     "smtp refused",
+			proto:    StartTLSSMTP,
+			exchange: []string{"STARTTLS\r\n", "454 TLS not available\r\n", "EHLO x\r\n", "220 not a reply to starttls\r\n"},
+		},
+		{
+			name:     "smtp before starttls",
+			proto:    StartTLSSMTP,
+			exchange: []string{"EHLO x\r\n", "220 mock\r\n"},
+		},
+		{
+			name:     "imap",
+			proto:    StartTLSIMAP,
+			exchange: []string{"a1 STARTTLS\r\n", "* untagged\r\na1 OK Begin TLS\r\n"},
+			accepted: true,
+		},
+		{
+			name:     "imap refused",
+			proto:    StartTLSIMAP,
+			exchange: []string{"a1 STARTTLS\r\n", "a1 BAD no\r\n"},
+		},
+		{
+			name:     "xmpp split across writes",
+			proto:    StartTLSXMPP,
+			exchange: []string{"<starttls xmlns=", "", "'urn:ietf:params:xml:ns:xmpp-tls'/>", "<proceed xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>"},
+			accepted: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := &startTLSWatcher{proto: test.proto}
+			for i, data := range test.exchange {
+				if i%2 == 0 {
+					w.clientData([]byte(data))
+				} else {
+					w.serverData([]byte(data))
+				}
+			}
+			if w.ready() != test.accepted {
+				t.Errorf("expected accepted=%v, got %v", test.accepted, w.ready())
+			}
+		})
+	}
+}
+
+func TestStartTLSSMTP(t *testing.T) {
+	plistener := NewProxyListener(nil)
+	plistener.SetCACertificate(testCA(t))
+	plistener.SetStartTLSProtocol(25, StartTLSSMTP)
+	events := make(chan ProxyEvent, 1)
+	plistener.SetEventHandler(func(e ProxyEvent) {
+		events <- e
+	})
+	addr := testTransparentListener(t, plistener, "mail.example", 25, false)
+
+	c := testDial(t, addr)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	client := bufio.NewReader(c)
+
+	// The server talks first so the connection has to be accepted before the client sends anything
+	pconn := testAccept(t, plistener)
+	if pconn.Protocol() != ProtocolUnknown {
+		t.Errorf("expected unknown protocol, got %s", pconn.Protocol())
+	}
+	server := bufio.NewReader(pconn)
+	expectLine := func(r *bufio.Reader, expected string) {
+		t.Helper()
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStr(t, strings.TrimSpace(line), expected)
+	}
+
+	pconn.Write([]byte("220 mail.example ESMTP\r\n"))
+	expectLine(client, "220 mail.example ESMTP")
+	c.Write([]byte("STARTTLS\r\n"))
+	expectLine(server, "STARTTLS")
+	pconn.Write([]byte("220 Ready to start TLS\r\n"))
+	expectLine(client, "220 Ready to start TLS")
+
+	select {
+	case e := <-events:
+		checkStr(t, e.Kind, EventStartTLS)
+		checkStr(t, e.Detail, "smtp")
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected starttls event")
+	}
+
+	tlsClient := tls.Client(c, &tls.Config{ServerName: "mail.example", InsecureSkipVerify: true})
+	go tlsClient.Write([]byte("EHLO client.example\r\n"))
+	expectLine(server, "EHLO client.example")
+	testErr(t, tlsClient.Handshake())
+	testErr(t, tlsClient.ConnectionState().PeerCertificates[0].VerifyHostname("mail.example"))
+	if !pconn.Info().TLSStripped {
+		t.Error("expected TLS to be stripped")
+	}
+}
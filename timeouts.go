@@ -0,0 +1,55 @@
+package puppy
+
+/*
+Limiting how long clients get to send the start of a connection
+*/
+
+import (
+	"net"
+	"time"
+)
+
+// SetPeekTimeout sets how long a client gets to send the first byte of a connection when it is peeked at to detect its protocol, such as the start of a ClientHello after CONNECT. It also limits how long transient errors while peeking are retried for, which is 10 seconds otherwise. Connections that time out are closed without being returned by Accept. Zero means no limit
+func (listener *ProxyListener) SetPeekTimeout(d time.Duration) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.peekTimeout = d
+}
+
+func (listener *ProxyListener) getPeekTimeout() time.Duration {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.peekTimeout
+}
+
+// SetRequestReadTimeout sets how long a client gets to send the header of each request the listener reads before handing the connection off, starting from when the listener starts waiting for it. Request bodies are read by whoever accepts the connection and aren't limited. Since the wait includes the time before the request starts, it also limits how long a kept-alive connection can be idle between requests. Zero means no limit
+func (listener *ProxyListener) SetRequestReadTimeout(d time.Duration) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.readTimeout = d
+}
+
+func (listener *ProxyListener) getRequestReadTimeout() time.Duration {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.readTimeout
+}
+
+// Set a read deadline timeout from now unless the deadline that was already set is sooner. Returns a function that puts the previous deadline back. Does nothing if timeout is zero
+func limitReadDeadline(conn net.Conn, prevDeadline time.Time, timeout time.Duration) func() {
+	if timeout <= 0 {
+		return func() {}
+	}
+	wait := time.Now().Add(timeout)
+	if !prevDeadline.IsZero() && prevDeadline.Before(wait) {
+		wait = prevDeadline
+	}
+	conn.SetReadDeadline(wait)
+	return func() {
+		conn.SetReadDeadline(prevDeadline)
+	}
+}
@@ -0,0 +1,112 @@
+package puppy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// Check that the proxy closes a connection within wait
+func testClosedWithin(t *testing.T, c net.Conn, wait time.Duration) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(wait))
+	_, err := io.Copy(io.Discard, c)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("connection was still open after %s", wait)
+	}
+}
+
+// Check that the proxy keeps a connection open for at least wait
+func testOpenFor(t *testing.T, c net.Conn, wait time.Duration) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(wait))
+	_, err := io.Copy(io.Discard, c)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("connection was closed before %s: %v", wait, err)
+	}
+	c.SetReadDeadline(time.Time{})
+}
+
+// Send a CONNECT and read its response without starting anything in the tunnel
+func testConnectStalled(t *testing.T, addr string) net.Conn {
+	c := testDial(t, addr)
+	fmt.Fprintf(c, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	rsp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	testErr(t, err)
+	if rsp.StatusCode != 200 {
+		t.Fatalf("unexpected CONNECT status %d", rsp.StatusCode)
+	}
+	return c
+}
+
+func TestPeekTimeout(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+	plistener.SetCACertificate(testCA(t))
+	plistener.SetPeekTimeout(200 * time.Millisecond)
+
+	c := testConnectStalled(t, addr)
+	defer c.Close()
+	testClosedWithin(t, c, 2*time.Second)
+}
+
+func TestPeekTimeoutIgnoresRequestReadTimeout(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+	plistener.SetCACertificate(testCA(t))
+	plistener.SetRequestReadTimeout(100 * time.Millisecond)
+
+	c := testConnectStalled(t, addr)
+	defer c.Close()
+	testOpenFor(t, c, 500*time.Millisecond)
+}
+
+func TestRequestReadTimeout(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+	plistener.SetRequestReadTimeout(200 * time.Millisecond)
+
+	c := testDial(t, addr)
+	defer c.Close()
+	fmt.Fprintf(c, "GET http://example.com/ HTTP/1.1\r\nHost: exa")
+	testClosedWithin(t, c, 2*time.Second)
+}
+
+func TestRequestReadTimeoutIgnoresPeekTimeout(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+	plistener.SetPeekTimeout(100 * time.Millisecond)
+
+	c := testDial(t, addr)
+	defer c.Close()
+	fmt.Fprintf(c, "GET http://example.com/ HTTP/1.1\r\nHost: exa")
+	testOpenFor(t, c, 500*time.Millisecond)
+}
+
+func TestRequestReadTimeoutAllowsSlowBody(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+	plistener.SetRequestReadTimeout(200 * time.Millisecond)
+
+	c := testDial(t, addr)
+	defer c.Close()
+	fmt.Fprintf(c, "POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\n")
+
+	pconn := testAccept(t, plistener)
+	defer pconn.Close()
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		fmt.Fprint(c, "body")
+	}()
+	req, err := http.ReadRequest(bufio.NewReader(pconn))
+	testErr(t, err)
+	body, err := io.ReadAll(req.Body)
+	testErr(t, err)
+	checkStr(t, string(body), "body")
+}
@@ -0,0 +1,20 @@
+package puppy
+
+/*
+Deciding from the destination port whether transparent connections are TLS
+*/
+
+// SetTLSByPort sets a function that decides whether connections to transparent listeners are TLS based on their destination port. If the function returns true, TLS is stripped from the connection, otherwise the connection is treated as plaintext. If no function is set (the default) TLS is stripped whenever it looks like the client is starting a TLS handshake. Either way, the destination of a connection TLS is stripped from uses TLS
+func (listener *ProxyListener) SetTLSByPort(tlsByPort func(port int) bool) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.tlsByPort = tlsByPort
+}
+
+func (listener *ProxyListener) getTLSByPort() func(port int) bool {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.tlsByPort
+}
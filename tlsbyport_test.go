@@ -0,0 +1,59 @@
+package puppy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net/http"
+	"testing"
+)
+
+func TestTLSByPort(t *testing.T) {
+	plistener := NewProxyListener(nil)
+	plistener.SetCACertificate(testCA(t))
+	plistener.SetTLSByPort(func(port int) bool {
+		return port == 443
+	})
+	tlsAddr := testTransparentListener(t, plistener, "secure.example", 443, true)
+	plainAddr := testTransparentListener(t, plistener, "plain.example", 80, false)
+
+	tlsc := tls.Client(testDial(t, tlsAddr), &tls.Config{InsecureSkipVerify: true})
+	defer tlsc.Close()
+	go tlsc.Write([]byte("GET /tls HTTP/1.1\r\nHost: secure.example\r\n\r\n"))
+	pconn := testAccept(t, plistener)
+	req, err := http.ReadRequest(bufio.NewReader(pconn))
+	testErr(t, err)
+	checkStr(t, req.URL.Path, "/tls")
+	checkStr(t, tlsc.ConnectionState().PeerCertificates[0].DNSNames[0], "secure.example")
+
+	c := testDial(t, plainAddr)
+	defer c.Close()
+	c.Write([]byte("GET /plain HTTP/1.1\r\nHost: plain.example\r\n\r\n"))
+	pconn = testAccept(t, plistener)
+	req, err = http.ReadRequest(bufio.NewReader(pconn))
+	testErr(t, err)
+	checkStr(t, req.URL.Path, "/plain")
+}
+
+func TestStrippedTransparentUsesTLS(t *testing.T) {
+	plistener := NewProxyListener(nil)
+	defer plistener.Close()
+	plistener.SetCACertificate(testCA(t))
+	addr := testTransparentListener(t, plistener, "example.com", 443, false)
+
+	tlsc := tls.Client(testDial(t, addr), &tls.Config{InsecureSkipVerify: true})
+	defer tlsc.Close()
+	go tlsc.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	pconn := testAccept(t, plistener)
+	defer pconn.Close()
+	if !pconn.Info().TLSStripped {
+		t.Fatal("expected TLS to be stripped")
+	}
+	checkStr(t, pconn.RemoteAddr().String(), EncodeRemoteAddr("example.com", 443, true))
+
+	c := testDial(t, addr)
+	defer c.Close()
+	c.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	plain := testAccept(t, plistener)
+	defer plain.Close()
+	checkStr(t, plain.RemoteAddr().String(), EncodeRemoteAddr("example.com", 443, false))
+}
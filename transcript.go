@@ -0,0 +1,138 @@
+package puppy
+
+/*
+Following everything that happens to a single connection in order
+*/
+
+import (
+	"math/bits"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kinds of ProxyEvent that are only sent to the transcript of the connection they are about and not to the handler set with SetEventHandler
+const (
+	// The listener accepted the client connection. The detail is the client's address
+	EventConnAccepted = "conn accepted"
+
+	// The listener read a request from the connection before handing it off. The detail is the method and request URI and the host is the one from the request
+	EventRequestParsed = "request parsed"
+
+	// TLS was stripped from the connection. The host is the one the certificate was signed for
+	EventTLSStripped = "tls stripped"
+
+	// The total number of bytes read from the ProxyConn reached a milestone. Sent for the first bytes and then each time the total doubles. The detail is the total
+	EventBytesRead = "bytes read"
+
+	// The same as EventBytesRead for bytes written to the ProxyConn
+	EventBytesWritten = "bytes written"
+
+	// The connection was closed. The detail is its CloseReason. Always the last event in a transcript
+	EventConnClosed = "conn closed"
+)
+
+// The most events a transcript holds before new ones are dropped, not counting the one for the connection being closed
+const maxTranscriptEvents = 256
+
+// The events that happened to one connection. Has its own lock so events can be recorded while the connection is locked
+type transcript struct {
+	mtx sync.Mutex
+	// Events recorded before anyone asked for the transcript. Most connections never have their transcript read so the channel is only made when it is
+	pending []ProxyEvent
+	events  chan ProxyEvent
+	done    bool
+}
+
+func newTranscript() *transcript {
+	return &transcript{}
+}
+
+// The number of events waiting to be received. Must be called while holding the lock
+func (t *transcript) queued() int {
+	if t.events == nil {
+		return len(t.pending)
+	}
+	// Only senders hold the lock so the length can shrink but not grow before a send
+	return len(t.events)
+}
+
+// Queue an event without blocking. Must be called while holding the lock
+func (t *transcript) push(event ProxyEvent) {
+	if t.events == nil {
+		t.pending = append(t.pending, t.stamp(event))
+		return
+	}
+	t.events <- t.stamp(event)
+}
+
+// Add an event to the transcript without blocking. The event is dropped if the transcript is full or finished
+func (t *transcript) record(event ProxyEvent) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.done || t.queued() >= maxTranscriptEvents {
+		return
+	}
+	t.push(event)
+}
+
+// Record that the connection was closed and close the channel. Only the first call does anything
+func (t *transcript) finish(connId int, reason string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.done {
+		return
+	}
+	t.push(ProxyEvent{Kind: EventConnClosed, ConnId: connId, Detail: reason})
+	t.done = true
+	if t.events != nil {
+		close(t.events)
+	}
+}
+
+// The channel events are received from. Made on the first call with the events recorded so far
+func (t *transcript) channel() <-chan ProxyEvent {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.events == nil {
+		// The extra slot is saved for EventConnClosed so a full transcript still ends with it
+		t.events = make(chan ProxyEvent, maxTranscriptEvents+1)
+		for _, event := range t.pending {
+			t.events <- event
+		}
+		t.pending = nil
+		if t.done {
+			close(t.events)
+		}
+	}
+	return t.events
+}
+
+func (t *transcript) stamp(event ProxyEvent) ProxyEvent {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	return event
+}
+
+// Record a byte count milestone if adding n bytes to the total made it reach one
+func (t *transcript) recordBytes(kind string, connId int, total int64, n int) {
+	prev := total - int64(n)
+	if n <= 0 || (prev > 0 && bits.Len64(uint64(prev)) == bits.Len64(uint64(total))) {
+		return
+	}
+	t.record(ProxyEvent{Kind: kind, ConnId: connId, Detail: strconv.FormatInt(total, 10)})
+}
+
+// Record a request the listener read from the connection
+func (pconn *proxyConn) recordRequest(req *http.Request) {
+	pconn.transcript.record(ProxyEvent{Kind: EventRequestParsed, ConnId: pconn.Id(), Detail: req.Method + " " + req.RequestURI, Host: req.Host})
+}
+
+func (pconn *proxyConn) Transcript() <-chan ProxyEvent {
+	return pconn.transcript.channel()
+}
@@ -0,0 +1,158 @@
+package puppy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Read a transcript until it is closed and return the kinds of events in it with repeats of the same kind collapsed
+func testTranscriptKinds(t *testing.T, events <-chan ProxyEvent) ([]string, []ProxyEvent) {
+	var kinds []string
+	var all []ProxyEvent
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return kinds, all
+			}
+			all = append(all, event)
+			if len(kinds) == 0 || kinds[len(kinds)-1] != event.Kind {
+				kinds = append(kinds, event.Kind)
+			}
+		case <-timeout:
+			t.Fatal("transcript was not closed")
+			return nil, nil
+		}
+	}
+}
+
+func TestTranscriptConnectTLS(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+	plistener.SetCACertificate(testCA(t))
+
+	served := make(chan ProxyConn, 1)
+	go func() {
+		c, err := plistener.Accept()
+		if err != nil {
+			return
+		}
+		pconn := c.(ProxyConn)
+		if req, err := http.ReadRequest(bufio.NewReader(pconn)); err == nil {
+			textResponse(200, "ok").Write(pconn)
+			req.Body.Close()
+		}
+		pconn.Close()
+		served <- pconn
+	}()
+
+	tlsc, err := testConnectTLS(t, addr, "example.com:443", nil)
+	testErr(t, err)
+	defer tlsc.Close()
+	fmt.Fprintf(tlsc, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	io.Copy(io.Discard, tlsc)
+
+	pconn := <-served
+	kinds, events := testTranscriptKinds(t, pconn.Transcript())
+	expected := []string{EventConnAccepted, EventRequestParsed, EventTLSStripped, EventBytesRead, EventBytesWritten, EventConnClosed}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Fatalf("expected transcript %v, got %v", expected, kinds)
+	}
+	for i, event := range events {
+		if event.ConnId != pconn.Id() {
+			t.Errorf("event %d is for connection %d instead of %d", i, event.ConnId, pconn.Id())
+		}
+		if i > 0 && event.Time.Before(events[i-1].Time) {
+			t.Errorf("event %d happened before the one ahead of it", i)
+		}
+	}
+	checkStr(t, events[1].Detail, "CONNECT example.com:443")
+	checkStr(t, events[2].Host, "example.com")
+	checkStr(t, events[len(events)-1].Detail, CloseReasonClosed)
+}
+
+func TestTranscriptIncludesConnEvents(t *testing.T) {
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+	plistener.SetCACertificate(testCA(t))
+	plistener.SetSNIMismatchPolicy(SNIMismatchAllow)
+
+	conns := testAcceptAsync(plistener)
+	tlsc, err := testConnectTLS(t, addr, "example.com:443", &tls.Config{InsecureSkipVerify: true, ServerName: "other.example.com"})
+	testErr(t, err)
+	tlsc.Close()
+
+	pconn := <-conns
+	pconn.Close()
+	kinds, _ := testTranscriptKinds(t, pconn.Transcript())
+	found := false
+	for _, kind := range kinds {
+		found = found || kind == EventSNIMismatch
+	}
+	if !found {
+		t.Errorf("expected an SNI mismatch event in transcript %v", kinds)
+	}
+}
+
+func TestTranscriptBounded(t *testing.T) {
+	tr := newTranscript()
+	for i := 0; i < maxTranscriptEvents*2; i++ {
+		tr.record(ProxyEvent{Kind: EventBytesRead})
+	}
+	tr.finish(1, CloseReasonClosed)
+	tr.finish(1, CloseReasonClosed)
+	tr.record(ProxyEvent{Kind: EventBytesRead})
+
+	_, events := testTranscriptKinds(t, tr.channel())
+	if len(events) != maxTranscriptEvents+1 {
+		t.Fatalf("expected %d events, got %d", maxTranscriptEvents+1, len(events))
+	}
+	checkStr(t, events[len(events)-1].Kind, EventConnClosed)
+}
+
+func TestTranscriptByteMilestones(t *testing.T) {
+	tr := newTranscript()
+	var total int64
+	for _, n := range []int{1, 1, 1, 1, 4, 100, 0} {
+		total += int64(n)
+		tr.recordBytes(EventBytesRead, 1, total, n)
+	}
+	tr.finish(1, CloseReasonClosed)
+
+	_, events := testTranscriptKinds(t, tr.channel())
+	var totals []string
+	for _, event := range events[:len(events)-1] {
+		totals = append(totals, event.Detail)
+	}
+	expected := []string{"1", "2", "4", "8", "108"}
+	if !reflect.DeepEqual(totals, expected) {
+		t.Fatalf("expected milestones %v, got %v", expected, totals)
+	}
+}
+
+func TestTranscriptAllocatedLazily(t *testing.T) {
+	tr := newTranscript()
+	tr.record(ProxyEvent{Kind: EventConnAccepted})
+	if tr.events != nil {
+		t.Fatal("channel was made before the transcript was asked for")
+	}
+	events := tr.channel()
+	tr.record(ProxyEvent{Kind: EventBytesRead})
+	tr.finish(1, CloseReasonClosed)
+	if tr.channel() != events {
+		t.Error("expected the same channel every time")
+	}
+
+	kinds, _ := testTranscriptKinds(t, events)
+	expected := []string{EventConnAccepted, EventBytesRead, EventConnClosed}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Fatalf("expected transcript %v, got %v", expected, kinds)
+	}
+}
@@ -0,0 +1,71 @@
+package puppy
+
+/*
+Changing where a transparent listener sends its connections
+*/
+
+import (
+	"net"
+)
+
+// Returned by SetTransparentDest when the ProxyListener doesn't have a listener with the given id
+const ErrNoSuchListener = ConstErr("ProxyListener has no listener with that id")
+
+// Returned by SetTransparentDest when the listener was added without a destination
+const ErrNotTransparent = ConstErr("listener does not have a transparent destination")
+
+// ListenerId returns the id the ProxyListener uses for a listener that was added to it, such as in ListenerEvents and for SetTransparentDest. Returns false if the listener isn't part of the ProxyListener
+func (listener *ProxyListener) ListenerId(inlisten net.Listener) (int, bool) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	// The set is locked while it is being iterated over so keep going after a match
+	id, found := 0, false
+	it := listener.inputListeners.Iterator()
+	for elem := range it.C {
+		if il := elem.(*listenerData); il.Listener == inlisten {
+			id, found = il.Id, true
+		}
+	}
+	return id, found
+}
+
+// SetTransparentDest changes the destination of a transparent or hybrid listener, identified by the id from ListenerId or its ListenerEvents. Connections the listener accepts afterwards go to the new destination and connections it has already accepted keep the one they had. The listener keeps accepting connections while the destination is changed
+func (listener *ProxyListener) SetTransparentDest(listenerId int, host string, port int, useTLS bool) error {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	// The set is locked while it is being iterated over so finish iterating before using the listener
+	var found *listenerData
+	it := listener.inputListeners.Iterator()
+	for elem := range it.C {
+		if il := elem.(*listenerData); il.Id == listenerId {
+			found = il
+		}
+	}
+	if found == nil {
+		return ErrNoSuchListener
+	}
+	if found.transparentDest() == nil {
+		return ErrNotTransparent
+	}
+	found.setTransparentDest(&proxyAddr{Host: host, Port: port, UseTLS: useTLS})
+	listener.logger.Printf("Listener %d now sends transparent connections to %s:%d", listenerId, host, port)
+	return nil
+}
+
+// The destination for transparent connections accepted by the listener. Has its own lock so the accept goroutine doesn't need the ProxyListener's
+func (il *listenerData) transparentDest() *proxyAddr {
+	il.destMtx.Lock()
+	defer il.destMtx.Unlock()
+
+	return il.dest
+}
+
+// Replace the destination for transparent connections. The old destination isn't modified since connections that were already accepted still use it
+func (il *listenerData) setTransparentDest(dest *proxyAddr) {
+	il.destMtx.Lock()
+	defer il.destMtx.Unlock()
+
+	il.dest = dest
+}
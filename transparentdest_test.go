@@ -0,0 +1,60 @@
+package puppy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestSetTransparentDest(t *testing.T) {
+	plistener := NewProxyListener(nil)
+	defer plistener.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testErr(t, err)
+	testErr(t, plistener.AddTransparentListener(l, "10.0.0.1", 80, false))
+	addr := l.Addr().String()
+	id, ok := plistener.ListenerId(l)
+	if !ok {
+		t.Fatal("listener that was added has no id")
+	}
+
+	before := testDial(t, addr)
+	defer before.Close()
+	fmt.Fprintf(before, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	beforeConn := testAccept(t, plistener)
+	defer beforeConn.Close()
+	checkStr(t, beforeConn.RemoteAddr().String(), EncodeRemoteAddr("10.0.0.1", 80, false))
+
+	testErr(t, plistener.SetTransparentDest(id, "10.0.0.2", 8080, false))
+
+	after := testDial(t, addr)
+	defer after.Close()
+	fmt.Fprintf(after, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	afterConn := testAccept(t, plistener)
+	defer afterConn.Close()
+	checkStr(t, afterConn.RemoteAddr().String(), EncodeRemoteAddr("10.0.0.2", 8080, false))
+
+	// Connections that were already accepted keep where they were going
+	checkStr(t, beforeConn.RemoteAddr().String(), EncodeRemoteAddr("10.0.0.1", 80, false))
+}
+
+func TestSetTransparentDestErrors(t *testing.T) {
+	plistener := NewProxyListener(nil)
+	defer plistener.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testErr(t, err)
+	testErr(t, plistener.AddListener(l))
+	id, _ := plistener.ListenerId(l)
+
+	if err := plistener.SetTransparentDest(id, "10.0.0.1", 80, false); err != ErrNotTransparent {
+		t.Errorf("expected ErrNotTransparent, got %v", err)
+	}
+	if err := plistener.SetTransparentDest(id+1000, "10.0.0.1", 80, false); err != ErrNoSuchListener {
+		t.Errorf("expected ErrNoSuchListener, got %v", err)
+	}
+
+	testErr(t, plistener.RemoveListener(l))
+	if _, ok := plistener.ListenerId(l); ok {
+		t.Error("expected a removed listener to have no id")
+	}
+}
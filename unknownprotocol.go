@@ -0,0 +1,35 @@
+package puppy
+
+/*
+Handling transparent connections that are not TLS or HTTP
+*/
+
+import (
+	"time"
+)
+
+// UnknownProtocolMode is what a transparent listener does with connections that do not look like TLS or HTTP
+type UnknownProtocolMode int
+
+const (
+	// Close the connection
+	UnknownProtocolClose UnknownProtocolMode = iota
+	// Accept the connection with a Protocol of ProtocolUnknown so that it can be relayed as-is
+	UnknownProtocolEmit
+)
+
+// SetUnknownProtocolMode sets what transparent listeners do with connections that are not TLS, HTTP, or h2c. When using UnknownProtocolEmit, connections where the client has not sent enough data to tell what it is speaking after waitTimeout (ie when the server is expected to talk first) are also accepted as ProtocolUnknown. A waitTimeout of zero waits forever. Any data read while figuring out the protocol can still be read from the accepted ProxyConn.
+func (listener *ProxyListener) SetUnknownProtocolMode(mode UnknownProtocolMode, waitTimeout time.Duration) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.unknownProtocolMode = mode
+	listener.unknownProtocolWait = waitTimeout
+}
+
+func (listener *ProxyListener) getUnknownProtocolMode() (UnknownProtocolMode, time.Duration) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.unknownProtocolMode, listener.unknownProtocolWait
+}
@@ -0,0 +1,51 @@
+package puppy
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTransparentUnknownProtocol(t *testing.T) {
+	plistener := NewProxyListener(nil)
+	addr := testTransparentListener(t, plistener, "10.0.0.2", 22, false)
+	banner := "SSH-2.0-OpenSSH_9.0\r\n"
+
+	// Closed by default
+	c := testDial(t, addr)
+	defer c.Close()
+	c.Write([]byte(banner))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := c.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Error("unknown protocol connection was not closed")
+	}
+
+	plistener.SetUnknownProtocolMode(UnknownProtocolEmit, 50*time.Millisecond)
+	c2 := testDial(t, addr)
+	defer c2.Close()
+	c2.Write([]byte(banner))
+	pconn := testAccept(t, plistener)
+	if pconn.Protocol() != ProtocolUnknown {
+		t.Errorf("expected unknown protocol, got %s", pconn.Protocol())
+	}
+	checkStr(t, pconn.RemoteAddr().String(), EncodeRemoteAddr("10.0.0.2", 22, false))
+	read := make([]byte, len(banner))
+	if _, err := io.ReadFull(pconn, read); err != nil {
+		t.Fatal(err)
+	}
+	checkStr(t, string(read), banner)
+
+	// Clients waiting for the server to talk first
+	c3 := testDial(t, addr)
+	defer c3.Close()
+	pconn = testAccept(t, plistener)
+	if pconn.Protocol() != ProtocolUnknown {
+		t.Errorf("expected unknown protocol, got %s", pconn.Protocol())
+	}
+	c3.Write([]byte("EHLO"))
+	read = make([]byte, 4)
+	if _, err := io.ReadFull(pconn, read); err != nil {
+		t.Fatal(err)
+	}
+	checkStr(t, string(read), "EHLO")
+}
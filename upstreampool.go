@@ -0,0 +1,162 @@
+package puppy
+
+/*
+Keeping idle upstream connections open so they can be reused for later requests to the same destination
+*/
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// How long to wait for data when checking whether an idle upstream connection is still usable
+const upstreamCheckTimeout = time.Millisecond
+
+// Idle upstream connections grouped by destination
+type upstreamPool struct {
+	mtx         sync.Mutex
+	maxIdle     int
+	idleTimeout time.Duration
+	idle        map[string][]*idleUpstream
+	closed      bool
+}
+
+// A connection waiting in the pool. The timer closes it once it has been idle for too long
+type idleUpstream struct {
+	conn  net.Conn
+	timer *time.Timer
+}
+
+func upstreamPoolKey(host string, port int, useTLS bool) string {
+	return fmt.Sprintf("%s:%d:%t", host, port, useTLS)
+}
+
+// SetUpstreamPool sets how many idle connections to each destination DialUpstream keeps for reuse and how long they are kept. Connections are only returned to the pool with ReleaseUpstream. The pool is only meant for request and response exchanges, so tunnels, Forward, Repeat, and Dialer always open new connections. TLS connections are not pooled while SetUpstreamSNI is in use. A maxIdle of 0 or less disables the pool and an idleTimeout of 0 or less keeps idle connections until they are reused or go stale. Connections that were in the previous pool are closed
+func (listener *ProxyListener) SetUpstreamPool(maxIdle int, idleTimeout time.Duration) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	if listener.upstreamPool != nil {
+		listener.upstreamPool.close()
+		listener.upstreamPool = nil
+	}
+	if maxIdle > 0 {
+		listener.upstreamPool = &upstreamPool{
+			maxIdle:     maxIdle,
+			idleTimeout: idleTimeout,
+			idle:        make(map[string][]*idleUpstream),
+		}
+	}
+}
+
+func (listener *ProxyListener) getUpstreamPool() *upstreamPool {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.upstreamPool
+}
+
+// ReleaseUpstream returns a connection made by DialUpstream to the given destination to the upstream pool so it can be reused. Only release connections that are idle and can carry another request, such as after a keep-alive response has been read in full. If there is no pool or the pool for the destination is full, the connection is closed
+func (listener *ProxyListener) ReleaseUpstream(conn net.Conn, host string, port int, useTLS bool) {
+	conn.SetDeadline(time.Time{})
+	pool := listener.getUpstreamPool()
+	// A TLS connection's server name may have been picked for the client it was dialed for
+	if pool == nil || (useTLS && listener.getUpstreamSNI() != nil) || !pool.put(upstreamPoolKey(host, port, useTLS), conn) {
+		conn.Close()
+	}
+}
+
+// Add an idle connection to the pool. Returns false if it was not added
+func (p *upstreamPool) put(key string, conn net.Conn) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.closed || len(p.idle[key]) >= p.maxIdle {
+		return false
+	}
+	entry := &idleUpstream{conn: conn}
+	if p.idleTimeout > 0 {
+		entry.timer = time.AfterFunc(p.idleTimeout, func() {
+			if p.remove(key, entry) {
+				conn.Close()
+			}
+		})
+	}
+	p.idle[key] = append(p.idle[key], entry)
+	return true
+}
+
+// Remove an entry from the pool. Returns false if it was already taken out
+func (p *upstreamPool) remove(key string, entry *idleUpstream) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	entries := p.idle[key]
+	for i, e := range entries {
+		if e == entry {
+			p.idle[key] = append(entries[:i], entries[i+1:]...)
+			if len(p.idle[key]) == 0 {
+				delete(p.idle, key)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Take the most recently used idle connection for a destination out of the pool. Connections that were closed by the server or have unexpected data waiting are closed and skipped. Returns nil if there are no usable connections
+func (p *upstreamPool) get(key string) net.Conn {
+	for {
+		p.mtx.Lock()
+		entries := p.idle[key]
+		if len(entries) == 0 {
+			p.mtx.Unlock()
+			return nil
+		}
+		entry := entries[len(entries)-1]
+		p.idle[key] = entries[:len(entries)-1]
+		if len(p.idle[key]) == 0 {
+			delete(p.idle, key)
+		}
+		p.mtx.Unlock()
+
+		if entry.timer != nil {
+			entry.timer.Stop()
+		}
+		if upstreamUsable(entry.conn) {
+			return entry.conn
+		}
+		entry.conn.Close()
+	}
+}
+
+// Close every idle connection and stop accepting new ones
+func (p *upstreamPool) close() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.closed = true
+	for _, entries := range p.idle {
+		for _, entry := range entries {
+			if entry.timer != nil {
+				entry.timer.Stop()
+			}
+			entry.conn.Close()
+		}
+	}
+	p.idle = nil
+}
+
+// Check that an idle connection has not been closed by the other side. An idle connection should have nothing to read, so anything other than a timeout means it can't be reused. The check reads from the connection, so a byte that arrived while the connection was idle is thrown away, but the connection is closed rather than reused in that case anyway
+func upstreamUsable(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(upstreamCheckTimeout))
+	n, err := conn.Read(make([]byte, 1))
+	conn.SetReadDeadline(time.Time{})
+	if n > 0 {
+		return false
+	}
+	neterr, ok := err.(net.Error)
+	return ok && neterr.Timeout()
+}
@@ -0,0 +1,251 @@
+package puppy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A server that echoes lines and keeps track of the connections made to it
+type testUpstreamServer struct {
+	listener net.Listener
+	host     string
+	port     int
+
+	mtx   sync.Mutex
+	conns []net.Conn
+	// Closed with the index of a connection once the server sees it closed
+	closed chan int
+}
+
+func newTestUpstreamServer(t *testing.T) *testUpstreamServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	s := &testUpstreamServer{listener: l, host: addr.IP.String(), port: addr.Port, closed: make(chan int, 16)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mtx.Lock()
+			idx := len(s.conns)
+			s.conns = append(s.conns, c)
+			s.mtx.Unlock()
+			go func() {
+				r := bufio.NewReader(c)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						s.closed <- idx
+						return
+					}
+					c.Write([]byte(line))
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *testUpstreamServer) accepted() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.conns)
+}
+
+func (s *testUpstreamServer) conn(idx int) net.Conn {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.conns[idx]
+}
+
+func testEcho(t *testing.T, conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStr(t, line, "ping\n")
+}
+
+func (s *testUpstreamServer) waitClosed(t *testing.T, idx int) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case closed := <-s.closed:
+			if closed == idx {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("connection %d was not closed", idx)
+		}
+	}
+}
+
+func TestUpstreamPoolReuse(t *testing.T) {
+	server := newTestUpstreamServer(t)
+	plistener := NewProxyListener(nil)
+	defer plistener.Close()
+	plistener.SetUpstreamPool(2, time.Minute)
+
+	conn, err := plistener.DialUpstream(server.host, server.port, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEcho(t, conn)
+	plistener.ReleaseUpstream(conn, server.host, server.port, false)
+
+	reused, err := plistener.DialUpstream(server.host, server.port, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reused.Close()
+	if reused != conn {
+		t.Error("expected the idle connection to be reused")
+	}
+	testEcho(t, reused)
+	if n := server.accepted(); n != 1 {
+		t.Errorf("expected 1 upstream connection, got %d", n)
+	}
+}
+
+func TestUpstreamPoolStale(t *testing.T) {
+	server := newTestUpstreamServer(t)
+	plistener := NewProxyListener(nil)
+	defer plistener.Close()
+	plistener.SetUpstreamPool(2, time.Minute)
+
+	conn, err := plistener.DialUpstream(server.host, server.port, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEcho(t, conn)
+	plistener.ReleaseUpstream(conn, server.host, server.port, false)
+
+	// The server hangs up while the connection is idle
+	server.conn(0).Close()
+	server.waitClosed(t, 0)
+
+	fresh, err := plistener.DialUpstream(server.host, server.port, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	if fresh == conn {
+		t.Fatal("expected a stale connection not to be reused")
+	}
+	testEcho(t, fresh)
+	if n := server.accepted(); n != 2 {
+		t.Errorf("expected 2 upstream connections, got %d", n)
+	}
+}
+
+func TestUpstreamPoolEviction(t *testing.T) {
+	t.Run("idle timeout", func(t *testing.T) {
+		server := newTestUpstreamServer(t)
+		plistener := NewProxyListener(nil)
+		defer plistener.Close()
+		plistener.SetUpstreamPool(2, 50*time.Millisecond)
+
+		conn, err := plistener.DialUpstream(server.host, server.port, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testEcho(t, conn)
+		plistener.ReleaseUpstream(conn, server.host, server.port, false)
+		server.waitClosed(t, 0)
+
+		if _, err := conn.Read(make([]byte, 1)); err == nil || err == io.EOF {
+			t.Errorf("expected the evicted connection to be closed locally, got %v", err)
+		}
+	})
+
+	t.Run("max idle", func(t *testing.T) {
+		server := newTestUpstreamServer(t)
+		plistener := NewProxyListener(nil)
+		defer plistener.Close()
+		plistener.SetUpstreamPool(1, time.Minute)
+
+		first, err := plistener.DialUpstream(server.host, server.port, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := plistener.DialUpstream(server.host, server.port, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testEcho(t, first)
+		testEcho(t, second)
+		plistener.ReleaseUpstream(first, server.host, server.port, false)
+		plistener.ReleaseUpstream(second, server.host, server.port, false)
+		server.waitClosed(t, 1)
+	})
+
+	t.Run("listener closed", func(t *testing.T) {
+		server := newTestUpstreamServer(t)
+		plistener := NewProxyListener(nil)
+		plistener.SetUpstreamPool(1, time.Minute)
+
+		conn, err := plistener.DialUpstream(server.host, server.port, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testEcho(t, conn)
+		plistener.ReleaseUpstream(conn, server.host, server.port, false)
+		plistener.Close()
+		server.waitClosed(t, 0)
+	})
+}
+
+func TestUpstreamPoolNotUsedForTunnels(t *testing.T) {
+	server := newTestUpstreamServer(t)
+	plistener, addr := testProxyListener(t)
+	plistener.SetUpstreamPool(2, time.Minute)
+	plistener.SetInterceptCIDR(nil, testCIDRs(t, "127.0.0.0/8"))
+
+	pooled, err := plistener.DialUpstream(server.host, server.port, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plistener.ReleaseUpstream(pooled, server.host, server.port, false)
+
+	// A bypassed CONNECT tunnels to the destination and must open its own connection
+	dest := net.JoinHostPort(server.host, fmt.Sprint(server.port))
+	c := testDial(t, addr)
+	defer c.Close()
+	r := bufio.NewReader(c)
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", dest, dest)
+	rsp, err := http.ReadResponse(r, nil)
+	testErr(t, err)
+	if rsp.StatusCode != 200 {
+		t.Fatalf("unexpected CONNECT status %d", rsp.StatusCode)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("ping\n"))
+	line, err := r.ReadString('\n')
+	testErr(t, err)
+	checkStr(t, line, "ping\n")
+	if n := server.accepted(); n != 2 {
+		t.Errorf("expected the tunnel to open a new connection, got %d upstream connections", n)
+	}
+
+	reused, err := plistener.DialUpstream(server.host, server.port, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reused.Close()
+	if reused != pooled {
+		t.Error("pooled connection was taken by the tunnel")
+	}
+}
@@ -0,0 +1,23 @@
+package puppy
+
+/*
+Choosing the server name sent to destinations independently of the one the client sent
+*/
+
+// UpstreamSNIFunc picks the server name to send when starting TLS with a destination. The client's server name is the one the client sent when TLS was stripped from it, or empty if there is no client connection or it didn't send one. Returning an empty string sends no server name
+type UpstreamSNIFunc func(clientSNI, dialHost string) string
+
+// SetUpstreamSNI sets the function that picks the server name sent by DialUpstream and the other dial helpers when connecting with TLS. It is used even when mirroring the client's ClientHello. If nil, the dial host is used, or the client's server name when mirroring. While it is set, TLS connections aren't taken from or given back to the pool set with SetUpstreamPool since the server name can differ between calls
+func (listener *ProxyListener) SetUpstreamSNI(sni UpstreamSNIFunc) {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	listener.upstreamSNI = sni
+}
+
+func (listener *ProxyListener) getUpstreamSNI() UpstreamSNIFunc {
+	listener.mtx.Lock()
+	defer listener.mtx.Unlock()
+
+	return listener.upstreamSNI
+}
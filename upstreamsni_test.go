@@ -0,0 +1,147 @@
+package puppy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Start a TLS server that reports the server name sent by each client
+func testSNIServer(t *testing.T) (int, chan string) {
+	cert, err := NewCACertSigner(testCA(t)).SignHost([]string{"upstream.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(chan string, 4)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			seen <- hello.ServerName
+			return nil, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.(*tls.Conn).Handshake()
+			c.Close()
+		}
+	}()
+	_, portStr, _ := net.SplitHostPort(l.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	return port, seen
+}
+
+func TestUpstreamSNI(t *testing.T) {
+	port, seen := testSNIServer(t)
+	plistener, addr := testProxyListener(t)
+	defer plistener.Close()
+	plistener.SetCACertificate(testCA(t))
+	plistener.SetResolver(func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+	})
+
+	dial := func(opts *DialOptions) string {
+		t.Helper()
+		conn, err := plistener.DialUpstreamWithOptions("upstream.test", port, true, opts)
+		testErr(t, err)
+		conn.Close()
+		select {
+		case sni := <-seen:
+			return sni
+		case <-time.After(5 * time.Second):
+			t.Fatal("upstream did not see a handshake")
+		}
+		return ""
+	}
+
+	checkStr(t, dial(nil), "upstream.test")
+
+	var gotClient, gotHost string
+	plistener.SetUpstreamSNI(func(clientSNI, dialHost string) string {
+		gotClient, gotHost = clientSNI, dialHost
+		return "front.example"
+	})
+	checkStr(t, dial(nil), "front.example")
+	checkStr(t, gotClient, "")
+	checkStr(t, gotHost, "upstream.test")
+
+	// The client's server name is passed along, even when mirroring would otherwise send it
+	conns := testAcceptAsync(plistener)
+	tlsc, err := testConnectTLS(t, addr, "example.com:443", &tls.Config{ServerName: "client.example", InsecureSkipVerify: true})
+	testErr(t, err)
+	defer tlsc.Close()
+	var pconn ProxyConn
+	select {
+	case pconn = <-conns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for connection")
+	}
+	defer pconn.Close()
+	checkStr(t, dial(&DialOptions{Client: pconn, MirrorClientHello: true}), "front.example")
+	checkStr(t, gotClient, "client.example")
+
+	plistener.SetUpstreamSNI(func(clientSNI, dialHost string) string {
+		return ""
+	})
+	checkStr(t, dial(nil), "")
+}
+
+func TestUpstreamSNIBypassesPool(t *testing.T) {
+	cert, err := NewCACertSigner(testCA(t)).SignHost([]string{"upstream.test"})
+	testErr(t, err)
+	seen := make(chan string, 4)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			seen <- hello.ServerName
+			return nil, nil
+		},
+	})
+	testErr(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// Stay open so the connection could be reused
+			go io.Copy(io.Discard, c)
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	plistener := NewProxyListener(nil)
+	defer plistener.Close()
+	plistener.SetUpstreamPool(4, time.Minute)
+	name := "a.example"
+	plistener.SetUpstreamSNI(func(clientSNI, dialHost string) string {
+		return name
+	})
+
+	for _, want := range []string{"a.example", "b.example"} {
+		name = want
+		conn, err := plistener.DialUpstream("127.0.0.1", port, true)
+		testErr(t, err)
+		testErr(t, conn.(*tls.Conn).Handshake())
+		select {
+		case sni := <-seen:
+			checkStr(t, sni, want)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no new handshake for %s, a pooled connection was reused", want)
+		}
+		plistener.ReleaseUpstream(conn, "127.0.0.1", port, true)
+	}
+}
@@ -0,0 +1,226 @@
+package puppy
+
+/*
+Decoding of raw websocket frames passing through a ProxyConn
+*/
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The most data that will be buffered while waiting for a frame or fragmented message to complete before inspection is abandoned
+const maxWSFrameBuffer = 16 * 1024 * 1024
+
+// WSFrame is a websocket frame seen on a ProxyConn. Fragmented messages are reassembled and delivered as a single frame once the final fragment arrives
+type WSFrame struct {
+	// The opcode of the frame. One of websocket.TextMessage, websocket.BinaryMessage, websocket.CloseMessage, websocket.PingMessage, or websocket.PongMessage
+	Opcode int
+
+	// The unmasked payload of the frame
+	Payload []byte
+
+	// The direction of the frame. Either ToServer or ToClient
+	Direction int
+
+	// Whether the frame was masked on the wire
+	Masked bool
+
+	// The number of frames the payload was sent in
+	Fragments int
+}
+
+// Incrementally decodes the frames sent in one direction of a websocket session
+type wsFrameParser struct {
+	direction int
+	hook      func(WSFrame)
+	buf       []byte
+	msg       *WSFrame // Fragmented message being reassembled
+	failed    bool
+	mem       *connMemory
+	charged   int // How much of the connection's memory limit the buffers are using
+}
+
+func newWSFrameParser(direction int, hook func(WSFrame), mem *connMemory) *wsFrameParser {
+	return &wsFrameParser{direction: direction, hook: hook, mem: mem}
+}
+
+// Stop counting the parser's buffers towards the connection's memory limit
+func (p *wsFrameParser) release() {
+	p.mem.resize(p.charged, 0)
+	p.charged = 0
+}
+
+// Add data from the connection to the parser and deliver any frames it completes
+func (p *wsFrameParser) feed(data []byte) error {
+	if p.failed {
+		return nil
+	}
+
+	p.buf = append(p.buf, data...)
+	for {
+		n, err := p.parseFrame()
+		if err != nil {
+			// Stop inspecting but let the data keep flowing
+			p.failed = true
+			p.buf = nil
+			p.msg = nil
+			p.release()
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		p.buf = p.buf[n:]
+	}
+
+	pending := len(p.buf)
+	if p.msg != nil {
+		pending += len(p.msg.Payload)
+	}
+	if pending > maxWSFrameBuffer {
+		p.failed = true
+		p.buf = nil
+		p.msg = nil
+		p.release()
+		return fmt.Errorf("websocket frame exceeds %d bytes", maxWSFrameBuffer)
+	}
+	if !p.mem.resize(p.charged, pending) {
+		p.failed = true
+		p.buf = nil
+		p.msg = nil
+		p.release()
+		return ErrConnMemoryLimit
+	}
+	p.charged = pending
+	if len(p.buf) == 0 {
+		p.buf = nil
+	}
+	return nil
+}
+
+// Parse one frame from the start of the buffer. Returns the number of bytes consumed or 0 if the frame is not complete
+func (p *wsFrameParser) parseFrame() (int, error) {
+	if len(p.buf) < 2 {
+		return 0, nil
+	}
+
+	fin := p.buf[0]&0x80 != 0
+	opcode := int(p.buf[0] & 0x0f)
+	masked := p.buf[1]&0x80 != 0
+	length := uint64(p.buf[1] & 0x7f)
+	off := 2
+
+	switch length {
+	case 126:
+		if len(p.buf) < off+2 {
+			return 0, nil
+		}
+		length = uint64(binary.BigEndian.Uint16(p.buf[off:]))
+		off += 2
+	case 127:
+		if len(p.buf) < off+8 {
+			return 0, nil
+		}
+		length = binary.BigEndian.Uint64(p.buf[off:])
+		off += 8
+		if length > maxWSFrameBuffer {
+			return 0, fmt.Errorf("websocket frame exceeds %d bytes", maxWSFrameBuffer)
+		}
+	}
+
+	var key []byte
+	if masked {
+		if len(p.buf) < off+4 {
+			return 0, nil
+		}
+		key = p.buf[off : off+4]
+		off += 4
+	}
+
+	if uint64(len(p.buf)-off) < length {
+		return 0, nil
+	}
+	end := off + int(length)
+
+	payload := make([]byte, length)
+	copy(payload, p.buf[off:end])
+	for i := range payload {
+		if masked {
+			payload[i] ^= key[i%4]
+		}
+	}
+
+	switch {
+	case opcode >= 8 && opcode <= 10:
+		// Control frames can't be fragmented but can be sent in the middle of a fragmented message
+		if !fin || length > 125 {
+			return 0, fmt.Errorf("invalid websocket control frame")
+		}
+		p.hook(WSFrame{Opcode: opcode, Payload: payload, Direction: p.direction, Masked: masked, Fragments: 1})
+	case opcode == 0:
+		if p.msg == nil {
+			return 0, fmt.Errorf("websocket continuation frame without a message to continue")
+		}
+		p.msg.Payload = append(p.msg.Payload, payload...)
+		p.msg.Fragments++
+		if fin {
+			p.hook(*p.msg)
+			p.msg = nil
+		}
+	case opcode == 1 || opcode == 2:
+		if p.msg != nil {
+			return 0, fmt.Errorf("websocket data frame sent before fragmented message was finished")
+		}
+		frame := WSFrame{Opcode: opcode, Payload: payload, Direction: p.direction, Masked: masked, Fragments: 1}
+		if fin {
+			p.hook(frame)
+		} else {
+			p.msg = &frame
+		}
+	default:
+		return 0, fmt.Errorf("unknown websocket opcode: %d", opcode)
+	}
+
+	return end, nil
+}
+
+func (pconn *proxyConn) SetWebSocketHook(hook func(frame WSFrame)) {
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+
+	// Buffers of the old parsers no longer count towards the memory limit
+	if pconn.wsFromClient != nil {
+		pconn.wsFromClient.release()
+		pconn.wsToClient.release()
+	}
+	if hook == nil {
+		pconn.wsFromClient = nil
+		pconn.wsToClient = nil
+		return
+	}
+	pconn.wsFromClient = newWSFrameParser(ToServer, hook, pconn.memory)
+	pconn.wsToClient = newWSFrameParser(ToClient, hook, pconn.memory)
+}
+
+func (pconn *proxyConn) getWSParsers() (*wsFrameParser, *wsFrameParser) {
+	pconn.mtx.Lock()
+	defer pconn.mtx.Unlock()
+
+	return pconn.wsFromClient, pconn.wsToClient
+}
+
+// Pass data that went through the connection to the websocket hook if one is set
+func (pconn *proxyConn) inspectWS(data []byte, fromClient bool) {
+	fromParser, toParser := pconn.getWSParsers()
+	parser := toParser
+	if fromClient {
+		parser = fromParser
+	}
+	if parser == nil {
+		return
+	}
+	if err := parser.feed(data); err != nil {
+		pconn.Logger().Printf("Stopped inspecting websocket frames on connection %d: %s", pconn.Id(), err)
+	}
+}
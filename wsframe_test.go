@@ -0,0 +1,142 @@
+package puppy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func testWSFrame(fin bool, opcode int, payload []byte, key []byte) []byte {
+	var frame []byte
+	b0 := byte(opcode)
+	if fin {
+		b0 |= 0x80
+	}
+	frame = append(frame, b0)
+
+	var maskBit byte
+	if key != nil {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		for i := 7; i >= 0; i-- {
+			frame = append(frame, byte(uint64(len(payload))>>(uint(i)*8)))
+		}
+	}
+
+	if key == nil {
+		return append(frame, payload...)
+	}
+	frame = append(frame, key...)
+	for i, b := range payload {
+		frame = append(frame, b^key[i%4])
+	}
+	return frame
+}
+
+func TestWSFrameParser(t *testing.T) {
+	key := []byte{0x12, 0x34, 0x56, 0x78}
+	big := bytes.Repeat([]byte("A"), 70000)
+
+	var data []byte
+	data = append(data, testWSFrame(true, websocket.TextMessage, []byte("single"), key)...)
+	data = append(data, testWSFrame(false, websocket.TextMessage, []byte("Hel"), key)...)
+	data = append(data, testWSFrame(true, websocket.PingMessage, []byte("ping"), key)...)
+	data = append(data, testWSFrame(true, 0, []byte("lo"), key)...)
+	data = append(data, testWSFrame(true, websocket.BinaryMessage, big, key)...)
+	data = append(data, testWSFrame(true, websocket.CloseMessage, []byte{0x03, 0xe8}, key)...)
+
+	var frames []WSFrame
+	parser := newWSFrameParser(ToServer, func(f WSFrame) {
+		frames = append(frames, f)
+	}, nil)
+
+	// Feed a byte at a time to make sure partial frames are handled
+	for i := range data {
+		testErr(t, parser.feed(data[i:i+1]))
+	}
+
+	expected := []WSFrame{
+		{Opcode: websocket.TextMessage, Payload: []byte("single"), Fragments: 1},
+		{Opcode: websocket.PingMessage, Payload: []byte("ping"), Fragments: 1},
+		{Opcode: websocket.TextMessage, Payload: []byte("Hello"), Fragments: 2},
+		{Opcode: websocket.BinaryMessage, Payload: big, Fragments: 1},
+		{Opcode: websocket.CloseMessage, Payload: []byte{0x03, 0xe8}, Fragments: 1},
+	}
+	if len(frames) != len(expected) {
+		t.Fatalf("expected %d frames, got %d", len(expected), len(frames))
+	}
+	for i, f := range frames {
+		e := expected[i]
+		if f.Opcode != e.Opcode || !bytes.Equal(f.Payload, e.Payload) || f.Fragments != e.Fragments {
+			t.Errorf("frame %d: expected opcode=%d fragments=%d, got opcode=%d fragments=%d len=%d", i, e.Opcode, e.Fragments, f.Opcode, f.Fragments, len(f.Payload))
+		}
+		if !f.Masked || f.Direction != ToServer {
+			t.Errorf("frame %d has incorrect masking or direction", i)
+		}
+	}
+}
+
+func TestWSFrameParserInvalid(t *testing.T) {
+	parser := newWSFrameParser(ToClient, func(f WSFrame) {
+		t.Errorf("unexpected frame delivered")
+	}, nil)
+
+	if err := parser.feed(testWSFrame(true, 0, []byte("orphan"), nil)); err == nil {
+		t.Error("expected error for continuation frame without a message")
+	}
+	// Inspection stops after an error
+	testErr(t, parser.feed(testWSFrame(true, websocket.TextMessage, []byte("ignored"), nil)))
+}
+
+func TestProxyConnWebSocketHook(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	pconn := newProxyConn(server, log.New(ioutil.Discard, "", 0))
+	defer pconn.Close()
+
+	var frames []WSFrame
+	pconn.SetWebSocketHook(func(f WSFrame) {
+		frames = append(frames, f)
+	})
+
+	fromClient := testWSFrame(true, websocket.TextMessage, []byte("to server"), []byte{1, 2, 3, 4})
+	toClient := testWSFrame(true, websocket.TextMessage, []byte("to client"), nil)
+
+	go client.Write(fromClient)
+	read := make([]byte, len(fromClient))
+	if _, err := io.ReadFull(pconn, read); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, fromClient) {
+		t.Error("frame was modified when read")
+	}
+
+	go io.ReadFull(client, make([]byte, len(toClient)))
+	if _, err := pconn.Write(toClient); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(frames) != 2 {
+		t.Fatalf("expected 2 frames, got %d", len(frames))
+	}
+	checkStr(t, string(frames[0].Payload), "to server")
+	if frames[0].Direction != ToServer {
+		t.Error("expected first frame to be sent to the server")
+	}
+	checkStr(t, string(frames[1].Payload), "to client")
+	if frames[1].Direction != ToClient || frames[1].Masked {
+		t.Error("expected second frame to be an unmasked frame sent to the client")
+	}
+}